@@ -1,6 +1,10 @@
 package auth
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -8,6 +12,7 @@ import (
 	"time"
 
 	"github.com/gomodule/redigo/redis"
+	"github.com/noisersup/encryptedfs-api/crypt"
 	l "github.com/noisersup/encryptedfs-api/logger"
 	"github.com/noisersup/encryptedfs-api/models"
 	uuid "github.com/satori/go.uuid"
@@ -15,11 +20,25 @@ import (
 )
 
 type Auth struct {
-	cache *redis.Pool
-	db    models.Database
+	cache  *redis.Pool
+	db     models.Database
+	secret []byte // server secret with which user keys are wrapped in sessions
 }
 
-func InitAuth(userDb models.Database, redisHost string) (*Auth, error) {
+// Session of signed in user
+type Session struct {
+	Username string
+	Key      []byte // user's key (available only for the session's lifetime)
+}
+
+// Session as stored in cache
+type cachedSession struct {
+	Username string `json:"username"`
+	Key      []byte `json:"key"` // user's key wrapped with key derived from server secret and session token
+}
+
+// secret is used to protect user keys stored in sessions
+func InitAuth(userDb models.Database, redisHost string, secret []byte) (*Auth, error) {
 	pool := &redis.Pool{
 		MaxIdle:     3,
 		IdleTimeout: 240 * time.Second,
@@ -36,9 +55,14 @@ func InitAuth(userDb models.Database, redisHost string) (*Auth, error) {
 		},
 	}
 
+	if len(secret) == 0 {
+		return nil, errors.New("no session secret provided")
+	}
+
 	a := Auth{
-		cache: pool,
-		db:    userDb,
+		cache:  pool,
+		db:     userDb,
+		secret: secret,
 	}
 
 	return &a, nil
@@ -63,10 +87,26 @@ func (a *Auth) Signin(username string, password string) (string, int) {
 		return "", http.StatusUnauthorized
 	}
 
-	sessionToken := uuid.NewV4().String()
+	key, err := a.unlockKey(username, password)
+	if err != nil {
+		l.Err("unlocking key of %s: %s", username, err.Error())
+		return "", http.StatusInternalServerError
+	}
+
+	// names can be encrypted only when user's key is available
+	if err = a.encryptNames(username, key); err != nil {
+		l.Err("encrypting names of %s: %s", username, err.Error())
+		return "", http.StatusInternalServerError
+	}
+
+	// users registered by older versions have no key pair with which files can be shared with them
+	if err = a.ensureKeyPair(username, key); err != nil {
+		l.Err("creating key pair of %s: %s", username, err.Error())
+		return "", http.StatusInternalServerError
+	}
 
 	conn := a.cache.Get()
-	_, err = conn.Do("SETEX", sessionToken, "120", username)
+	sessionToken, err := a.newSession(conn, &Session{username, key})
 	conn.Close()
 	if err != nil {
 		l.Err("redis error: %s", err.Error())
@@ -76,6 +116,137 @@ func (a *Auth) Signin(username string, password string) (string, int) {
 	return sessionToken, http.StatusOK
 }
 
+// Decrypts user's key with key derived from the password
+func (a *Auth) unlockKey(username, password string) ([]byte, error) {
+	userKey, err := a.db.GetKey(username)
+	if err != nil {
+		return nil, err
+	}
+
+	if userKey.Salt != nil {
+		return crypt.UnwrapKey(crypt.DeriveKey(password, userKey.Salt), userKey.Wrapped)
+	}
+
+	// key stored in plaintext by older version, protect it now
+	l.Log("Wrapping plaintext key of %s", username)
+	key := userKey.Wrapped
+	wrapped, err := wrapWithPassword(key, password)
+	if err != nil {
+		return nil, err
+	}
+	if err = a.db.SetKey(username, wrapped); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Encrypts names of user's files stored in plaintext by older versions (only until they are migrated)
+func (a *Auth) encryptNames(username string, key []byte) error {
+	root, err := a.db.GetRoot(username)
+	if err != nil {
+		return err
+	}
+	n, err := a.db.EncryptNames(key, root)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		l.Log("Encrypted %d names of %s", n, username)
+	}
+	return nil
+}
+
+// Creates key pair of user if the user doesn't have one
+func (a *Auth) ensureKeyPair(username string, key []byte) error {
+	pair, err := a.db.GetKeyPair(username)
+	if err != nil {
+		return err
+	}
+	if pair.Public != nil {
+		return nil
+	}
+	l.Log("Creating key pair of %s", username)
+	if pair, err = newKeyPair(key); err != nil {
+		return err
+	}
+	return a.db.SetKeyPair(username, pair)
+}
+
+// Generates key pair with private key wrapped with user's key
+func newKeyPair(key []byte) (*models.KeyPair, error) {
+	public, private, err := crypt.NewKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := crypt.WrapKey(key, private)
+	if err != nil {
+		return nil, err
+	}
+	return &models.KeyPair{Public: public, WrappedPrivate: wrapped}, nil
+}
+
+// Wraps key with key derived from the password and a new salt
+func wrapWithPassword(key []byte, password string) (*models.UserKey, error) {
+	salt, err := crypt.NewSalt()
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := crypt.WrapKey(crypt.DeriveKey(password, salt), key)
+	if err != nil {
+		return nil, err
+	}
+	return &models.UserKey{Wrapped: wrapped, Salt: salt}, nil
+}
+
+// Stores session in cache and returns its token
+func (a *Auth) newSession(conn redis.Conn, session *Session) (string, error) {
+	token := uuid.NewV4().String()
+
+	wrapped, err := crypt.WrapKey(a.sessionKek(token), session.Key)
+	if err != nil {
+		return "", err
+	}
+	value, err := json.Marshal(cachedSession{session.Username, wrapped})
+	if err != nil {
+		return "", err
+	}
+
+	_, err = conn.Do("SETEX", token, "120", value)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Reads session from cache
+// Returns nil session if token is not valid
+func (a *Auth) getSession(conn redis.Conn, token string) (*Session, error) {
+	value, err := redis.Bytes(conn.Do("GET", token))
+	if err != nil {
+		if err == redis.ErrNil {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var cached cachedSession
+	if err = json.Unmarshal(value, &cached); err != nil {
+		return nil, err
+	}
+	key, err := crypt.UnwrapKey(a.sessionKek(token), cached.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{cached.Username, key}, nil
+}
+
+// Key encryption key of the session with provided token
+func (a *Auth) sessionKek(token string) []byte {
+	h := hmac.New(sha256.New, a.secret)
+	h.Write([]byte(token))
+	return h.Sum(nil)
+}
+
 func (a *Auth) Signup(username string, password string) int {
 	/*
 		verify password and username len
@@ -86,7 +257,23 @@ func (a *Auth) Signup(username string, password string) int {
 		return http.StatusInternalServerError
 	}
 
-	err = a.db.NewUser(username, string(hash))
+	key, err := crypt.NewKey()
+	if err != nil {
+		log.Print("key: ", err)
+		return http.StatusInternalServerError
+	}
+	wrapped, err := wrapWithPassword(key, password)
+	if err != nil {
+		log.Print("key: ", err)
+		return http.StatusInternalServerError
+	}
+	pair, err := newKeyPair(key)
+	if err != nil {
+		log.Print("key: ", err)
+		return http.StatusInternalServerError
+	}
+
+	err = a.db.NewUser(username, string(hash), wrapped)
 
 	if err != nil {
 		if strings.Contains(err.Error(), "duplicate key value") {
@@ -97,34 +284,42 @@ func (a *Auth) Signup(username string, password string) int {
 		}
 	}
 
+	if err = a.db.SetKeyPair(username, pair); err != nil {
+		log.Print("db: ", err)
+		return http.StatusInternalServerError
+	}
+
 	return http.StatusCreated
 }
 
-func (a *Auth) Authorize(w http.ResponseWriter, r *http.Request) string {
+// Returns session of user who sent the request
+// If request is not authorized writes appropriate status and returns nil
+func (a *Auth) Authorize(w http.ResponseWriter, r *http.Request) *Session {
 	c, err := r.Cookie("session_token")
 	if err != nil {
 		if err == http.ErrNoCookie {
 			w.WriteHeader(http.StatusUnauthorized)
-			return ""
+			return nil
 		}
 		w.WriteHeader(http.StatusBadRequest)
-		return ""
+		return nil
 	}
 	token := c.Value
 
 	conn := a.cache.Get()
-	response, err := conn.Do("GET", token)
+	session, err := a.getSession(conn, token)
 	conn.Close()
 	if err != nil {
+		l.Err("session error: %s", err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
-		return ""
+		return nil
 	}
-	if response == nil {
+	if session == nil {
 		w.WriteHeader(http.StatusUnauthorized)
-		return ""
+		return nil
 	}
 
-	return fmt.Sprintf("%s", response)
+	return session
 }
 
 func (a *Auth) Logout(r *http.Request) int {
@@ -170,18 +365,17 @@ func (a *Auth) Refresh(r *http.Request) (*http.Cookie, int) {
 	userToken := cookie.Value
 
 	conn := a.cache.Get()
-	response, err := conn.Do("GET", userToken)
+	session, err := a.getSession(conn, userToken)
 	if err != nil {
 		conn.Close()
 		return nil, http.StatusInternalServerError
 	}
-	if response == nil {
+	if session == nil {
 		conn.Close()
 		return nil, http.StatusUnauthorized
 	}
 
-	newToken := uuid.NewV4().String()
-	_, err = conn.Do("SETEX", newToken, "120", fmt.Sprintf("%s", response))
+	newToken, err := a.newSession(conn, session)
 	if err != nil {
 		conn.Close()
 		return nil, http.StatusInternalServerError
@@ -198,3 +392,47 @@ func (a *Auth) Refresh(r *http.Request) (*http.Cookie, int) {
 		Expires: time.Now().Add(120 * time.Second),
 	}, http.StatusOK
 }
+
+// Failed attempts (e.g. wrong passwords) are counted in cache under provided keys,
+// so all servers share the counts and they survive restarts of the servers
+
+// Returns how long requests under key have to wait after limit of failed attempts was reached (0 if they don't)
+func (a *Auth) RetryAfter(key string, limit int) (time.Duration, error) {
+	conn := a.cache.Get()
+	defer conn.Close()
+
+	failures, err := redis.Int(conn.Do("GET", "attempts:"+key))
+	if err != nil {
+		if err == redis.ErrNil {
+			return 0, nil
+		}
+		return 0, err
+	}
+	if failures < limit {
+		return 0, nil
+	}
+	ttl, err := redis.Int64(conn.Do("PTTL", "attempts:"+key))
+	if err != nil || ttl < 0 {
+		return 0, err
+	}
+	return time.Duration(ttl) * time.Millisecond, nil
+}
+
+// Counts failed attempt under key
+// Counts are removed after window passes since the first counted failure
+func (a *Auth) Fail(key string, window time.Duration) error {
+	conn := a.cache.Get()
+	defer conn.Close()
+
+	_, err := failScript.Do(conn, "attempts:"+key, window.Milliseconds())
+	return err
+}
+
+// Increments counter and sets its expiration when it's created (atomically, so it can't be left without one)
+var failScript = redis.NewScript(1, `
+	local n = redis.call("INCR", KEYS[1])
+	if n == 1 then
+		redis.call("PEXPIRE", KEYS[1], ARGV[1])
+	end
+	return n
+`)
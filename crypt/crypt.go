@@ -0,0 +1,109 @@
+/*
+	Cryptographic helpers shared by server and database
+*/
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Size of all symmetric keys (AES-256)
+const KeySize = 32
+
+var ErrUnwrap error = errors.New("cannot unwrap key")
+var ErrDecrypt error = errors.New("cannot decrypt data")
+
+// Generates new random key
+func NewKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Encrypts key with key encryption key (kek)
+// Returns nonce followed by AES-GCM ciphertext
+func WrapKey(kek, key []byte) ([]byte, error) {
+	return Encrypt(kek, key)
+}
+
+// Decrypts key wrapped with WrapKey
+// Returns ErrUnwrap if kek is wrong or wrapped key was modified
+func UnwrapKey(kek, wrapped []byte) ([]byte, error) {
+	key, err := Decrypt(kek, wrapped)
+	if err == ErrDecrypt {
+		return nil, ErrUnwrap
+	}
+	return key, err
+}
+
+// Encrypts small piece of data with key
+// Returns nonce followed by AES-GCM ciphertext
+func Encrypt(key, data []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, nil), nil
+}
+
+// Decrypts data encrypted with Encrypt
+// Returns ErrDecrypt if key is wrong or data was modified
+func Decrypt(key, encrypted []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(encrypted) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrDecrypt
+	}
+	nonce := encrypted[:aead.NonceSize()]
+	data, err := aead.Open(nil, nonce, encrypted[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return data, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Parameters of Argon2id used for password based key derivation
+const (
+	argonTime    = 1
+	argonMemory  = 64 * 1024
+	argonThreads = 4
+	SaltSize     = 16
+)
+
+// Generates new random salt for DeriveKey
+func NewSalt() ([]byte, error) {
+	salt := make([]byte, SaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// Derives key encryption key from user's password (Argon2id)
+func DeriveKey(password string, salt []byte) []byte {
+	return argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, KeySize)
+}
@@ -0,0 +1,132 @@
+package crypt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrapKey(t *testing.T) {
+	kek, err := NewKey()
+	assert.NoError(t, err)
+	key, err := NewKey()
+	assert.NoError(t, err)
+
+	wrapped, err := WrapKey(kek, key)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(wrapped), string(key))
+
+	unwrapped, err := UnwrapKey(kek, wrapped)
+	assert.NoError(t, err)
+	assert.Equal(t, key, unwrapped)
+
+	otherKek, _ := NewKey()
+	_, err = UnwrapKey(otherKek, wrapped)
+	assert.Equal(t, ErrUnwrap, err)
+
+	wrapped[len(wrapped)-1] ^= 1
+	_, err = UnwrapKey(kek, wrapped)
+	assert.Equal(t, ErrUnwrap, err)
+
+	_, err = UnwrapKey(kek, wrapped[:5])
+	assert.Equal(t, ErrUnwrap, err)
+}
+
+func TestDeriveKey(t *testing.T) {
+	salt, err := NewSalt()
+	assert.NoError(t, err)
+
+	key := DeriveKey("password", salt)
+	assert.Len(t, key, KeySize)
+	assert.Equal(t, key, DeriveKey("password", salt))
+	assert.NotEqual(t, key, DeriveKey("Password", salt))
+
+	otherSalt, _ := NewSalt()
+	assert.NotEqual(t, key, DeriveKey("password", otherSalt))
+}
+
+func TestEncryptName(t *testing.T) {
+	key, _ := NewKey()
+
+	enc, err := EncryptName(key, "report.pdf")
+	assert.NoError(t, err)
+	assert.NotContains(t, enc, "report")
+
+	again, err := EncryptName(key, "report.pdf")
+	assert.NoError(t, err)
+	assert.Equal(t, enc, again, "encryption must be deterministic")
+
+	other, _ := EncryptName(key, "report.pdg")
+	assert.NotEqual(t, enc, other)
+
+	name, err := DecryptName(key, enc)
+	assert.NoError(t, err)
+	assert.Equal(t, "report.pdf", name)
+
+	otherKey, _ := NewKey()
+	_, err = DecryptName(otherKey, enc)
+	assert.Equal(t, ErrName, err)
+
+	_, err = DecryptName(key, "plain.txt")
+	assert.Equal(t, ErrName, err)
+}
+
+func TestSearchTokens(t *testing.T) {
+	key, _ := NewKey()
+	name := NameTokens(key, "Annual Report.pdf")
+
+	assert.Subset(t, name, SearchTokens(key, "report", false, false))
+	assert.Subset(t, name, SearchTokens(key, "ann", true, false))
+	assert.Subset(t, name, SearchTokens(key, ".pdf", false, true))
+	assert.NotSubset(t, name, SearchTokens(key, "report", true, false))
+	assert.NotSubset(t, name, SearchTokens(key, "invoice", false, false))
+	assert.Nil(t, SearchTokens(key, "an", false, false))
+
+	otherKey, _ := NewKey()
+	assert.NotSubset(t, name, SearchTokens(otherKey, "report", false, false))
+}
+
+func TestLinkKey(t *testing.T) {
+	token, err := NewLinkToken()
+	assert.NoError(t, err)
+	otherToken, _ := NewLinkToken()
+	assert.NotEqual(t, token, otherToken)
+	assert.Len(t, LinkTokenHash(token), 64)
+	assert.Equal(t, LinkTokenHash(token), LinkTokenHash(token))
+
+	key, _ := NewKey()
+	wrapped, err := WrapKey(LinkKey(token, "secret"), key)
+	assert.NoError(t, err)
+
+	unwrapped, err := UnwrapKey(LinkKey(token, "secret"), wrapped)
+	assert.NoError(t, err)
+	assert.Equal(t, key, unwrapped)
+
+	for _, kek := range [][]byte{LinkKey(token, ""), LinkKey(token, "wrong"), LinkKey(otherToken, "secret")} {
+		_, err = UnwrapKey(kek, wrapped)
+		assert.Equal(t, ErrUnwrap, err)
+	}
+}
+
+func TestSealKey(t *testing.T) {
+	public, private, err := NewKeyPair()
+	assert.NoError(t, err)
+	_, otherPrivate, _ := NewKeyPair()
+
+	key, _ := NewKey()
+	sealed, err := SealKey(public, key)
+	assert.NoError(t, err)
+
+	opened, err := OpenKey(private, sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, key, opened)
+
+	_, err = OpenKey(otherPrivate, sealed)
+	assert.Equal(t, ErrSealed, err)
+
+	sealed[len(sealed)-1] ^= 1
+	_, err = OpenKey(private, sealed)
+	assert.Equal(t, ErrSealed, err)
+	_, err = OpenKey(private, sealed[:10])
+	assert.Equal(t, ErrSealed, err)
+}
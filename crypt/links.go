@@ -0,0 +1,47 @@
+package crypt
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+)
+
+/*
+	Share links
+
+	Token of a link is a random secret known only to people who received the link.
+	Server stores only its hash (to find the link) and a key wrapped with key derived from the token
+	(and the password of the link if it has one), so the key can't be unwrapped without the token.
+*/
+
+const linkTokenSize = 32
+
+// Generates new random token of share link (URL safe)
+func NewLinkToken() (string, error) {
+	token := make([]byte, linkTokenSize)
+	if _, err := io.ReadFull(rand.Reader, token); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// Returns hex encoded hash of token under which the link is stored
+func LinkTokenHash(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// Derives key encryption key of share link from its token and password (empty if link has no password)
+func LinkKey(token, password string) []byte {
+	kek := subKey([]byte(token), "share-link")
+	if password == "" {
+		return kek
+	}
+	salt := subKey([]byte(token), "share-link-salt")[:SaltSize]
+	h := hmac.New(sha256.New, kek)
+	h.Write(DeriveKey(password, salt))
+	return h.Sum(nil)
+}
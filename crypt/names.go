@@ -0,0 +1,80 @@
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+)
+
+var ErrName error = errors.New("cannot decrypt name")
+
+/*
+	Deterministic encryption of file names (SIV construction)
+
+	iv   = HMAC-SHA256(mac key, name)[:16]
+	name = base64url(iv || AES-CTR(enc key, iv, name))
+
+	Mac and enc keys are derived from provided key,
+	so the same name encrypted with the same key always gives the same ciphertext
+	and lookups by equality still work.
+*/
+
+const nameIVSize = 16
+
+func nameKeys(key []byte) (macKey, encKey []byte) {
+	return subKey(key, "name-mac"), subKey(key, "name-enc")
+}
+
+// Derives independent key for provided purpose
+func subKey(key []byte, purpose string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(purpose))
+	return h.Sum(nil)
+}
+
+func EncryptName(key []byte, name string) (string, error) {
+	macKey, encKey := nameKeys(key)
+
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write([]byte(name))
+	iv := mac.Sum(nil)[:nameIVSize]
+
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return "", err
+	}
+
+	out := make([]byte, nameIVSize+len(name))
+	copy(out, iv)
+	cipher.NewCTR(block, iv).XORKeyStream(out[nameIVSize:], []byte(name))
+	return base64.RawURLEncoding.EncodeToString(out), nil
+}
+
+// Decrypts name encrypted with EncryptName
+// Returns ErrName if key is wrong or name was modified
+func DecryptName(key []byte, encrypted string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encrypted)
+	if err != nil || len(data) < nameIVSize {
+		return "", ErrName
+	}
+	macKey, encKey := nameKeys(key)
+
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return "", err
+	}
+
+	iv := data[:nameIVSize]
+	name := make([]byte, len(data)-nameIVSize)
+	cipher.NewCTR(block, iv).XORKeyStream(name, data[nameIVSize:])
+
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(name)
+	if !hmac.Equal(mac.Sum(nil)[:nameIVSize], iv) {
+		return "", ErrName
+	}
+	return string(name), nil
+}
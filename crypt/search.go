@@ -0,0 +1,65 @@
+package crypt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+/*
+	Blind index of file names
+
+	Lowercase names are split into trigrams (with markers of beginning and end of the name)
+	and every trigram is replaced with truncated HMAC of it.
+	Database can find names containing searched text by comparing tokens
+	without learning neither names nor the text.
+	Tokens are truncated, so found names have to be verified after decryption.
+*/
+
+const (
+	nameStart = '\x02'
+	nameEnd   = '\x03'
+	tokenSize = 8
+)
+
+// Returns tokens of all trigrams of name
+func NameTokens(key []byte, name string) []string {
+	return tokens(key, string(nameStart)+strings.ToLower(name)+string(nameEnd))
+}
+
+// Returns tokens which have to be present in tokens of every name containing text
+// atStart and atEnd mark text as the beginning or the end of name
+// Returns nil if text is too short to be searched with tokens
+func SearchTokens(key []byte, text string, atStart, atEnd bool) []string {
+	text = strings.ToLower(text)
+	if atStart {
+		text = string(nameStart) + text
+	}
+	if atEnd {
+		text = text + string(nameEnd)
+	}
+	return tokens(key, text)
+}
+
+// Returns unique tokens of trigrams of s
+func tokens(key []byte, s string) []string {
+	runes := []rune(s)
+	if len(runes) < 3 {
+		return nil
+	}
+	macKey := subKey(key, "name-search")
+
+	seen := map[string]bool{}
+	out := []string{}
+	for i := 0; i+3 <= len(runes); i++ {
+		mac := hmac.New(sha256.New, macKey)
+		mac.Write([]byte(string(runes[i : i+3])))
+		token := hex.EncodeToString(mac.Sum(nil)[:tokenSize])
+		if !seen[token] {
+			seen[token] = true
+			out = append(out, token)
+		}
+	}
+	return out
+}
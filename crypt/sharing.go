@@ -0,0 +1,96 @@
+package crypt
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+/*
+	Sharing keys between users
+
+	Every user has X25519 key pair, its private key is wrapped with user's key.
+	Key is sealed for a user (who doesn't have to be signed in) with ephemeral key pair:
+
+	secret = X25519(ephemeral private, recipient public)
+	kek    = HKDF-SHA256(secret, salt = ephemeral public || recipient public)
+	sealed = ephemeral public || WrapKey(kek, key)
+
+	so it can be opened only with private key of the recipient.
+*/
+
+var ErrSealed error = errors.New("cannot open sealed key")
+
+// Generates new X25519 key pair
+func NewKeyPair() (public, private []byte, err error) {
+	private = make([]byte, curve25519.ScalarSize)
+	if _, err = io.ReadFull(rand.Reader, private); err != nil {
+		return nil, nil, err
+	}
+	public, err = curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	return public, private, nil
+}
+
+// Encrypts key so it can be decrypted only with private key matching provided public key
+func SealKey(public, key []byte) ([]byte, error) {
+	ephemeralPublic, ephemeralPrivate, err := NewKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := curve25519.X25519(ephemeralPrivate, public)
+	if err != nil {
+		return nil, err
+	}
+	kek, err := sealKek(secret, ephemeralPublic, public)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := WrapKey(kek, key)
+	if err != nil {
+		return nil, err
+	}
+	return append(ephemeralPublic, wrapped...), nil
+}
+
+// Decrypts key sealed with SealKey
+// Returns ErrSealed if key was sealed for someone else or was modified
+func OpenKey(private, sealed []byte) ([]byte, error) {
+	if len(sealed) < curve25519.PointSize {
+		return nil, ErrSealed
+	}
+	ephemeralPublic := sealed[:curve25519.PointSize]
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := curve25519.X25519(private, ephemeralPublic)
+	if err != nil {
+		return nil, ErrSealed
+	}
+	kek, err := sealKek(secret, ephemeralPublic, public)
+	if err != nil {
+		return nil, err
+	}
+	key, err := UnwrapKey(kek, sealed[curve25519.PointSize:])
+	if err == ErrUnwrap {
+		return nil, ErrSealed
+	}
+	return key, err
+}
+
+// Derives key encryption key from shared secret of ephemeral and recipient's key pairs
+func sealKek(secret, ephemeralPublic, recipientPublic []byte) ([]byte, error) {
+	salt := append(append([]byte{}, ephemeralPublic...), recipientPublic...)
+	kek := make([]byte, KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte("sealed-key")), kek); err != nil {
+		return nil, err
+	}
+	return kek, nil
+}
@@ -5,30 +5,37 @@ package database
 
 import (
 	"context"
-	"crypto/rand"
 	"encoding/base64"
+	"errors"
+	"fmt"
 
+	"github.com/cockroachdb/cockroach-go/v2/crdb/crdbpgx"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/noisersup/encryptedfs-api/kms"
 	l "github.com/noisersup/encryptedfs-api/logger"
+	"github.com/noisersup/encryptedfs-api/models"
 )
 
+var UserNotFound error = errors.New("User not found")
+
 /*
 	Registers new user
 	!!! remember to provide bcrypt hash as password argument !!!
+	!!! and user's key wrapped with key derived from the password !!!
 */
-func (db *Database) NewUser(username, hashedPassword string) error {
-	key := make([]byte, 32)
-	_, err := rand.Read(key)
+func (db *Database) NewUser(username, hashedPassword string, key *models.UserKey) error {
+	keyB64, version, err := db.encryptKey(key.Wrapped)
 	if err != nil {
 		return err
 	}
-	keyB64 := base64.StdEncoding.EncodeToString(key)
 
 	var id uuid.UUID
 
 	l.LogV("Inserting into users...")
-	sqlFormula := "INSERT INTO users (username, password, key) VALUES ($1,$2,$3) RETURNING id;"
-	err = db.pool.QueryRow(context.Background(), sqlFormula, username, hashedPassword, keyB64).Scan(&id)
+	// new users have no names stored by older versions
+	sqlFormula := "INSERT INTO users (username, password, key, key_salt, key_version, names_migrated) VALUES ($1,$2,$3,$4,$5,TRUE) RETURNING id;"
+	err = db.pool.QueryRow(context.Background(), sqlFormula, username, hashedPassword, keyB64, key.Salt, version).Scan(&id)
 	if err != nil {
 		return err
 	}
@@ -62,21 +69,117 @@ func (db *Database) GetPasswordOfUser(username string) (string, error) {
 }
 
 /*
-gets hashing key of user
+gets wrapped key of user
 */
-func (db *Database) GetKey(username string) ([]byte, error) {
+func (db *Database) GetKey(username string) (*models.UserKey, error) {
 	var b64Decoded string
-	sqlFormula := "SELECT key FROM users WHERE username=$1;"
-	err := db.pool.QueryRow(context.Background(), sqlFormula, username).Scan(&b64Decoded)
+	var salt []byte
+	var version *int64
+	sqlFormula := "SELECT key, key_salt, key_version FROM users WHERE username=$1;"
+	err := db.pool.QueryRow(context.Background(), sqlFormula, username).Scan(&b64Decoded, &salt, &version)
 	if err != nil {
 		return nil, err
 	}
 
-	key, err := base64.StdEncoding.DecodeString(b64Decoded)
+	key, err := db.decryptKey(b64Decoded, version)
 	if err != nil {
 		return nil, err
 	}
-	return key, nil
+	return &models.UserKey{Wrapped: key, Salt: salt}, nil
+}
+
+// Replaces stored key of user (ex. after wrapping plaintext key of older versions)
+func (db *Database) SetKey(username string, key *models.UserKey) error {
+	keyB64, version, err := db.encryptKey(key.Wrapped)
+	if err != nil {
+		return err
+	}
+	sqlFormula := "UPDATE users SET key = $2, key_salt = $3, key_version = $4 WHERE username = $1;"
+	_, err = db.pool.Exec(context.Background(), sqlFormula, username, keyB64, key.Salt, version)
+	return err
+}
+
+/*
+	Re-encrypts keys of all users with current master key version
+	(blobs and keys wrapped by user keys stay untouched)
+	Every key is updated in its own transaction and keys already using current version are skipped,
+	so it's safe to run it again after it fails part way
+	Returns number of updated users
+*/
+func (db *Database) RewrapKeys() (int, error) {
+	current := int64(db.keys.CurrentVersion())
+
+	rows, err := db.pool.Query(context.Background(), "SELECT username FROM users WHERE key_version IS NULL OR key_version != $1;", current)
+	if err != nil {
+		return 0, err
+	}
+	usernames := []string{}
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		usernames = append(usernames, username)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, username := range usernames {
+		err := crdbpgx.ExecuteTx(context.Background(), db.pool, pgx.TxOptions{}, func(tx pgx.Tx) error {
+			var b64Encrypted string
+			var version *int64
+			err := tx.QueryRow(context.Background(), "SELECT key, key_version FROM users WHERE username = $1 FOR UPDATE;", username).Scan(&b64Encrypted, &version)
+			if err != nil {
+				return err
+			}
+			key, err := db.decryptKey(b64Encrypted, version)
+			if err != nil {
+				return err
+			}
+			keyB64, newVersion, err := db.encryptKey(key)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(context.Background(), "UPDATE users SET key = $2, key_version = $3 WHERE username = $1;", username, keyB64, newVersion)
+			return err
+		})
+		if err != nil {
+			return n, fmt.Errorf("rewrapping key of %s: %w", username, err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Encrypts key with master key
+// Returns base64 encoded ciphertext and version of used master key
+func (db *Database) encryptKey(key []byte) (string, int64, error) {
+	encrypted, err := db.keys.Encrypt(key)
+	if err != nil {
+		return "", 0, err
+	}
+	version, err := kms.Version(encrypted)
+	if err != nil {
+		return "", 0, err
+	}
+	return base64.StdEncoding.EncodeToString(encrypted), int64(version), nil
+}
+
+// Decrypts key stored in users table
+// Keys without version were stored by older versions without master key encryption
+func (db *Database) decryptKey(keyB64 string, version *int64) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(keyB64)
+	if err != nil {
+		return nil, err
+	}
+	if version == nil {
+		return key, nil
+	}
+	return db.keys.Decrypt(key)
 }
 
 func (db *Database) GetRoot(username string) (uuid.UUID, error) {
@@ -87,3 +190,31 @@ func (db *Database) GetRoot(username string) (uuid.UUID, error) {
 	}
 	return root, nil
 }
+
+// Gets key pair of user (its fields are nil if user has no key pair yet)
+// Returns UserNotFound if there is no such user
+func (db *Database) GetKeyPair(username string) (*models.KeyPair, error) {
+	pair := models.KeyPair{}
+	sqlFormula := "SELECT public_key, private_key FROM users WHERE username = $1;"
+	err := db.pool.QueryRow(context.Background(), sqlFormula, username).Scan(&pair.Public, &pair.WrappedPrivate)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, UserNotFound
+		}
+		return nil, err
+	}
+	return &pair, nil
+}
+
+// Stores key pair of user (private key has to be wrapped with user's key)
+func (db *Database) SetKeyPair(username string, pair *models.KeyPair) error {
+	sqlFormula := "UPDATE users SET public_key = $2, private_key = $3 WHERE username = $1;"
+	tag, err := db.pool.Exec(context.Background(), sqlFormula, username, pair.Public, pair.WrappedPrivate)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return UserNotFound
+	}
+	return nil
+}
@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/noisersup/encryptedfs-api/crypt"
+	"github.com/noisersup/encryptedfs-api/kms"
 	l "github.com/noisersup/encryptedfs-api/logger"
 	"github.com/noisersup/encryptedfs-api/models"
+	"github.com/noisersup/encryptedfs-api/storage"
 
 	"github.com/cockroachdb/cockroach-go/v2/crdb/crdbpgx"
 	"github.com/google/uuid"
@@ -15,13 +18,17 @@ import (
 )
 
 type Database struct {
-	pool *pgxpool.Pool // database connection
-	root uuid.UUID     // id of the root directory in database
+	pool  *pgxpool.Pool     // database connection
+	root  uuid.UUID         // id of the root directory in database
+	blobs storage.BlobStore // storage of encrypted file contents
+	keys  kms.KeyManager    // master keys encrypting user keys at rest
 }
 
 // Connects to database with provided data
 // and returns database object
-func ConnectDB(uri, database string, root string) (*Database, error) {
+// blobs is a storage from which contents of deleted files are removed
+// keys is used to encrypt keys of users stored in the database
+func ConnectDB(uri, database string, root string, blobs storage.BlobStore, keys kms.KeyManager) (*Database, error) {
 	config, err := pgxpool.ParseConfig(os.ExpandEnv(uri))
 	if err != nil {
 		return nil, err
@@ -34,7 +41,7 @@ func ConnectDB(uri, database string, root string) (*Database, error) {
 		return nil, err
 	}
 
-	db := Database{pool: pool}
+	db := Database{pool: pool, blobs: blobs, keys: keys}
 	db.createIfNotExists()
 
 	err = db.fetchRoot()
@@ -46,15 +53,24 @@ func ConnectDB(uri, database string, root string) (*Database, error) {
 }
 
 func (db *Database) createIfNotExists() {
-	var payloads [4]string
+	var payloads [49]string
 	payloads[0] = `
 	CREATE TABLE IF NOT EXISTS "file_tree" (
 	  "id" UUID NOT NULL UNIQUE DEFAULT gen_random_uuid(),
-	  "encrypted_name" STRING(255),
+	  "encrypted_name" STRING,
+	  "name_encrypted" BOOL,
 	  "hash" STRING(64),
 	  "duplicate" INT,
 	  "parent_id" UUID,
 	  "is_directory" BOOL,
+	  "wrapped_key" BYTES,
+	  "size" INT8,
+	  "content_type" STRING,
+	  "checksum" STRING(64),
+	  "created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+	  "modified_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+	  "name_tokens" STRING[],
+	  "version" INT8 NOT NULL DEFAULT 1,
 	  CONSTRAINT "primary" PRIMARY KEY (id ASC)
 	);
 	`
@@ -74,10 +90,270 @@ func (db *Database) createIfNotExists() {
 		"id" UUID NOT NULL UNIQUE DEFAULT gen_random_uuid(),
 		"username" STRING(16) NOT NULL UNIQUE,
 		"password" STRING(60) NOT NULL,
-		"key"	   STRING(44) NOT NULL UNIQUE,
+		"key"	   STRING NOT NULL UNIQUE,
+		"key_salt" BYTES,
+		"key_version" INT,
 		CONSTRAINT "primary" PRIMARY KEY (username)
 	);
 	`
+
+	// migrations of tables created by older versions
+	payloads[4] = `
+	ALTER TABLE file_tree ADD COLUMN IF NOT EXISTS "wrapped_key" BYTES;
+	`
+
+	payloads[5] = `
+	ALTER TABLE users ALTER COLUMN "key" TYPE STRING;
+	`
+
+	payloads[6] = `
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS "key_salt" BYTES;
+	`
+
+	payloads[7] = `
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS "key_version" INT;
+	`
+
+	payloads[8] = `
+	ALTER TABLE file_tree ALTER COLUMN "encrypted_name" TYPE STRING;
+	`
+
+	payloads[9] = `
+	ALTER TABLE file_tree ADD COLUMN IF NOT EXISTS "name_encrypted" BOOL;
+	`
+
+	payloads[10] = `
+	CREATE TABLE IF NOT EXISTS "uploads" (
+		"id" UUID NOT NULL DEFAULT gen_random_uuid(),
+		"owner" STRING NOT NULL,
+		"path" BYTES NOT NULL,
+		"size" INT8 NOT NULL,
+		"received" INT8 NOT NULL DEFAULT 0,
+		"parts" INT NOT NULL DEFAULT 0,
+		"header" BYTES NOT NULL,
+		"wrapped_key" BYTES NOT NULL,
+		"hash_state" BYTES,
+		"created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+		CONSTRAINT "primary" PRIMARY KEY (id)
+	);
+	`
+
+	payloads[11] = `
+	CREATE INDEX IF NOT EXISTS fileBlob ON file_tree (hash, duplicate);
+	`
+
+	payloads[12] = `
+	ALTER TABLE file_tree ADD COLUMN IF NOT EXISTS "size" INT8;
+	`
+
+	payloads[13] = `
+	ALTER TABLE file_tree ADD COLUMN IF NOT EXISTS "content_type" STRING;
+	`
+
+	payloads[14] = `
+	ALTER TABLE file_tree ADD COLUMN IF NOT EXISTS "checksum" STRING(64);
+	`
+
+	payloads[15] = `
+	ALTER TABLE file_tree ADD COLUMN IF NOT EXISTS "created_at" TIMESTAMPTZ NOT NULL DEFAULT now();
+	`
+
+	payloads[16] = `
+	ALTER TABLE file_tree ADD COLUMN IF NOT EXISTS "modified_at" TIMESTAMPTZ NOT NULL DEFAULT now();
+	`
+
+	payloads[17] = `
+	ALTER TABLE uploads ADD COLUMN IF NOT EXISTS "hash_state" BYTES;
+	`
+
+	// size of files from older versions is unknown (listed as 0)
+	payloads[18] = `
+	UPDATE file_tree SET size = 0 WHERE size IS NULL;
+	`
+
+	payloads[19] = `
+	CREATE INDEX IF NOT EXISTS fileSize ON file_tree (parent_id, size, id);
+	`
+
+	payloads[20] = `
+	CREATE INDEX IF NOT EXISTS fileModified ON file_tree (parent_id, modified_at, id);
+	`
+
+	payloads[21] = `
+	CREATE INDEX IF NOT EXISTS fileType ON file_tree (parent_id, is_directory);
+	`
+
+	payloads[22] = `
+	ALTER TABLE file_tree ADD COLUMN IF NOT EXISTS "name_tokens" STRING[];
+	`
+
+	payloads[23] = `
+	CREATE INVERTED INDEX IF NOT EXISTS fileNameTokens ON file_tree (name_tokens);
+	`
+
+	payloads[24] = `
+	ALTER TABLE file_tree ADD COLUMN IF NOT EXISTS "version" INT8 NOT NULL DEFAULT 1;
+	`
+
+	// entries of file_tree moved to trash (detached with parent_id set to NULL)
+	payloads[25] = `
+	CREATE TABLE IF NOT EXISTS "trash" (
+		"id" UUID NOT NULL,
+		"root" UUID NOT NULL,
+		"path" BYTES NOT NULL,
+		"deleted_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+		CONSTRAINT "primary" PRIMARY KEY (id)
+	);
+	`
+
+	payloads[26] = `
+	CREATE INDEX IF NOT EXISTS trashRoot ON trash (root, deleted_at);
+	`
+
+	payloads[27] = `
+	CREATE INDEX IF NOT EXISTS trashDeleted ON trash (deleted_at);
+	`
+
+	// replaced contents of files
+	payloads[28] = `
+	CREATE TABLE IF NOT EXISTS "file_versions" (
+		"id" UUID NOT NULL DEFAULT gen_random_uuid(),
+		"file_id" UUID NOT NULL,
+		"version" INT8 NOT NULL,
+		"hash" STRING(64),
+		"duplicate" INT,
+		"wrapped_key" BYTES,
+		"size" INT8 NOT NULL,
+		"content_type" STRING,
+		"checksum" STRING(64),
+		"modified_at" TIMESTAMPTZ NOT NULL,
+		"archived_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+		CONSTRAINT "primary" PRIMARY KEY (id)
+	);
+	`
+
+	payloads[29] = `
+	CREATE UNIQUE INDEX IF NOT EXISTS fileVersion ON file_versions (file_id, version);
+	`
+
+	payloads[30] = `
+	CREATE INDEX IF NOT EXISTS versionBlob ON file_versions (hash, duplicate);
+	`
+
+	payloads[31] = `
+	CREATE INDEX IF NOT EXISTS versionArchived ON file_versions (archived_at);
+	`
+
+	// links giving access to files without an account (token itself isn't stored)
+	payloads[32] = `
+	CREATE TABLE IF NOT EXISTS "share_links" (
+		"id" UUID NOT NULL DEFAULT gen_random_uuid(),
+		"token_hash" STRING(64) NOT NULL,
+		"file_id" UUID NOT NULL,
+		"owner" UUID NOT NULL,
+		"wrapped_key" BYTES NOT NULL,
+		"has_password" BOOL NOT NULL DEFAULT false,
+		"expires_at" TIMESTAMPTZ,
+		"max_downloads" INT NOT NULL DEFAULT 0,
+		"downloads" INT NOT NULL DEFAULT 0,
+		"created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+		CONSTRAINT "primary" PRIMARY KEY (id)
+	);
+	`
+
+	payloads[33] = `
+	CREATE UNIQUE INDEX IF NOT EXISTS shareToken ON share_links (token_hash);
+	`
+
+	payloads[34] = `
+	CREATE INDEX IF NOT EXISTS shareOwner ON share_links (owner, created_at);
+	`
+
+	// key pairs with which keys are shared with users (private key is wrapped with user's key)
+	payloads[35] = `
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS "public_key" BYTES;
+	`
+
+	payloads[36] = `
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS "private_key" BYTES;
+	`
+
+	// files shared with other users (own key of shared file is sealed for recipient)
+	payloads[37] = `
+	CREATE TABLE IF NOT EXISTS "shares" (
+		"id" UUID NOT NULL DEFAULT gen_random_uuid(),
+		"file_id" UUID NOT NULL,
+		"owner" UUID NOT NULL,
+		"recipient" STRING NOT NULL,
+		"permission" STRING NOT NULL,
+		"wrapped_key" BYTES NOT NULL,
+		"created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+		CONSTRAINT "primary" PRIMARY KEY (id)
+	);
+	`
+
+	payloads[38] = `
+	CREATE UNIQUE INDEX IF NOT EXISTS shareRecipient ON shares (file_id, recipient);
+	`
+
+	payloads[39] = `
+	CREATE INDEX IF NOT EXISTS sharesByOwner ON shares (owner, created_at);
+	`
+
+	payloads[40] = `
+	CREATE INDEX IF NOT EXISTS sharesWithUser ON shares (recipient, created_at);
+	`
+
+	// groups with their own drives (id of a group is id of root of its drive)
+	payloads[41] = `
+	CREATE TABLE IF NOT EXISTS "groups" (
+		"id" UUID NOT NULL DEFAULT gen_random_uuid(),
+		"name" STRING NOT NULL,
+		"created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+		CONSTRAINT "primary" PRIMARY KEY (id)
+	);
+	`
+
+	// key of a group is sealed for each of its members
+	payloads[42] = `
+	CREATE TABLE IF NOT EXISTS "group_members" (
+		"group_id" UUID NOT NULL,
+		"username" STRING NOT NULL,
+		"role" STRING NOT NULL,
+		"wrapped_key" BYTES NOT NULL,
+		"added_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+		CONSTRAINT "primary" PRIMARY KEY (group_id, username)
+	);
+	`
+
+	payloads[43] = `
+	CREATE INDEX IF NOT EXISTS groupsOfUser ON group_members (username);
+	`
+
+	// set when names of user's files don't need encrypting and indexing anymore
+	payloads[44] = `
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS "names_migrated" BOOL;
+	`
+
+	// own keys of shared files and directories (wrapped with key of their parent)
+	// and names of shared entries encrypted with them (read by recipients)
+	payloads[45] = `
+	ALTER TABLE file_tree ADD COLUMN IF NOT EXISTS "own_key" BYTES;
+	`
+
+	payloads[46] = `
+	ALTER TABLE file_tree ADD COLUMN IF NOT EXISTS "own_name" STRING;
+	`
+
+	// shares created by older versions sealed the whole key of the owner
+	payloads[47] = `
+	DELETE FROM shares WHERE file_id NOT IN (SELECT id FROM file_tree WHERE own_key IS NOT NULL);
+	`
+
+	// share links created by older versions wrapped the whole key of the owner
+	payloads[48] = `
+	DELETE FROM share_links WHERE file_id NOT IN (SELECT id FROM file_tree WHERE own_key IS NOT NULL);
+	`
 	for _, payload := range payloads {
 		r := db.pool.QueryRow(context.Background(), payload)
 		err := r.Scan()
@@ -144,62 +420,111 @@ func (db *Database) setRoot() error {
 		return err
 	}
 
+	db.root = id
 	l.LogV("SUCCESS!")
 	return nil
 }
 
 // Adds file entry to database
-func (db *Database) NewFile(pathNames []string, key []byte, duplicate int, isDirectory bool, userRoot uuid.UUID) error {
+// Hash (name of blob, computed from the name if empty), IsDirectory, WrappedKey and metadata of content are taken from provided file,
+// the rest of its fields is filled after insertion
+func (db *Database) NewFile(pathNames []string, key []byte, file *models.File, userRoot uuid.UUID) error {
 	if len(pathNames) == 0 {
 		return fmt.Errorf("NewFile: no path provided")
 	}
-	parentId := userRoot
+	parentId, dirKey, err := db.ensureParent(pathNames, key, userRoot)
+	if err != nil {
+		return err
+	}
+
+	file.Name = pathNames[len(pathNames)-1]
+	if file.Hash == "" {
+		file.Hash = getHashOfFile([]byte(file.Name), key)
+	}
+	file.ParentId = parentId
+
+	// data key is stored wrapped with key of the directory (own key of shared directory)
+	wrappedKey := file.WrappedKey
+	if file.WrappedKey, err = rewrapKey(wrappedKey, key, dirKey); err != nil {
+		return err
+	}
+	defer func() { file.WrappedKey = wrappedKey }()
+	return crdbpgx.ExecuteTx(context.Background(), db.pool, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		return newFile(context.Background(), tx, file, dirKey)
+	})
+}
+
+/*
+	Stores file on provided path resolving conflict with existing file according to policy:
+	ConflictFail      - returns FileExists
+	ConflictOverwrite - replaces content of existing file keeping its id (replaced content is kept as a version)
+	ConflictRename    - stores the file under the first free name "name (n).ext"
+	Hash (name of blob) is computed from the requested name if empty, fields filled by NewFile are filled too
+	(Name is set to the name under which the file was stored)
+*/
+func (db *Database) StoreFile(pathNames []string, key []byte, file *models.File, userRoot uuid.UUID, policy models.ConflictPolicy) error {
+	if len(pathNames) == 0 {
+		return fmt.Errorf("StoreFile: no path provided")
+	}
+	parentId, dirKey, err := db.ensureParent(pathNames, key, userRoot)
+	if err != nil {
+		return err
+	}
+	if file.Hash == "" {
+		file.Hash = getHashOfFile([]byte(pathNames[len(pathNames)-1]), key)
+	}
+
+	wrappedKey := file.WrappedKey
+	if file.WrappedKey, err = rewrapKey(wrappedKey, key, dirKey); err != nil {
+		return err
+	}
+	defer func() { file.WrappedKey = wrappedKey }()
+	return crdbpgx.ExecuteTx(context.Background(), db.pool, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		return storeFile(context.Background(), tx, pathNames[len(pathNames)-1], parentId, dirKey, file, policy)
+	})
+}
+
+// Returns id of parent directory of file on provided path with key of names in it
+// Missing parent directories are created
+func (db *Database) ensureParent(pathNames []string, key []byte, userRoot uuid.UUID) (uuid.UUID, []byte, error) {
+	// If only one file in path it's placed in root
+	if len(pathNames) == 1 {
+		return userRoot, key, nil
+	}
+
 	/*
 		Warning!!!
 		Be careful with using recursion in go (also in production environments...).
 		Go compiler doesn't implement tail call optimization so it is possible to overflow the stack.
 	*/
-	err := func() error {
-		// If only one file in path return from recursion and add it to database
-		if len(pathNames) == 1 {
-			return nil
+
+	// check if parent of file exists
+	f, s, err := lookupFile(db.pool, pathNames[:len(pathNames)-1], key, userRoot)
+	if err != nil {
+		if err != FileNotFound {
+			return uuid.UUID{}, nil, err
+		}
+		// if parent doesn't exist create it
+		err = db.NewFile(pathNames[:len(pathNames)-1], key, &models.File{IsDirectory: true}, userRoot)
+		if err != nil && err != FileExists {
+			return uuid.UUID{}, nil, err
 		}
 
-		// check if parent of file exists
-		f, err := getFile(db.pool, pathNames[:len(pathNames)-1], userRoot)
+		// we're sure that the parent of file exists (i guess...)
+		// now we can get it's database id to link our file to it
+		f, s, err = lookupFile(db.pool, pathNames[:len(pathNames)-1], key, userRoot)
 		if err != nil {
-			// if parent doesn't exist create it
-			if err == FileNotFound {
-				err = db.NewFile(pathNames[:len(pathNames)-1], key, 0, true, userRoot)
-				if err != nil {
-					if err != FileExists {
-						return err
-					}
-				}
-
-				// we're sure that the parent of file exists (i guess...)
-				// now we can get it's database id to link our file to it
-				f, err = getFile(db.pool, pathNames[:len(pathNames)-1], userRoot)
-				if err != nil {
-					return err
-				}
-				parentId = f.Id
-				return nil
-			}
-			return err
+			return uuid.UUID{}, nil, err
 		}
-
-		//if parent exists set variable parentId to it's id
-		parentId = f.Id
-		return nil
-	}()
-
+	}
+	if !f.IsDirectory {
+		return uuid.UUID{}, nil, InvalidMove
+	}
+	dirKey, err := contentKey(f, s.key)
 	if err != nil {
-		return err
+		return uuid.UUID{}, nil, err
 	}
-	return crdbpgx.ExecuteTx(context.Background(), db.pool, pgx.TxOptions{}, func(tx pgx.Tx) error {
-		return newFile(context.Background(), tx, pathNames[len(pathNames)-1], getHashOfFile([]byte(pathNames[len(pathNames)-1]), key), parentId, duplicate, isDirectory)
-	})
+	return f.Id, dirKey, nil
 }
 
 /*
@@ -208,27 +533,171 @@ func (db *Database) NewFile(pathNames []string, key []byte, duplicate int, isDir
 	pathNames array contains filenames of path from the first to last
 	ex: /a/b/c/d.conf == {"a","b","c","d.conf"}
 	For the best experience use database.PathToArr function
+	Names are encrypted with provided key
 */
-func (db *Database) GetFile(pathNames []string, userRoot uuid.UUID) (*models.File, error) {
-	return getFile(db.pool, pathNames, userRoot)
+func (db *Database) GetFile(pathNames []string, key []byte, userRoot uuid.UUID) (*models.File, error) {
+	return getFile(db.pool, pathNames, key, userRoot)
+}
+
+// Gets file with provided id and its path in tree of the user
+// Returns FileNotFound if the file isn't placed under userRoot (e.g. it's in trash)
+func (db *Database) GetFileById(id uuid.UUID, key []byte, userRoot uuid.UUID) (*models.File, []string, error) {
+	// own keys of ancestors are collected to decrypt names inside of shared directories
+	sqlQuery := `
+	WITH RECURSIVE up (cur, path, keys) AS (
+		SELECT parent_id, ARRAY[encrypted_name], ARRAY[]::BYTES[] FROM file_tree WHERE id = $1
+		UNION ALL
+		SELECT f.parent_id, f.encrypted_name || u.path, array_prepend(COALESCE(f.own_key, b''), u.keys)
+		FROM up u JOIN file_tree f ON f.id = u.cur
+		WHERE u.cur != $2
+	)
+	SELECT ` + fileColumns + `, up.path, up.keys FROM up JOIN file_tree ON file_tree.id = $1 WHERE up.cur = $2;
+	`
+	rows, err := db.pool.Query(context.Background(), sqlQuery, id, userRoot)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, FileNotFound
+	}
+	f := models.File{}
+	var encryptedPath []string
+	var ownKeys [][]byte
+	if err = scanFile(rows, &f, nil, &encryptedPath, &ownKeys); err != nil {
+		return nil, nil, err
+	}
+
+	dirKey := key
+	path := make([]string, len(encryptedPath))
+	for i, encryptedName := range encryptedPath {
+		if path[i], err = crypt.DecryptName(dirKey, encryptedName); err != nil {
+			return nil, nil, err
+		}
+		if i < len(ownKeys) && len(ownKeys[i]) > 0 {
+			if dirKey, err = crypt.UnwrapKey(dirKey, ownKeys[i]); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	f.Name = path[len(path)-1]
+	if err = wrapWithDirectory(&f, dirKey); err != nil {
+		return nil, nil, err
+	}
+	if err = exposeFile(&f, dirKey, key); err != nil {
+		return nil, nil, err
+	}
+	return &f, path, nil
 }
 
 // Lists directory with specified id
-// (Without arguments it will use root directory id)
-// WARNING!!! Remember to not use this function without any arguments as an output for an user!!!
+// (names are decrypted with provided key)
+func (db *Database) ListDirectory(id uuid.UUID, key []byte) ([]models.File, error) {
+	return listDirectory(db.pool, id, key)
+}
+
+// Moves file or directory from src to dst path in one transaction
+// (it can be renamed, moved to other directory or both)
+func (db *Database) MoveFile(src, dst []string, key []byte, userRoot uuid.UUID) error {
+	if len(src) == 0 || len(dst) == 0 {
+		return fmt.Errorf("MoveFile: no path provided")
+	}
+	return crdbpgx.ExecuteTx(context.Background(), db.pool, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		return moveFile(context.Background(), tx, src, dst, key, userRoot)
+	})
+}
 
-func (db *Database) ListDirectory(id ...uuid.UUID) ([]models.File, error) {
-	var dirId uuid.UUID
-	if len(id) == 0 {
-		dirId = db.root
-	} else {
-		dirId = id[0]
+// Copies file or directory from src to dst path in one transaction
+// (contents of files are shared between copies, empty src is shared file which is root of the drive)
+func (db *Database) CopyFile(src, dst []string, key []byte, userRoot uuid.UUID) error {
+	if len(dst) == 0 {
+		return fmt.Errorf("CopyFile: no path provided")
 	}
-	return listDirectory(db.pool, dirId)
+	return crdbpgx.ExecuteTx(context.Background(), db.pool, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		return copyFile(context.Background(), tx, src, dst, key, userRoot)
+	})
 }
 
-func (db *Database) DeleteFile(pathNames []string, userRoot uuid.UUID) error {
+/*
+	Replaces content of existing file in one transaction
+	Hash (name of blob, computed from the name if empty), WrappedKey and metadata of content are taken from provided file,
+	the rest of its fields is filled from the replaced entry
+	If ifMatch is not empty entity tag of the file has to match it (otherwise PreconditionFailed is returned)
+	Replaced content is kept as a version of the file
+*/
+func (db *Database) ReplaceFile(pathNames []string, key []byte, file *models.File, userRoot uuid.UUID, ifMatch string) error {
+	if len(pathNames) == 0 {
+		return fmt.Errorf("ReplaceFile: no path provided")
+	}
+	file.Name = pathNames[len(pathNames)-1]
+	if file.Hash == "" {
+		file.Hash = getHashOfFile([]byte(file.Name), key)
+	}
+
 	return crdbpgx.ExecuteTx(context.Background(), db.pool, pgx.TxOptions{}, func(tx pgx.Tx) error {
-		return deleteFile(db.pool, context.Background(), tx, pathNames, userRoot)
+		return replaceFile(context.Background(), tx, pathNames, key, file, userRoot, ifMatch)
+	})
+}
+
+// Removes blobs which are no longer used
+// (blob could be already missing)
+func (db *Database) removeBlobs(names []string) {
+	for _, name := range names {
+		if err := db.blobs.Delete(name); err != nil && err != storage.ErrNotFound {
+			l.Warn("%s: %s", name, err.Error())
+		}
+	}
+}
+
+// Permanently deletes file on provided path (with its whole subtree)
+// Blobs are removed after the transaction unless they are shared with other entries
+func (db *Database) DeleteFile(pathNames []string, key []byte, userRoot uuid.UUID) error {
+	if len(pathNames) == 0 {
+		return fmt.Errorf("DeleteFile: no path provided")
+	}
+	var blobs []string
+	err := crdbpgx.ExecuteTx(context.Background(), db.pool, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		var err error
+		blobs, err = deleteFile(context.Background(), tx, pathNames, key, userRoot)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	db.removeBlobs(blobs)
+	return nil
+}
+
+// Encrypts with key all names under userRoot stored in plaintext by older versions
+// and adds names without search tokens to the search index
+// The tree is converted only once, after that user is marked as migrated and the pass is skipped
+// Returns number of converted entries
+func (db *Database) EncryptNames(key []byte, userRoot uuid.UUID) (int, error) {
+	var migrated *bool
+	err := db.pool.QueryRow(context.Background(), "SELECT names_migrated FROM users WHERE id = $1;", userRoot).Scan(&migrated)
+	if err != nil && err != pgx.ErrNoRows {
+		return 0, err
+	}
+	if migrated != nil && *migrated {
+		return 0, nil
+	}
+
+	n := 0
+	err = crdbpgx.ExecuteTx(context.Background(), db.pool, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		var err error
+		n, err = encryptNames(context.Background(), tx, key, userRoot)
+		if err != nil {
+			return err
+		}
+		if err = indexNames(context.Background(), tx, key, userRoot); err != nil {
+			return err
+		}
+		_, err = tx.Exec(context.Background(), "UPDATE users SET names_migrated = TRUE WHERE id = $1;", userRoot)
+		return err
 	})
+	return n, err
 }
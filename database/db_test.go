@@ -0,0 +1,104 @@
+package database
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/noisersup/encryptedfs-api/crypt"
+	"github.com/noisersup/encryptedfs-api/kms"
+	"github.com/noisersup/encryptedfs-api/models"
+	"github.com/noisersup/encryptedfs-api/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// Queries are tested against CockroachDB at TEST_DATABASE_URL
+// (e.g. postgresql://root@localhost:26257?sslmode=disable), tests are skipped if it isn't set
+const testDatabaseEnv = "TEST_DATABASE_URL"
+
+// Database created for tests (every test works in drives of its own users)
+const testDatabase = "encryptedfs_test"
+
+// Connects to test database with blobs kept in memory
+func testDB(t *testing.T) (*Database, *storage.MemoryStore) {
+	uri := os.Getenv(testDatabaseEnv)
+	if uri == "" {
+		t.Skipf("%s not set", testDatabaseEnv)
+	}
+
+	conn, err := pgx.Connect(context.Background(), uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Exec(context.Background(), "CREATE DATABASE IF NOT EXISTS "+testDatabase+";")
+	conn.Close(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := kms.NewLocalKeyManager(filepath.Join(t.TempDir(), "keyring.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs := storage.NewMemoryStore()
+	db, err := ConnectDB(uri, testDatabase, "", blobs, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	return db, blobs
+}
+
+// Registers user with unique name and returns root of their drive and their key
+func testUser(t *testing.T, db *Database) (uuid.UUID, []byte) {
+	key, err := crypt.NewKey()
+	assert.NoError(t, err)
+	username := "test-" + uuid.New().String()
+	if err = db.NewUser(username, "hash", &models.UserKey{Wrapped: key}); err != nil {
+		t.Fatal(err)
+	}
+	root, err := db.GetRoot(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root, key
+}
+
+// Stores file on path with a new data key (wrapped with key) and its blob under a unique name
+// Returns the file (with name of its blob as Hash) and its data key
+func testFile(t *testing.T, db *Database, blobs storage.BlobStore, path []string, key []byte, root uuid.UUID) (*models.File, []byte) {
+	dataKey, err := crypt.NewKey()
+	assert.NoError(t, err)
+	wrappedKey, err := crypt.WrapKey(key, dataKey)
+	assert.NoError(t, err)
+
+	// blob names are unique in the whole (shared) database, so blobs of other tests can't keep them in use
+	f := models.File{Hash: strings.ReplaceAll(uuid.New().String(), "-", ""), WrappedKey: wrappedKey, Size: 7}
+	if err = db.NewFile(path, key, &f, root); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, blobs.Put(f.BlobName(), strings.NewReader("content")))
+	return &f, dataKey
+}
+
+// Checks if blob is (or isn't) in blob store
+func assertBlob(t *testing.T, blobs storage.BlobStore, name string, exists bool) {
+	_, err := blobs.Stat(name)
+	if exists {
+		assert.NoError(t, err, name)
+	} else {
+		assert.Equal(t, storage.ErrNotFound, err, name)
+	}
+}
+
+// Reads data key of file with provided id as stored in the database
+func storedKey(t *testing.T, db *Database, id uuid.UUID) []byte {
+	var wrappedKey []byte
+	err := db.pool.QueryRow(context.Background(), "SELECT wrapped_key FROM file_tree WHERE id = $1;", id).Scan(&wrappedKey)
+	assert.NoError(t, err)
+	return wrappedKey
+}
@@ -0,0 +1,188 @@
+/*
+	Groups with their own drives
+
+	Files of a group are encrypted with key of the group which is sealed with public key of each member,
+	so members can be added without re-encrypting files of the group.
+	When a member is removed the group gets a new key with which names and keys of its files are re-wrapped
+	(content of files stays encrypted with the same data keys).
+*/
+package database
+
+import (
+	"context"
+	"errors"
+
+	"github.com/cockroachdb/cockroach-go/v2/crdb/crdbpgx"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/noisersup/encryptedfs-api/models"
+)
+
+var LastGroupOwner error = errors.New("Group has to have an owner")
+var GroupChanged error = errors.New("Members of the group changed")
+
+const memberColumns = "group_id, groups.name, username, role, wrapped_key, added_at"
+
+// Joins members with their groups
+const memberTables = "group_members JOIN groups ON groups.id = group_members.group_id"
+
+// Creates group with root of its drive and adds its owner
+// Sets id of the group and time when the owner was added
+func (db *Database) NewGroup(owner *models.GroupMember) error {
+	return crdbpgx.ExecuteTx(context.Background(), db.pool, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		ctx := context.Background()
+		err := tx.QueryRow(ctx, "INSERT INTO groups (name) VALUES ($1) RETURNING id;", owner.GroupName).Scan(&owner.GroupId)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(ctx, "INSERT INTO file_tree (id, parent_id) VALUES ($1, $2);", owner.GroupId, db.root); err != nil {
+			return err
+		}
+		return insertMember(ctx, tx, owner)
+	})
+}
+
+// Gets membership of user in group
+// Returns FileNotFound if the user isn't a member of the group
+func (db *Database) GetGroupMember(groupId uuid.UUID, username string) (*models.GroupMember, error) {
+	member := models.GroupMember{}
+	sqlQuery := "SELECT " + memberColumns + " FROM " + memberTables + " WHERE group_id = $1 AND username = $2;"
+	if err := scanMember(db.pool.QueryRow(context.Background(), sqlQuery, groupId, username), &member); err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, FileNotFound
+		}
+		return nil, err
+	}
+	return &member, nil
+}
+
+// Lists memberships of user in groups (sorted by names of groups)
+func (db *Database) ListGroups(username string) ([]models.GroupMember, error) {
+	return db.listMembers("username = $1 ORDER BY groups.name, group_id", username)
+}
+
+// Lists members of group (sorted by usernames)
+func (db *Database) ListGroupMembers(groupId uuid.UUID) ([]models.GroupMember, error) {
+	return db.listMembers("group_id = $1 ORDER BY username", groupId)
+}
+
+func (db *Database) listMembers(condition string, arg interface{}) ([]models.GroupMember, error) {
+	sqlQuery := "SELECT " + memberColumns + " FROM " + memberTables + " WHERE " + condition + ";"
+	rows, err := db.pool.Query(context.Background(), sqlQuery, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []models.GroupMember{}
+	for rows.Next() {
+		member := models.GroupMember{}
+		if err := scanMember(rows, &member); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+// Adds member to group or changes role and key of existing member
+// Returns LastGroupOwner if the only owner of the group would lose the role
+func (db *Database) SetGroupMember(member *models.GroupMember) error {
+	return crdbpgx.ExecuteTx(context.Background(), db.pool, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		ctx := context.Background()
+		if member.Role != models.RoleOwner {
+			if err := checkOtherOwners(ctx, tx, member.GroupId, member.Username); err != nil {
+				return err
+			}
+		}
+		return insertMember(ctx, tx, member)
+	})
+}
+
+/*
+	Removes member from group and rotates key of the group, so the removed member can't use the old one
+	Names and keys of files of the group (with its trash) are re-encrypted from key to newKey
+	(content of files isn't re-encrypted) and newKey sealed for each remaining member (sealedKeys by usernames)
+	replaces their copy of the old key
+	Returns FileNotFound if the user isn't a member of the group, LastGroupOwner if the user is the only owner
+	of the group and GroupChanged if key isn't sealed for some of the remaining members
+*/
+func (db *Database) RemoveGroupMember(groupId uuid.UUID, username string, key, newKey []byte, sealedKeys map[string][]byte) error {
+	return crdbpgx.ExecuteTx(context.Background(), db.pool, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		ctx := context.Background()
+		if err := checkOtherOwners(ctx, tx, groupId, username); err != nil {
+			return err
+		}
+		tag, err := tx.Exec(ctx, "DELETE FROM group_members WHERE group_id = $1 AND username = $2;", groupId, username)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return FileNotFound
+		}
+
+		rows, err := tx.Query(ctx, "SELECT username FROM group_members WHERE group_id = $1;", groupId)
+		if err != nil {
+			return err
+		}
+		remaining := []string{}
+		for rows.Next() {
+			var member string
+			if err := rows.Scan(&member); err != nil {
+				rows.Close()
+				return err
+			}
+			remaining = append(remaining, member)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		for _, member := range remaining {
+			sealed, ok := sealedKeys[member]
+			if !ok {
+				return GroupChanged
+			}
+			sqlFormula := "UPDATE group_members SET wrapped_key = $3 WHERE group_id = $1 AND username = $2;"
+			if _, err = tx.Exec(ctx, sqlFormula, groupId, member, sealed); err != nil {
+				return err
+			}
+		}
+
+		if err = rekeyTree(ctx, tx, groupId, key, newKey); err != nil {
+			return err
+		}
+		return rekeyTrash(ctx, tx, groupId, key, newKey)
+	})
+}
+
+// Returns LastGroupOwner if group has no owners other than user with provided username
+func checkOtherOwners(ctx context.Context, tx pgx.Tx, groupId uuid.UUID, username string) error {
+	var owners int
+	sqlQuery := "SELECT count(*) FROM group_members WHERE group_id = $1 AND role = $2 AND username != $3;"
+	if err := tx.QueryRow(ctx, sqlQuery, groupId, string(models.RoleOwner), username).Scan(&owners); err != nil {
+		return err
+	}
+	if owners == 0 {
+		return LastGroupOwner
+	}
+	return nil
+}
+
+// Inserts member or replaces role and key of existing one
+func insertMember(ctx context.Context, tx pgx.Tx, member *models.GroupMember) error {
+	sqlFormula := `
+	INSERT INTO group_members (group_id, username, role, wrapped_key) VALUES ($1, $2, $3, $4)
+	ON CONFLICT (group_id, username) DO UPDATE SET role = excluded.role, wrapped_key = excluded.wrapped_key
+	RETURNING added_at;
+	`
+	row := tx.QueryRow(ctx, sqlFormula, member.GroupId, member.Username, string(member.Role), member.WrappedKey)
+	return row.Scan(&member.AddedAt)
+}
+
+func scanMember(row pgx.Row, member *models.GroupMember) error {
+	var role string
+	err := row.Scan(&member.GroupId, &member.GroupName, &member.Username, &role, &member.WrappedKey, &member.AddedAt)
+	member.Role = models.GroupRole(role)
+	return err
+}
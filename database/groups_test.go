@@ -0,0 +1,98 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/noisersup/encryptedfs-api/crypt"
+	"github.com/noisersup/encryptedfs-api/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// Creates group with owner and editor and returns it with the key of the group
+func testGroup(t *testing.T, db *Database) (*models.GroupMember, *models.GroupMember, []byte) {
+	groupKey, err := crypt.NewKey()
+	assert.NoError(t, err)
+	owner := models.GroupMember{GroupName: "test", Username: "test-" + uuid.New().String(), Role: models.RoleOwner, WrappedKey: []byte("owner")}
+	if err = db.NewGroup(&owner); err != nil {
+		t.Fatal(err)
+	}
+	editor := models.GroupMember{GroupId: owner.GroupId, Username: "test-" + uuid.New().String(), Role: models.RoleEditor, WrappedKey: []byte("editor")}
+	if err = db.SetGroupMember(&editor); err != nil {
+		t.Fatal(err)
+	}
+	return &owner, &editor, groupKey
+}
+
+func Test_RemoveGroupMemberRotatesKey(t *testing.T) {
+	db, blobs := testDB(t)
+	owner, editor, groupKey := testGroup(t, db)
+	root := owner.GroupId
+
+	f, dataKey := testFile(t, db, blobs, []string{"dir", "a.txt"}, groupKey, root)
+	trashed, trashedKey := testFile(t, db, blobs, []string{"b.txt"}, groupKey, root)
+	assert.NoError(t, db.TrashFile([]string{"b.txt"}, groupKey, root))
+	shared, sharedKey, err := db.ShareKey([]string{"dir"}, groupKey, root)
+	assert.NoError(t, err)
+
+	newKey, err := crypt.NewKey()
+	assert.NoError(t, err)
+	err = db.RemoveGroupMember(root, editor.Username, groupKey, newKey, map[string][]byte{owner.Username: []byte("resealed")})
+	assert.NoError(t, err)
+
+	_, err = db.GetGroupMember(root, editor.Username)
+	assert.Equal(t, FileNotFound, err)
+	member, err := db.GetGroupMember(root, owner.Username)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("resealed"), member.WrappedKey)
+
+	// the old key opens nothing in the drive of the group
+	_, err = crypt.UnwrapKey(groupKey, storedKey(t, db, trashed.Id))
+	assert.Error(t, err)
+	_, err = db.GetFile([]string{"dir", "a.txt"}, groupKey, root)
+	assert.Error(t, err)
+
+	unwrapped, err := crypt.UnwrapKey(newKey, storedKey(t, db, trashed.Id))
+	assert.NoError(t, err)
+	assert.Equal(t, trashedKey, unwrapped)
+	got, err := db.GetFile([]string{"dir", "a.txt"}, newKey, root)
+	assert.NoError(t, err)
+	unwrapped, err = crypt.UnwrapKey(newKey, got.WrappedKey)
+	assert.NoError(t, err)
+	assert.Equal(t, dataKey, unwrapped)
+
+	// own key of the shared directory is kept (shares stay valid), only rewrapped
+	_, again, err := db.ShareKey([]string{"dir"}, newKey, root)
+	assert.NoError(t, err)
+	assert.Equal(t, sharedKey, again)
+	unwrapped, err = crypt.UnwrapKey(sharedKey, storedKey(t, db, f.Id))
+	assert.NoError(t, err)
+	assert.Equal(t, dataKey, unwrapped)
+	_, err = db.GetSharedFile(shared.Id, sharedKey, root)
+	assert.NoError(t, err)
+
+	// trash keeps original paths
+	items, err := db.ListTrash(newKey, root)
+	assert.NoError(t, err)
+	if assert.Len(t, items, 1) {
+		assert.Equal(t, []string{"b.txt"}, items[0].Path)
+	}
+}
+
+func Test_RemoveGroupMemberWithoutSealedKeys(t *testing.T) {
+	db, blobs := testDB(t)
+	owner, editor, groupKey := testGroup(t, db)
+	root := owner.GroupId
+	testFile(t, db, blobs, []string{"a.txt"}, groupKey, root)
+
+	newKey, err := crypt.NewKey()
+	assert.NoError(t, err)
+	err = db.RemoveGroupMember(root, editor.Username, groupKey, newKey, map[string][]byte{})
+	assert.Equal(t, GroupChanged, err)
+
+	// nothing changed
+	_, err = db.GetGroupMember(root, editor.Username)
+	assert.NoError(t, err)
+	_, err = db.GetFile([]string{"a.txt"}, groupKey, root)
+	assert.NoError(t, err)
+}
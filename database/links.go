@@ -0,0 +1,102 @@
+/*
+	Share links giving access to files and directories without an account
+
+	Only hash of token of a link is stored, own key of the shared file (see scopes.go)
+	is wrapped with key derived from the token, so the link can be used only by someone who knows the token
+	and it gives access only to the shared file (and its subtree).
+*/
+package database
+
+import (
+	"context"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/noisersup/encryptedfs-api/models"
+)
+
+var LinkExpired error = errors.New("Link expired")
+
+const linkColumns = "id, token_hash, file_id, owner, wrapped_key, has_password, expires_at, max_downloads, downloads, created_at"
+
+// Adds share link to database and sets its id and creation time
+func (db *Database) NewShareLink(link *models.ShareLink) error {
+	sqlFormula := `
+	INSERT INTO share_links (token_hash, file_id, owner, wrapped_key, has_password, expires_at, max_downloads)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	RETURNING id, created_at;
+	`
+	row := db.pool.QueryRow(context.Background(), sqlFormula,
+		link.TokenHash, link.FileId, link.Owner, link.WrappedKey, link.HasPassword, link.ExpiresAt, link.MaxDownloads)
+	return row.Scan(&link.Id, &link.CreatedAt)
+}
+
+// Gets share link with provided hash of token
+// Returns FileNotFound if there is no such link
+func (db *Database) GetShareLink(tokenHash string) (*models.ShareLink, error) {
+	link := models.ShareLink{}
+	sqlQuery := "SELECT " + linkColumns + " FROM share_links WHERE token_hash = $1;"
+	if err := scanLink(db.pool.QueryRow(context.Background(), sqlQuery, tokenHash), &link); err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, FileNotFound
+		}
+		return nil, err
+	}
+	return &link, nil
+}
+
+// Lists share links created by owner (the newest first)
+func (db *Database) ListShareLinks(owner uuid.UUID) ([]models.ShareLink, error) {
+	sqlQuery := "SELECT " + linkColumns + " FROM share_links WHERE owner = $1 ORDER BY created_at DESC;"
+	rows, err := db.pool.Query(context.Background(), sqlQuery, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []models.ShareLink{}
+	for rows.Next() {
+		link := models.ShareLink{}
+		if err := scanLink(rows, &link); err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// Revokes share link with provided id created by owner
+// Returns FileNotFound if there is no such link
+func (db *Database) DeleteShareLink(id uuid.UUID, owner uuid.UUID) error {
+	tag, err := db.pool.Exec(context.Background(), "DELETE FROM share_links WHERE id = $1 AND owner = $2;", id, owner)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return FileNotFound
+	}
+	return nil
+}
+
+// Counts download through share link with provided id
+// Returns LinkExpired if the link expired or its downloads limit was reached
+func (db *Database) CountDownload(id uuid.UUID) error {
+	sqlFormula := `
+	UPDATE share_links SET downloads = downloads + 1
+	WHERE id = $1 AND (expires_at IS NULL OR expires_at > now()) AND (max_downloads = 0 OR downloads < max_downloads);
+	`
+	tag, err := db.pool.Exec(context.Background(), sqlFormula, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return LinkExpired
+	}
+	return nil
+}
+
+func scanLink(row pgx.Row, link *models.ShareLink) error {
+	return row.Scan(&link.Id, &link.TokenHash, &link.FileId, &link.Owner, &link.WrappedKey, &link.HasPassword,
+		&link.ExpiresAt, &link.MaxDownloads, &link.Downloads, &link.CreatedAt)
+}
@@ -0,0 +1,350 @@
+/*
+	Paginated directory listings and recursive tree walks
+
+	Listings sorted by size or modification time are paginated with keyset queries
+	using (parent_id, size, id) and (parent_id, modified_at, id) indexes.
+	Names are encrypted, so their order in database doesn't match alphabetical one.
+	Listings sorted by name decrypt names of all entries of the directory
+	and fetch full rows only for the requested page, so each page costs O(n) in size of the directory.
+	No order preserving key of names is stored, as it would reveal alphabetical order of names to the database.
+	Clients of big directories should sort by modified or size.
+*/
+package database
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/noisersup/encryptedfs-api/crypt"
+	"github.com/noisersup/encryptedfs-api/models"
+)
+
+var InvalidCursor error = errors.New("Invalid cursor")
+var InvalidListOptions error = errors.New("Invalid listing options")
+
+const (
+	DefaultListLimit = 1000
+	MaxListLimit     = 1000
+)
+
+// Lists page of directory with specified id
+// (names are decrypted with provided key)
+func (db *Database) ListDirectoryPage(id uuid.UUID, key []byte, opts models.ListOptions) (*models.DirectoryPage, error) {
+	if opts.Limit <= 0 {
+		opts.Limit = DefaultListLimit
+	}
+	if opts.Limit > MaxListLimit {
+		opts.Limit = MaxListLimit
+	}
+
+	var typeFilter string
+	switch opts.Type {
+	case "":
+	case "file":
+		typeFilter = " AND is_directory IS NOT TRUE"
+	case "directory":
+		typeFilter = " AND is_directory"
+	default:
+		return nil, InvalidListOptions
+	}
+
+	switch opts.SortBy {
+	case "", "name":
+		return listByName(db, id, key, opts, typeFilter)
+	case "size", "modified":
+		return listByColumn(db, id, key, opts, typeFilter)
+	}
+	return nil, InvalidListOptions
+}
+
+// Lists page of directory sorted by size or modification time
+func listByColumn(db *Database, id uuid.UUID, key []byte, opts models.ListOptions, typeFilter string) (*models.DirectoryPage, error) {
+	column := "size"
+	if opts.SortBy == "modified" {
+		column = "modified_at"
+	}
+	order, cmp := "ASC", ">"
+	if opts.Desc {
+		order, cmp = "DESC", "<"
+	}
+
+	args := []interface{}{id, opts.Limit + 1}
+	sqlQuery := "SELECT " + fileColumns + " FROM file_tree WHERE parent_id = $1" + typeFilter
+	if opts.Cursor != "" {
+		value, after, err := decodeCursor(opts.Cursor, opts.SortBy)
+		if err != nil {
+			return nil, err
+		}
+		var v interface{}
+		if column == "size" {
+			if v, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return nil, InvalidCursor
+			}
+		} else {
+			nanos, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, InvalidCursor
+			}
+			v = time.Unix(0, nanos).UTC()
+		}
+		sqlQuery += " AND (" + column + ", id) " + cmp + " ($3, $4)"
+		args = append(args, v, after)
+	}
+	sqlQuery += " ORDER BY " + column + " " + order + ", id " + order + " LIMIT $2;"
+
+	rows, err := db.pool.Query(context.Background(), sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := models.DirectoryPage{Files: []models.File{}}
+	for rows.Next() {
+		f := models.File{}
+		if err := scanFile(rows, &f, key); err != nil {
+			return nil, err
+		}
+		page.Files = append(page.Files, f)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Files) > opts.Limit {
+		page.Files = page.Files[:opts.Limit]
+		last := page.Files[len(page.Files)-1]
+		value := strconv.FormatInt(last.Size, 10)
+		if column == "modified_at" {
+			value = strconv.FormatInt(last.ModifiedAt.UnixNano(), 10)
+		}
+		page.NextCursor = encodeCursor(opts.SortBy, value, last.Id)
+	}
+	return &page, nil
+}
+
+// Lists page of directory sorted by name
+func listByName(db *Database, id uuid.UUID, key []byte, opts models.ListOptions, typeFilter string) (*models.DirectoryPage, error) {
+	type entry struct {
+		id   uuid.UUID
+		name string
+	}
+
+	sqlQuery := "SELECT id, encrypted_name FROM file_tree WHERE parent_id = $1" + typeFilter + ";"
+	rows, err := db.pool.Query(context.Background(), sqlQuery, id)
+	if err != nil {
+		return nil, err
+	}
+	entries := []entry{}
+	for rows.Next() {
+		var e entry
+		var encryptedName string
+		if err := rows.Scan(&e.id, &encryptedName); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if e.name, err = crypt.DecryptName(key, encryptedName); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// names are unique in directory so they are enough to order entries
+	sort.Slice(entries, func(i, j int) bool {
+		if opts.Desc {
+			return entries[i].name > entries[j].name
+		}
+		return entries[i].name < entries[j].name
+	})
+
+	if opts.Cursor != "" {
+		value, _, err := decodeCursor(opts.Cursor, "name")
+		if err != nil {
+			return nil, err
+		}
+		after, err := crypt.DecryptName(key, value)
+		if err != nil {
+			return nil, InvalidCursor
+		}
+		start := sort.Search(len(entries), func(i int) bool {
+			if opts.Desc {
+				return entries[i].name < after
+			}
+			return entries[i].name > after
+		})
+		entries = entries[start:]
+	}
+
+	page := models.DirectoryPage{Files: []models.File{}}
+	if len(entries) > opts.Limit {
+		entries = entries[:opts.Limit]
+		last := entries[len(entries)-1]
+		// cursor holds encrypted name so it doesn't reveal it in urls
+		encryptedName, err := crypt.EncryptName(key, last.name)
+		if err != nil {
+			return nil, err
+		}
+		page.NextCursor = encodeCursor("name", encryptedName, last.id)
+	}
+	if len(entries) == 0 {
+		return &page, nil
+	}
+
+	ids := make([]uuid.UUID, len(entries))
+	for i, e := range entries {
+		ids[i] = e.id
+	}
+	sqlQuery = "SELECT " + fileColumns + " FROM file_tree WHERE id = ANY($1);"
+	rows, err = db.pool.Query(context.Background(), sqlQuery, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := map[uuid.UUID]models.File{}
+	for rows.Next() {
+		f := models.File{}
+		if err := scanFile(rows, &f, key); err != nil {
+			return nil, err
+		}
+		files[f.Id] = f
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		// entry could be removed in the meantime
+		if f, ok := files[e.id]; ok {
+			page.Files = append(page.Files, f)
+		}
+	}
+	return &page, nil
+}
+
+// Cursor is base64 encoded "sort:value:id" of the last listed file
+func encodeCursor(sortBy, value string, id uuid.UUID) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(sortBy + ":" + value + ":" + id.String()))
+}
+
+// Returns value and id of the last listed file from cursor
+// Returns InvalidCursor if cursor was created for listing sorted by other key
+func decodeCursor(cursor, sortBy string) (string, uuid.UUID, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", uuid.UUID{}, InvalidCursor
+	}
+	parts := strings.SplitN(string(raw), ":", 3)
+	if len(parts) != 3 || parts[0] != sortBy {
+		return "", uuid.UUID{}, InvalidCursor
+	}
+	id, err := uuid.Parse(parts[2])
+	if err != nil {
+		return "", uuid.UUID{}, InvalidCursor
+	}
+	return parts[1], id, nil
+}
+
+/*
+	Walks the whole subtree of directory with provided id with one recursive query
+	(and one more for every shared directory in it, as names in it are encrypted with its own key)
+	fn is called for every entry with path of the entry relative to the directory
+	(parents are visited before their children)
+	maxDepth limits depth of walk (direct children have depth 1, 0 means no limit)
+	Error returned by fn stops the walk and is returned
+*/
+func (db *Database) ListTree(id uuid.UUID, key []byte, maxDepth int, fn func(path []string, f *models.File) error) error {
+	return db.walkTree(id, key, key, nil, maxDepth, fn)
+}
+
+// Walks subtree of directory with provided id in which names are encrypted with dirKey
+// Paths passed to fn are prefixed with prefix and keys of files are wrapped with key
+func (db *Database) walkTree(id uuid.UUID, dirKey, key []byte, prefix []string, maxDepth int, fn func(path []string, f *models.File) error) error {
+	sqlQuery := `
+	WITH RECURSIVE tree (id, path, depth, keyed) AS (
+		SELECT id, ARRAY[encrypted_name], 1, own_key IS NOT NULL FROM file_tree WHERE parent_id = $1
+		UNION ALL
+		SELECT f.id, t.path || f.encrypted_name, t.depth + 1, f.own_key IS NOT NULL FROM file_tree f JOIN tree t ON f.parent_id = t.id
+		WHERE NOT t.keyed AND ($2 = 0 OR t.depth < $2)
+	)
+	SELECT ` + fileColumns + `, tree.path, tree.depth FROM tree JOIN file_tree USING (id);
+	`
+	rows, err := db.pool.Query(context.Background(), sqlQuery, id, maxDepth)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	// shared directories are walked after this query with their own keys
+	type shared struct {
+		id    uuid.UUID
+		key   []byte
+		path  []string
+		depth int
+	}
+	nested := []shared{}
+
+	// names of directories repeat in paths of all their descendants
+	names := map[string]string{}
+	for rows.Next() {
+		f := models.File{}
+		var encryptedPath []string
+		var depth int
+		if err := scanFile(rows, &f, dirKey, &encryptedPath, &depth); err != nil {
+			return err
+		}
+
+		path := make([]string, len(prefix), len(prefix)+len(encryptedPath))
+		copy(path, prefix)
+		for _, encryptedName := range encryptedPath[:len(encryptedPath)-1] {
+			name, ok := names[encryptedName]
+			if !ok {
+				if name, err = crypt.DecryptName(dirKey, encryptedName); err != nil {
+					return err
+				}
+				names[encryptedName] = name
+			}
+			path = append(path, name)
+		}
+		path = append(path, f.Name)
+
+		if f.IsDirectory && f.OwnKey != nil && (maxDepth == 0 || depth < maxDepth) {
+			ownKey, err := contentKey(&f, dirKey)
+			if err != nil {
+				return err
+			}
+			nested = append(nested, shared{f.Id, ownKey, path, depth})
+		}
+		if err = exposeFile(&f, dirKey, key); err != nil {
+			return err
+		}
+		if err = fn(path, &f); err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for _, n := range nested {
+		depth := 0
+		if maxDepth != 0 {
+			depth = maxDepth - n.depth
+		}
+		if err = db.walkTree(n.id, n.key, key, n.path, depth, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
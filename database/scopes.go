@@ -0,0 +1,397 @@
+/*
+	Shared files and directories with their own keys
+
+	File or directory shared with another user or with a link gets its own random key,
+	so only this key is handed out instead of the key of the whole drive.
+	Own key is stored wrapped with key of the parent directory. Names in the subtree of shared directory
+	and data keys of shared file (with its versions) are encrypted with it, while the name of shared entry
+	itself stays encrypted with key of its parent (own_name keeps its copy readable for recipients).
+	Lookups switch to own key when they enter shared directory, so its owner keeps using paths of their drive.
+	Keys returned with files (WrappedKey and OwnKey) are always wrapped with the key provided by the caller.
+*/
+package database
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/noisersup/encryptedfs-api/crypt"
+	"github.com/noisersup/encryptedfs-api/models"
+)
+
+// Content stored by older versions is encrypted with key of the user,
+// so it can't be moved into shared directory (or shared) without being uploaded again
+var LegacyFile error = errors.New("File stored by older version has to be uploaded again")
+
+// Directory in which names (and data keys) are encrypted with the same key
+// (root of a drive or shared directory)
+type scope struct {
+	root uuid.UUID
+	key  []byte
+	path []string // path of root relative to the root of the drive
+}
+
+/*
+	Gets metadata of file on provided path and scope of the directory in which it is
+	(keys of the file are wrapped with key of the scope)
+	Shared directories on the path are entered with their own keys
+	Empty path means shared file which is root of the drive itself (see sharedFile)
+*/
+func lookupFile(q querier, pathNames []string, key []byte, root uuid.UUID) (*models.File, scope, error) {
+	s := scope{root: root, key: key}
+	if len(pathNames) == 0 {
+		f, err := sharedFile(q, root, key)
+		return f, s, err
+	}
+
+	parent := root
+	var f *models.File
+	for i, name := range pathNames {
+		if f != nil {
+			if f.OwnKey != nil {
+				ownKey, err := contentKey(f, s.key)
+				if err != nil {
+					return nil, s, err
+				}
+				s = scope{root: f.Id, key: ownKey, path: pathNames[:i]}
+			}
+			parent = f.Id
+		}
+		var err error
+		if f, err = getEntry(q, name, s.key, parent); err != nil {
+			return nil, s, err
+		}
+	}
+	return f, s, nil
+}
+
+// Gets shared file or directory with provided id (root of drive of recipients of the share)
+// Its name is decrypted with its own key with which keys of its content are wrapped
+func sharedFile(q querier, id uuid.UUID, key []byte) (*models.File, error) {
+	sqlQuery := "SELECT " + fileColumns + ", own_name FROM file_tree WHERE id = $1 AND own_key IS NOT NULL;"
+	rows, err := q.Query(context.Background(), sqlQuery, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, FileNotFound
+	}
+	f := models.File{}
+	var ownName string
+	if err = scanFile(rows, &f, nil, &ownName); err != nil {
+		return nil, err
+	}
+	if f.Name, err = crypt.DecryptName(key, ownName); err != nil {
+		return nil, err
+	}
+	// own key is wrapped with key of the parent, which isn't shared
+	f.OwnKey = nil
+	return &f, nil
+}
+
+// Returns key with which content of f (names of its children or its data keys) is encrypted
+// (own key of shared file unwrapped with key of its directory or key of the directory itself)
+func contentKey(f *models.File, dirKey []byte) ([]byte, error) {
+	if f.OwnKey == nil {
+		return dirKey, nil
+	}
+	return crypt.UnwrapKey(dirKey, f.OwnKey)
+}
+
+// Re-wraps key wrapped with key from with key to (nil stays nil)
+func rewrapKey(wrapped, from, to []byte) ([]byte, error) {
+	if wrapped == nil || bytes.Equal(from, to) {
+		return wrapped, nil
+	}
+	key, err := crypt.UnwrapKey(from, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return crypt.WrapKey(to, key)
+}
+
+// Re-wraps data key of shared file (wrapped with its own key) with key of its directory
+func wrapWithDirectory(f *models.File, dirKey []byte) error {
+	if f.OwnKey == nil || f.WrappedKey == nil {
+		return nil
+	}
+	ownKey, err := contentKey(f, dirKey)
+	if err != nil {
+		return err
+	}
+	f.WrappedKey, err = rewrapKey(f.WrappedKey, ownKey, dirKey)
+	return err
+}
+
+// Re-wraps keys of f read in directory with key dirKey with key provided by the caller
+func exposeFile(f *models.File, dirKey, key []byte) error {
+	var err error
+	if f.WrappedKey, err = rewrapKey(f.WrappedKey, dirKey, key); err != nil {
+		return err
+	}
+	f.OwnKey, err = rewrapKey(f.OwnKey, dirKey, key)
+	return err
+}
+
+// Re-wraps data key of file copied from directory with key from into directory with key to
+// (the copy isn't shared even if the original is)
+func copyKeys(f *models.File, from, to []byte) error {
+	f.OwnKey = nil
+	if !f.IsDirectory && f.WrappedKey == nil && !bytes.Equal(from, to) {
+		return LegacyFile
+	}
+	var err error
+	f.WrappedKey, err = rewrapKey(f.WrappedKey, from, to)
+	return err
+}
+
+/*
+	Places f (read in directory with key from) under directory parent with provided name encrypted with key to
+	Content of f is re-encrypted if the keys differ, shared file keeps its own key
+	(only its name seen by recipients is changed)
+	Returns FileExists if the name is taken
+*/
+func relinkFile(ctx context.Context, tx pgx.Tx, f *models.File, name string, parent uuid.UUID, from, to []byte) error {
+	encryptedName, err := crypt.EncryptName(to, name)
+	if err != nil {
+		return err
+	}
+	ownKey, err := rewrapKey(f.OwnKey, from, to)
+	if err != nil {
+		return err
+	}
+
+	// hash is left untouched as it identifies blob of the file
+	sqlFormula := "UPDATE file_tree SET encrypted_name = $2, parent_id = $3, name_tokens = $4, own_key = $5 WHERE id = $1;"
+	if _, err = tx.Exec(ctx, sqlFormula, f.Id, encryptedName, parent, crypt.NameTokens(to, name), ownKey); err != nil {
+		if strings.Contains(err.Error(), "duplicate key value") {
+			return FileExists
+		}
+		return err
+	}
+
+	if f.OwnKey != nil {
+		return setOwnName(ctx, tx, f, name, from)
+	}
+	if bytes.Equal(from, to) {
+		return nil
+	}
+	return rekeyContent(ctx, tx, f, from, to)
+}
+
+// Stores name of shared file encrypted with its own key (f is read in directory with key dirKey)
+func setOwnName(ctx context.Context, tx pgx.Tx, f *models.File, name string, dirKey []byte) error {
+	ownKey, err := contentKey(f, dirKey)
+	if err != nil {
+		return err
+	}
+	ownName, err := crypt.EncryptName(ownKey, name)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, "UPDATE file_tree SET own_name = $2 WHERE id = $1;", f.Id, ownName)
+	return err
+}
+
+// Re-encrypts content of f which isn't shared (names in subtree of directory or data keys of file and its versions)
+// moved from directory with key from into directory with key to
+func rekeyContent(ctx context.Context, tx pgx.Tx, f *models.File, from, to []byte) error {
+	if f.IsDirectory {
+		return rekeyTree(ctx, tx, f.Id, from, to)
+	}
+	if f.WrappedKey == nil {
+		return LegacyFile
+	}
+	wrappedKey, err := rewrapKey(f.WrappedKey, from, to)
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(ctx, "UPDATE file_tree SET wrapped_key = $2 WHERE id = $1;", f.Id, wrappedKey); err != nil {
+		return err
+	}
+	return rekeyVersions(ctx, tx, f.Id, from, to)
+}
+
+// Re-encrypts names of children of directory (with their content) from key from to key to
+// (content of shared children stays encrypted with their own keys)
+func rekeyTree(ctx context.Context, tx pgx.Tx, dir uuid.UUID, from, to []byte) error {
+	children, err := listDirectory(tx, dir, from)
+	if err != nil {
+		if err == FileNotFound {
+			return nil
+		}
+		return err
+	}
+
+	for i := range children {
+		if err = rekeyEntry(ctx, tx, &children[i], from, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Re-encrypts name of f (read with key from) with its content from key from to key to
+// (content of shared file stays encrypted with its own key, which is re-wrapped)
+func rekeyEntry(ctx context.Context, tx pgx.Tx, f *models.File, from, to []byte) error {
+	encryptedName, err := crypt.EncryptName(to, f.Name)
+	if err != nil {
+		return err
+	}
+	ownKey, err := rewrapKey(f.OwnKey, from, to)
+	if err != nil {
+		return err
+	}
+	sqlFormula := "UPDATE file_tree SET encrypted_name = $2, name_encrypted = TRUE, name_tokens = $3, own_key = $4 WHERE id = $1;"
+	if _, err = tx.Exec(ctx, sqlFormula, f.Id, encryptedName, crypt.NameTokens(to, f.Name), ownKey); err != nil {
+		return err
+	}
+	if f.OwnKey != nil {
+		return nil
+	}
+	return rekeyContent(ctx, tx, f, from, to)
+}
+
+// Re-wraps data keys of old versions of file with provided id from key from to key to
+func rekeyVersions(ctx context.Context, tx pgx.Tx, id uuid.UUID, from, to []byte) error {
+	rows, err := tx.Query(ctx, "SELECT version, wrapped_key FROM file_versions WHERE file_id = $1;", id)
+	if err != nil {
+		return err
+	}
+	type version struct {
+		n          int64
+		wrappedKey []byte
+	}
+	versions := []version{}
+	for rows.Next() {
+		var v version
+		if err := rows.Scan(&v.n, &v.wrappedKey); err != nil {
+			rows.Close()
+			return err
+		}
+		versions = append(versions, v)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, v := range versions {
+		if v.wrappedKey == nil {
+			return LegacyFile
+		}
+		wrappedKey, err := rewrapKey(v.wrappedKey, from, to)
+		if err != nil {
+			return err
+		}
+		sqlFormula := "UPDATE file_versions SET wrapped_key = $3 WHERE file_id = $1 AND version = $2;"
+		if _, err = tx.Exec(ctx, sqlFormula, id, v.n, wrappedKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Lists scopes of shared directories under directory root (read with key)
+// including directories shared inside of them (paths of scopes are relative to root)
+func innerScopes(q querier, root uuid.UUID, key []byte) ([]scope, error) {
+	sqlQuery := `
+	WITH RECURSIVE tree (id, path, own_key) AS (
+		SELECT id, ARRAY[encrypted_name], own_key FROM file_tree WHERE parent_id = $1 AND is_directory
+		UNION ALL
+		SELECT f.id, t.path || f.encrypted_name, f.own_key FROM file_tree f JOIN tree t ON f.parent_id = t.id
+		WHERE f.is_directory AND t.own_key IS NULL
+	)
+	SELECT id, path, own_key FROM tree WHERE own_key IS NOT NULL;
+	`
+	rows, err := q.Query(context.Background(), sqlQuery, root)
+	if err != nil {
+		return nil, err
+	}
+	type shared struct {
+		id            uuid.UUID
+		encryptedPath []string
+		ownKey        []byte
+	}
+	found := []shared{}
+	for rows.Next() {
+		var sh shared
+		if err := rows.Scan(&sh.id, &sh.encryptedPath, &sh.ownKey); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		found = append(found, sh)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	scopes := []scope{}
+	for _, sh := range found {
+		s := scope{root: sh.id, path: make([]string, len(sh.encryptedPath))}
+		for i, encryptedName := range sh.encryptedPath {
+			if s.path[i], err = crypt.DecryptName(key, encryptedName); err != nil {
+				return nil, err
+			}
+		}
+		if s.key, err = crypt.UnwrapKey(key, sh.ownKey); err != nil {
+			return nil, err
+		}
+		nested, err := innerScopes(q, s.root, s.key)
+		if err != nil {
+			return nil, err
+		}
+		scopes = append(scopes, s)
+		for _, n := range nested {
+			n.path = append(append([]string{}, s.path...), n.path...)
+			scopes = append(scopes, n)
+		}
+	}
+	return scopes, nil
+}
+
+// Returns scope with provided id of root under root of the drive (the drive itself or shared directory)
+// Returns FileNotFound if there is no such scope
+func findScope(q querier, id uuid.UUID, key []byte, root uuid.UUID) (scope, error) {
+	if id == root {
+		return scope{root: root, key: key}, nil
+	}
+	scopes, err := innerScopes(q, root, key)
+	if err != nil {
+		return scope{}, err
+	}
+	for _, s := range scopes {
+		if s.root == id {
+			return s, nil
+		}
+	}
+	return scope{}, FileNotFound
+}
+
+// Returns ids of root and of shared directories under it
+// (files deleted inside of shared directory are kept in its trash)
+func scopeRoots(q querier, root uuid.UUID) ([]string, error) {
+	sqlQuery := `
+	WITH RECURSIVE tree (id, own_key) AS (
+		SELECT id, own_key FROM file_tree WHERE parent_id = $1 AND is_directory
+		UNION ALL
+		SELECT f.id, f.own_key FROM file_tree f JOIN tree t ON f.parent_id = t.id WHERE f.is_directory
+	)
+	SELECT id FROM tree WHERE own_key IS NOT NULL;
+	`
+	ids, err := queryIds(context.Background(), q, sqlQuery, root)
+	if err != nil {
+		return nil, err
+	}
+	return append(ids, root.String()), nil
+}
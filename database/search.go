@@ -0,0 +1,222 @@
+/*
+	Search of files by name
+
+	Names are encrypted, so they are searched with blind index of their trigrams
+	(see crypt.NameTokens). Candidates containing all tokens of the query are found
+	with inverted index and their paths are rebuilt by walking up to the searched directory.
+	Names of candidates are decrypted and verified, as tokens can match by accident.
+	Queries too short to have tokens are matched against every name under the directory.
+	Tokens depend on the key of names, so shared directories (with their own keys) are searched separately.
+*/
+package database
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/noisersup/encryptedfs-api/crypt"
+	"github.com/noisersup/encryptedfs-api/models"
+)
+
+var InvalidSearch error = errors.New("Invalid search query")
+
+const (
+	DefaultSearchLimit = 100
+	MaxSearchLimit     = 1000
+)
+
+// errSearchDone stops walk of the tree when enough results are found
+var errSearchDone = errors.New("search done")
+
+// Finds files with names matching query under directory with provided id
+// (search is case insensitive)
+func (db *Database) SearchFiles(dir uuid.UUID, key []byte, query models.SearchQuery) ([]models.SearchResult, error) {
+	if query.Limit <= 0 {
+		query.Limit = DefaultSearchLimit
+	}
+	if query.Limit > MaxSearchLimit {
+		query.Limit = MaxSearchLimit
+	}
+
+	match, tokens, err := compileSearch(key, query)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []models.SearchResult{}
+	collect := func(p []string, f *models.File) error {
+		if !match(f.Name) {
+			return nil
+		}
+		results = append(results, models.SearchResult{Path: p, File: *f})
+		if len(results) == query.Limit {
+			return errSearchDone
+		}
+		return nil
+	}
+
+	if len(tokens) == 0 {
+		err = db.ListTree(dir, key, 0, collect)
+	} else {
+		err = db.searchScopes(dir, key, query, tokens, collect)
+	}
+	if err != nil && err != errSearchDone {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Calls fn for every file under dir (and under shared directories in it) which name matches tokens of query
+// (tokens are tokens of query computed with key)
+func (db *Database) searchScopes(dir uuid.UUID, key []byte, query models.SearchQuery, tokens []string, fn func(path []string, f *models.File) error) error {
+	if err := db.searchTokens(dir, key, key, nil, tokens, fn); err != nil {
+		return err
+	}
+	scopes, err := innerScopes(db.pool, dir, key)
+	if err != nil {
+		return err
+	}
+	for _, s := range scopes {
+		_, tokens, err := compileSearch(s.key, query)
+		if err != nil {
+			return err
+		}
+		if err = db.searchTokens(s.root, s.key, key, s.path, tokens, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Calls fn for every file under dir which name contains all tokens
+// (names under dir are encrypted with dirKey and tokens are computed with it)
+// Paths passed to fn are prefixed with prefix and keys of files are wrapped with key
+func (db *Database) searchTokens(dir uuid.UUID, dirKey, key []byte, prefix []string, tokens []string, fn func(path []string, f *models.File) error) error {
+	// walk up stops at shared directories, names under them are encrypted with other keys
+	sqlQuery := `
+	WITH RECURSIVE up (id, cur, path) AS (
+		SELECT id, parent_id, ARRAY[encrypted_name] FROM file_tree WHERE name_tokens @> $2
+		UNION ALL
+		SELECT u.id, f.parent_id, f.encrypted_name || u.path FROM up u JOIN file_tree f ON f.id = u.cur
+		WHERE u.cur != $1 AND f.own_key IS NULL
+	)
+	SELECT ` + fileColumns + `, up.path FROM up JOIN file_tree USING (id) WHERE up.cur = $1;
+	`
+	rows, err := db.pool.Query(context.Background(), sqlQuery, dir, tokens)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		f := models.File{}
+		var encryptedPath []string
+		if err := scanFile(rows, &f, dirKey, &encryptedPath); err != nil {
+			return err
+		}
+		p := make([]string, len(prefix), len(prefix)+len(encryptedPath))
+		copy(p, prefix)
+		for _, encryptedName := range encryptedPath[:len(encryptedPath)-1] {
+			name, err := crypt.DecryptName(dirKey, encryptedName)
+			if err != nil {
+				return err
+			}
+			p = append(p, name)
+		}
+		p = append(p, f.Name)
+
+		if err = exposeFile(&f, dirKey, key); err != nil {
+			return err
+		}
+		if err = fn(p, &f); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Returns function matching names with query and tokens required in matching names
+func compileSearch(key []byte, query models.SearchQuery) (func(name string) bool, []string, error) {
+	pattern := strings.ToLower(query.Pattern)
+	if pattern == "" {
+		return nil, nil, InvalidSearch
+	}
+
+	switch query.Mode {
+	case "", "substring":
+		match := func(name string) bool { return strings.Contains(strings.ToLower(name), pattern) }
+		return match, crypt.SearchTokens(key, pattern, false, false), nil
+	case "prefix":
+		match := func(name string) bool { return strings.HasPrefix(strings.ToLower(name), pattern) }
+		return match, crypt.SearchTokens(key, pattern, true, false), nil
+	case "glob":
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, nil, InvalidSearch
+		}
+		match := func(name string) bool {
+			ok, _ := path.Match(pattern, strings.ToLower(name))
+			return ok
+		}
+		tokens := []string{}
+		for _, lit := range globLiterals(pattern) {
+			tokens = append(tokens, crypt.SearchTokens(key, lit.text, lit.atStart, lit.atEnd)...)
+		}
+		return match, tokens, nil
+	}
+	return nil, nil, InvalidSearch
+}
+
+type globLiteral struct {
+	text           string
+	atStart, atEnd bool // literal is the beginning or the end of matching names
+}
+
+// Returns literal parts of glob pattern (separated by wildcards and character classes)
+func globLiterals(pattern string) []globLiteral {
+	literals := []globLiteral{}
+	cur := strings.Builder{}
+	atStart := true
+	flush := func(atEnd bool) {
+		if cur.Len() > 0 {
+			literals = append(literals, globLiteral{cur.String(), atStart, atEnd})
+			cur.Reset()
+		}
+		atStart = false
+	}
+
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		switch runes[i] {
+		case '\\':
+			if i+1 < len(runes) {
+				i++
+				cur.WriteRune(runes[i])
+			}
+		case '*', '?':
+			flush(false)
+		case '[':
+			flush(false)
+			// skip the class ("]" right after "[" or "[^" is a part of it)
+			i++
+			if i < len(runes) && runes[i] == '^' {
+				i++
+			}
+			if i < len(runes) && runes[i] == ']' {
+				i++
+			}
+			for i < len(runes) && runes[i] != ']' {
+				if runes[i] == '\\' {
+					i++
+				}
+				i++
+			}
+		default:
+			cur.WriteRune(runes[i])
+		}
+	}
+	flush(true)
+	return literals
+}
@@ -0,0 +1,178 @@
+/*
+	Files and directories shared between users
+
+	Shared file or directory gets its own key (see scopes.go) which is sealed with public key of the recipient,
+	so the recipient can decrypt the shared file (and its subtree) without knowing owner's password
+	and without getting key of the rest of owner's drive.
+	Drive of the recipient is rooted at the shared entry (see GetSharedFile).
+*/
+package database
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach-go/v2/crdb/crdbpgx"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/noisersup/encryptedfs-api/crypt"
+	"github.com/noisersup/encryptedfs-api/models"
+)
+
+const shareColumns = "shares.id, file_id, owner, users.username, recipient, permission, wrapped_key, shares.created_at"
+
+// Joins shares with their owners
+const shareTables = "shares JOIN users ON users.id = shares.owner"
+
+/*
+	Returns file on provided path with its own key which can be handed out with a share or a link
+	File which isn't shared yet gets new own key and its content (names in subtree of directory
+	or data keys of file) is re-encrypted with it in one transaction
+	Returns LegacyFile if the file (or file in the directory) was stored by older version
+*/
+func (db *Database) ShareKey(pathNames []string, key []byte, userRoot uuid.UUID) (*models.File, []byte, error) {
+	var f *models.File
+	var ownKey []byte
+	err := crdbpgx.ExecuteTx(context.Background(), db.pool, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		ctx := context.Background()
+		var s scope
+		var err error
+		if f, s, err = lookupFile(tx, pathNames, key, userRoot); err != nil {
+			return err
+		}
+		if f.OwnKey != nil {
+			ownKey, err = contentKey(f, s.key)
+			if err != nil {
+				return err
+			}
+			return exposeFile(f, s.key, key)
+		}
+
+		if ownKey, err = crypt.NewKey(); err != nil {
+			return err
+		}
+		if err = rekeyContent(ctx, tx, f, s.key, ownKey); err != nil {
+			return err
+		}
+		if f.OwnKey, err = crypt.WrapKey(s.key, ownKey); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(ctx, "UPDATE file_tree SET own_key = $2 WHERE id = $1;", f.Id, f.OwnKey); err != nil {
+			return err
+		}
+		if err = setOwnName(ctx, tx, f, f.Name, s.key); err != nil {
+			return err
+		}
+		return exposeFile(f, s.key, key)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, ownKey, nil
+}
+
+/*
+	Gets shared file or directory with provided id (root of drive opened with a share or a link)
+	Its name is decrypted with its own key and its data key is wrapped with it
+	Returns FileNotFound if the file isn't placed under owner's root anymore (e.g. it's in trash)
+*/
+func (db *Database) GetSharedFile(id uuid.UUID, key []byte, owner uuid.UUID) (*models.File, error) {
+	sqlQuery := `
+	WITH RECURSIVE up (cur) AS (
+		SELECT parent_id FROM file_tree WHERE id = $1
+		UNION ALL
+		SELECT f.parent_id FROM up u JOIN file_tree f ON f.id = u.cur
+		WHERE u.cur != $2
+	)
+	SELECT EXISTS (SELECT 1 FROM up WHERE cur = $2);
+	`
+	var attached bool
+	if err := db.pool.QueryRow(context.Background(), sqlQuery, id, owner).Scan(&attached); err != nil {
+		return nil, err
+	}
+	if !attached {
+		return nil, FileNotFound
+	}
+	return sharedFile(db.pool, id, key)
+}
+
+// Shares file with recipient and sets id and creation time of the share
+// If the file is already shared with the recipient, its permission and key are replaced
+func (db *Database) ShareFile(share *models.Share) error {
+	sqlFormula := `
+	INSERT INTO shares (file_id, owner, recipient, permission, wrapped_key)
+	VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (file_id, recipient) DO UPDATE SET permission = excluded.permission, wrapped_key = excluded.wrapped_key
+	RETURNING id, created_at;
+	`
+	row := db.pool.QueryRow(context.Background(), sqlFormula,
+		share.FileId, share.Owner, share.Recipient, string(share.Permission), share.WrappedKey)
+	return row.Scan(&share.Id, &share.CreatedAt)
+}
+
+// Gets share with provided id
+// Returns FileNotFound if there is no such share
+func (db *Database) GetShare(id uuid.UUID) (*models.Share, error) {
+	share := models.Share{}
+	sqlQuery := "SELECT " + shareColumns + " FROM " + shareTables + " WHERE shares.id = $1;"
+	if err := scanShare(db.pool.QueryRow(context.Background(), sqlQuery, id), &share); err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, FileNotFound
+		}
+		return nil, err
+	}
+	return &share, nil
+}
+
+// Lists files shared by owner (the newest first)
+func (db *Database) ListSharesByOwner(owner uuid.UUID) ([]models.Share, error) {
+	return db.listShares("shares.owner = $1", owner)
+}
+
+// Lists files shared with recipient (the newest first)
+func (db *Database) ListSharesWithUser(recipient string) ([]models.Share, error) {
+	return db.listShares("shares.recipient = $1", recipient)
+}
+
+func (db *Database) listShares(condition string, arg interface{}) ([]models.Share, error) {
+	sqlQuery := "SELECT " + shareColumns + " FROM " + shareTables + " WHERE " + condition + " ORDER BY shares.created_at DESC;"
+	rows, err := db.pool.Query(context.Background(), sqlQuery, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shares := []models.Share{}
+	for rows.Next() {
+		share := models.Share{}
+		if err := scanShare(rows, &share); err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	return shares, rows.Err()
+}
+
+// Removes share with provided id (it can be revoked by owner or left by recipient)
+// Returns FileNotFound if there is no such share of the user
+func (db *Database) DeleteShare(id uuid.UUID, username string) error {
+	sqlFormula := `
+	DELETE FROM shares
+	WHERE id = $1 AND (recipient = $2 OR owner = (SELECT id FROM users WHERE username = $2));
+	`
+	tag, err := db.pool.Exec(context.Background(), sqlFormula, id, username)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return FileNotFound
+	}
+	return nil
+}
+
+func scanShare(row pgx.Row, share *models.Share) error {
+	var permission string
+	err := row.Scan(&share.Id, &share.FileId, &share.Owner, &share.OwnerName, &share.Recipient, &permission,
+		&share.WrappedKey, &share.CreatedAt)
+	share.Permission = models.Permission(permission)
+	return err
+}
@@ -0,0 +1,90 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/noisersup/encryptedfs-api/crypt"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ShareKeyRekeysDirectory(t *testing.T) {
+	db, blobs := testDB(t)
+	root, key := testUser(t, db)
+
+	f, dataKey := testFile(t, db, blobs, []string{"dir", "sub", "a.txt"}, key, root)
+
+	dir, ownKey, err := db.ShareKey([]string{"dir"}, key, root)
+	assert.NoError(t, err)
+	assert.NotEqual(t, key, ownKey)
+	assert.Equal(t, "dir", dir.Name)
+
+	// subtree is encrypted with own key of the directory, not with key of the user
+	_, err = crypt.UnwrapKey(key, storedKey(t, db, f.Id))
+	assert.Error(t, err)
+	unwrapped, err := crypt.UnwrapKey(ownKey, storedKey(t, db, f.Id))
+	assert.NoError(t, err)
+	assert.Equal(t, dataKey, unwrapped)
+
+	// owner still reads it through the path
+	owned, err := db.GetFile([]string{"dir", "sub", "a.txt"}, key, root)
+	assert.NoError(t, err)
+	unwrapped, err = crypt.UnwrapKey(key, owned.WrappedKey)
+	assert.NoError(t, err)
+	assert.Equal(t, dataKey, unwrapped)
+
+	// and recipient through drive rooted at the directory
+	shared, err := db.GetSharedFile(dir.Id, ownKey, root)
+	assert.NoError(t, err)
+	assert.Equal(t, "dir", shared.Name)
+	received, err := db.GetFile([]string{"sub", "a.txt"}, ownKey, dir.Id)
+	assert.NoError(t, err)
+	unwrapped, err = crypt.UnwrapKey(ownKey, received.WrappedKey)
+	assert.NoError(t, err)
+	assert.Equal(t, dataKey, unwrapped)
+
+	// sharing again hands out the same key
+	_, again, err := db.ShareKey([]string{"dir"}, key, root)
+	assert.NoError(t, err)
+	assert.Equal(t, ownKey, again)
+
+	// file moved out of the shared directory is rewrapped with key of the user
+	assert.NoError(t, db.MoveFile([]string{"dir", "sub", "a.txt"}, []string{"a.txt"}, key, root))
+	unwrapped, err = crypt.UnwrapKey(key, storedKey(t, db, f.Id))
+	assert.NoError(t, err)
+	assert.Equal(t, dataKey, unwrapped)
+	_, err = db.GetFile([]string{"sub", "a.txt"}, ownKey, dir.Id)
+	assert.Equal(t, FileNotFound, err)
+}
+
+func Test_TrashOfSharedDirectory(t *testing.T) {
+	db, blobs := testDB(t)
+	root, key := testUser(t, db)
+
+	testFile(t, db, blobs, []string{"dir", "a.txt"}, key, root)
+	dir, ownKey, err := db.ShareKey([]string{"dir"}, key, root)
+	assert.NoError(t, err)
+
+	// recipient deletes the file inside the shared directory
+	assert.NoError(t, db.TrashFile([]string{"a.txt"}, ownKey, dir.Id))
+
+	// both see it in their trash, with path from root of their drive
+	items, err := db.ListTrash(ownKey, dir.Id)
+	assert.NoError(t, err)
+	if assert.Len(t, items, 1) {
+		assert.Equal(t, []string{"a.txt"}, items[0].Path)
+	}
+	owned, err := db.ListTrash(key, root)
+	assert.NoError(t, err)
+	if assert.Len(t, owned, 1) {
+		assert.Equal(t, []string{"dir", "a.txt"}, owned[0].Path)
+	}
+
+	path, err := db.RestoreFile(items[0].Id, ownKey, dir.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.txt"}, path)
+	_, err = db.GetFile([]string{"dir", "a.txt"}, key, root)
+	assert.NoError(t, err)
+	items, err = db.ListTrash(ownKey, dir.Id)
+	assert.NoError(t, err)
+	assert.Empty(t, items)
+}
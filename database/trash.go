@@ -0,0 +1,376 @@
+/*
+	Trash of deleted files
+
+	Deleted file stays in file_tree with parent_id set to NULL, so it (with its whole subtree)
+	is detached from the tree of its owner but keeps its content, metadata and id.
+	Its original path is stored in trash table encrypted with key of the owner.
+	Files deleted inside of shared directory are kept in its trash (with path relative to it
+	encrypted with its own key), so they can be restored both by the owner (in trash of the drive)
+	and by recipients (in trash of the shared directory, whose root is the directory itself).
+	Files (with their versions) are removed permanently when trash is emptied
+	or when they are purged after retention period.
+*/
+package database
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach-go/v2/crdb/crdbpgx"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/noisersup/encryptedfs-api/crypt"
+	"github.com/noisersup/encryptedfs-api/models"
+)
+
+// Moves file on provided path (with its whole subtree) to trash of the drive with provided root
+// (trash of a group is kept under root of the group and listed with /groups/{id}/trash)
+func (db *Database) TrashFile(pathNames []string, key []byte, userRoot uuid.UUID) error {
+	if len(pathNames) == 0 {
+		return fmt.Errorf("TrashFile: no path provided")
+	}
+
+	return crdbpgx.ExecuteTx(context.Background(), db.pool, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		f, s, err := lookupFile(tx, pathNames, key, userRoot)
+		if err != nil {
+			return err
+		}
+		path, err := crypt.Encrypt(s.key, []byte(strings.Join(pathNames[len(s.path):], "/")))
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(context.Background(), "UPDATE file_tree SET parent_id = NULL WHERE id = $1;", f.Id); err != nil {
+			return err
+		}
+		_, err = tx.Exec(context.Background(), "INSERT INTO trash (id, root, path) VALUES ($1, $2, $3);", f.Id, s.root, path)
+		return err
+	})
+}
+
+// Lists files in trash of the user (most recently deleted first)
+// including files deleted inside of shared directories
+// (names and paths are decrypted with key)
+func (db *Database) ListTrash(key []byte, userRoot uuid.UUID) ([]models.TrashItem, error) {
+	scopes, err := innerScopes(db.pool, userRoot, key)
+	if err != nil {
+		return nil, err
+	}
+
+	items := []models.TrashItem{}
+	for _, s := range append([]scope{{root: userRoot, key: key}}, scopes...) {
+		found, err := db.listTrash(s, key)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, found...)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].DeletedAt.Equal(items[j].DeletedAt) {
+			return items[i].DeletedAt.After(items[j].DeletedAt)
+		}
+		return items[i].Id.String() < items[j].Id.String()
+	})
+	return items, nil
+}
+
+// Lists files in trash of scope s (paths are prefixed with path of the scope
+// and keys of files are returned wrapped with key)
+func (db *Database) listTrash(s scope, key []byte) ([]models.TrashItem, error) {
+	sqlQuery := `
+	SELECT ` + fileColumns + `, t.path, t.deleted_at
+	FROM file_tree f JOIN trash t USING (id)
+	WHERE t.root = $1;
+	`
+	rows, err := db.pool.Query(context.Background(), sqlQuery, s.root)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []models.TrashItem{}
+	for rows.Next() {
+		item := models.TrashItem{}
+		var path []byte
+		if err := scanFile(rows, &item.File, s.key, &path, &item.DeletedAt); err != nil {
+			return nil, err
+		}
+		if item.Path, err = decryptPath(s.key, path); err != nil {
+			return nil, err
+		}
+		item.Path = append(append([]string{}, s.path...), item.Path...)
+		if err = exposeFile(&item.File, s.key, key); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+/*
+	Moves file from trash back to its original path and returns the path
+	Missing parent directories are created
+	Returns FileNotFound if the item isn't in trash of the user
+	and FileExists if the original path is taken
+*/
+func (db *Database) RestoreFile(id uuid.UUID, key []byte, userRoot uuid.UUID) ([]string, error) {
+	var root uuid.UUID
+	var path []byte
+	err := db.pool.QueryRow(context.Background(), "SELECT root, path FROM trash WHERE id = $1;", id).Scan(&root, &path)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, FileNotFound
+		}
+		return nil, err
+	}
+	// file is restored in trash of the drive or of shared directory under it
+	s, err := findScope(db.pool, root, key, userRoot)
+	if err != nil {
+		return nil, err
+	}
+	pathNames, err := decryptPath(s.key, path)
+	if err != nil {
+		return nil, err
+	}
+
+	parentId, dirKey, err := db.ensureParent(pathNames, s.key, s.root)
+	if err != nil {
+		return nil, err
+	}
+
+	err = crdbpgx.ExecuteTx(context.Background(), db.pool, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		name := pathNames[len(pathNames)-1]
+		_, err := getEntry(tx, name, dirKey, parentId)
+		if err == nil {
+			return FileExists
+		}
+		if err != FileNotFound {
+			return err
+		}
+
+		tag, err := tx.Exec(context.Background(), "DELETE FROM trash WHERE id = $1 AND root = $2;", id, s.root)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return FileNotFound
+		}
+
+		rows, err := tx.Query(context.Background(), "SELECT "+fileColumns+" FROM file_tree WHERE id = $1;", id)
+		if err != nil {
+			return err
+		}
+		f := models.File{}
+		found := rows.Next()
+		if found {
+			err = scanFile(rows, &f, s.key)
+		}
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		if !found {
+			return FileNotFound
+		}
+		// parent directory could be shared after the file was deleted
+		return relinkFile(context.Background(), tx, &f, name, parentId, s.key, dirKey)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]string{}, s.path...), pathNames...), nil
+}
+
+// Permanently deletes item with provided id from trash of the user
+// Returns FileNotFound if the item isn't in the trash
+func (db *Database) DeleteFromTrash(id uuid.UUID, userRoot uuid.UUID) error {
+	roots, err := scopeRoots(db.pool, userRoot)
+	if err != nil {
+		return err
+	}
+	n, err := db.purge("id = $1 AND root = ANY($2::UUID[])", id, roots)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return FileNotFound
+	}
+	return nil
+}
+
+// Permanently deletes all items from trash of the user (with trash of shared directories in the drive)
+// and returns their number
+func (db *Database) EmptyTrash(userRoot uuid.UUID) (int, error) {
+	roots, err := scopeRoots(db.pool, userRoot)
+	if err != nil {
+		return 0, err
+	}
+	return db.purge("root = ANY($1::UUID[])", roots)
+}
+
+// Permanently deletes items of all users moved to trash before provided time
+// Returns number of deleted items
+func (db *Database) PurgeTrash(deletedBefore time.Time) (int, error) {
+	return db.purge("deleted_at < $1", deletedBefore)
+}
+
+// Permanently deletes trash items matching SQL condition with their subtrees
+// Blobs are removed after the transaction unless they are shared with other entries
+// Returns number of deleted trash items
+func (db *Database) purge(condition string, args ...interface{}) (int, error) {
+	var n int
+	var blobs []string
+	err := crdbpgx.ExecuteTx(context.Background(), db.pool, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		var err error
+		n, blobs, err = purgeTrash(context.Background(), tx, condition, args...)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	db.removeBlobs(blobs)
+	return n, nil
+}
+
+// Deletes trash items matching SQL condition with their subtrees
+// Returns number of deleted items and names of blobs which are no longer used
+func purgeTrash(ctx context.Context, tx pgx.Tx, condition string, args ...interface{}) (int, []string, error) {
+	ids, err := queryIds(ctx, tx, "DELETE FROM trash WHERE "+condition+" RETURNING id;", args...)
+	if err != nil || len(ids) == 0 {
+		return 0, nil, err
+	}
+
+	blobs, err := deleteTree(ctx, tx, ids)
+	if err != nil {
+		return 0, nil, err
+	}
+	return len(ids), blobs, nil
+}
+
+// Deletes entries with provided ids with their subtrees (with their versions, shares and links)
+// Returns names of blobs which are no longer used
+func deleteTree(ctx context.Context, tx pgx.Tx, ids []string) ([]string, error) {
+	sqlQuery := `
+	WITH RECURSIVE tree (id) AS (
+		SELECT id FROM file_tree WHERE id = ANY($1::UUID[])
+		UNION ALL
+		SELECT f.id FROM file_tree f JOIN tree t ON f.parent_id = t.id
+	)
+	SELECT id FROM tree;
+	`
+	subtree, err := queryIds(ctx, tx, sqlQuery, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	deleted, err := queryBlobRefs(ctx, tx, "SELECT hash, duplicate FROM file_tree WHERE id = ANY($1::UUID[]) AND NOT is_directory;", subtree)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = tx.Exec(ctx, "DELETE FROM file_tree WHERE id = ANY($1::UUID[]);", subtree); err != nil {
+		return nil, err
+	}
+	if _, err = tx.Exec(ctx, "DELETE FROM share_links WHERE file_id = ANY($1::UUID[]);", subtree); err != nil {
+		return nil, err
+	}
+	if _, err = tx.Exec(ctx, "DELETE FROM shares WHERE file_id = ANY($1::UUID[]);", subtree); err != nil {
+		return nil, err
+	}
+	versions, err := queryBlobRefs(ctx, tx, "DELETE FROM file_versions WHERE file_id = ANY($1::UUID[]) RETURNING hash, duplicate;", subtree)
+	if err != nil {
+		return nil, err
+	}
+	blobs, err := unusedBlobs(ctx, tx, append(deleted, versions...))
+	if err != nil {
+		return nil, err
+	}
+
+	// files in trash of deleted shared directories
+	trashed, err := queryIds(ctx, tx, "DELETE FROM trash WHERE root = ANY($1::UUID[]) RETURNING id;", subtree)
+	if err != nil || len(trashed) == 0 {
+		return blobs, err
+	}
+	names, err := deleteTree(ctx, tx, trashed)
+	if err != nil {
+		return nil, err
+	}
+	return append(blobs, names...), nil
+}
+
+// Re-encrypts files in trash of scope with provided root (with their original paths) from key from to key to
+func rekeyTrash(ctx context.Context, tx pgx.Tx, root uuid.UUID, from, to []byte) error {
+	sqlQuery := `
+	SELECT ` + fileColumns + `, t.path
+	FROM file_tree f JOIN trash t USING (id)
+	WHERE t.root = $1;
+	`
+	rows, err := tx.Query(ctx, sqlQuery, root)
+	if err != nil {
+		return err
+	}
+	type trashed struct {
+		f    models.File
+		path []byte
+	}
+	items := []trashed{}
+	for rows.Next() {
+		var item trashed
+		if err := scanFile(rows, &item.f, from, &item.path); err != nil {
+			rows.Close()
+			return err
+		}
+		items = append(items, item)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range items {
+		pathNames, err := decryptPath(from, items[i].path)
+		if err != nil {
+			return err
+		}
+		path, err := crypt.Encrypt(to, []byte(strings.Join(pathNames, "/")))
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(ctx, "UPDATE trash SET path = $2 WHERE id = $1;", items[i].f.Id, path); err != nil {
+			return err
+		}
+		if err = rekeyEntry(ctx, tx, &items[i].f, from, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns ids (as strings) selected by query
+func queryIds(ctx context.Context, q querier, sqlQuery string, args ...interface{}) ([]string, error) {
+	rows, err := q.Query(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id.String())
+	}
+	return ids, rows.Err()
+}
+
+// Decrypts path stored with key
+func decryptPath(key, encrypted []byte) ([]string, error) {
+	path, err := crypt.Decrypt(key, encrypted)
+	if err != nil {
+		return nil, err
+	}
+	return PathToArr(string(path)), nil
+}
@@ -0,0 +1,82 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/noisersup/encryptedfs-api/crypt"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_PurgeTrashRemovesUnusedBlobs(t *testing.T) {
+	db, blobs := testDB(t)
+	root, key := testUser(t, db)
+
+	f, _ := testFile(t, db, blobs, []string{"dir", "a.txt"}, key, root)
+	// copy shares blob of the file
+	assert.NoError(t, db.CopyFile([]string{"dir", "a.txt"}, []string{"b.txt"}, key, root))
+
+	assert.NoError(t, db.TrashFile([]string{"dir"}, key, root))
+	items, err := db.ListTrash(key, root)
+	assert.NoError(t, err)
+	if assert.Len(t, items, 1) {
+		assert.Equal(t, []string{"dir"}, items[0].Path)
+	}
+	_, err = db.GetFile([]string{"dir", "a.txt"}, key, root)
+	assert.Equal(t, FileNotFound, err)
+
+	// blob is kept while the copy uses it
+	n, err := db.EmptyTrash(root)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assertBlob(t, blobs, f.BlobName(), true)
+	copied, err := db.GetFile([]string{"b.txt"}, key, root)
+	assert.NoError(t, err)
+	assert.Equal(t, f.Hash, copied.Hash)
+
+	// and removed with the last entry using it when it expires in trash
+	assert.NoError(t, db.TrashFile([]string{"b.txt"}, key, root))
+	_, err = db.pool.Exec(context.Background(), "UPDATE trash SET deleted_at = now() - INTERVAL '2 days' WHERE id = $1;", copied.Id)
+	assert.NoError(t, err)
+	n, err = db.PurgeTrash(time.Now().Add(-24 * time.Hour))
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, n, 1)
+	assertBlob(t, blobs, f.BlobName(), false)
+
+	items, err = db.ListTrash(key, root)
+	assert.NoError(t, err)
+	assert.Empty(t, items)
+}
+
+func Test_RestoreFile(t *testing.T) {
+	db, blobs := testDB(t)
+	root, key := testUser(t, db)
+
+	f, dataKey := testFile(t, db, blobs, []string{"dir", "sub", "a.txt"}, key, root)
+	assert.NoError(t, db.TrashFile([]string{"dir", "sub"}, key, root))
+	assert.NoError(t, db.DeleteFile([]string{"dir"}, key, root))
+
+	items, err := db.ListTrash(key, root)
+	assert.NoError(t, err)
+	if !assert.Len(t, items, 1) {
+		return
+	}
+	assert.Equal(t, []string{"dir", "sub"}, items[0].Path)
+
+	// missing parent is created again
+	path, err := db.RestoreFile(items[0].Id, key, root)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dir", "sub"}, path)
+	restored, err := db.GetFile([]string{"dir", "sub", "a.txt"}, key, root)
+	assert.NoError(t, err)
+	assert.Equal(t, f.Id, restored.Id)
+	unwrapped, err := crypt.UnwrapKey(key, restored.WrappedKey)
+	assert.NoError(t, err)
+	assert.Equal(t, dataKey, unwrapped)
+	// blob of the file wasn't removed with its deleted parent
+	assertBlob(t, blobs, f.BlobName(), true)
+
+	_, err = db.RestoreFile(items[0].Id, key, root)
+	assert.Equal(t, FileNotFound, err)
+}
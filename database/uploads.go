@@ -0,0 +1,78 @@
+/*
+	Database operations on unfinished resumable uploads
+*/
+package database
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/noisersup/encryptedfs-api/models"
+)
+
+var UploadConflict error = errors.New("Upload offset mismatch")
+
+// Adds upload entry to database and sets its id and creation time
+func (db *Database) NewUpload(u *models.Upload) error {
+	sqlFormula := "INSERT INTO uploads (owner, path, size, header, wrapped_key) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at;"
+	return db.pool.QueryRow(context.Background(), sqlFormula, u.Owner, u.Path, u.Size, u.Header, u.WrappedKey).Scan(&u.Id, &u.CreatedAt)
+}
+
+// Gets upload with provided id started by owner
+func (db *Database) GetUpload(id uuid.UUID, owner string) (*models.Upload, error) {
+	u := models.Upload{}
+	sqlQuery := "SELECT id, owner, path, size, received, parts, header, wrapped_key, hash_state, created_at FROM uploads WHERE id = $1 AND owner = $2;"
+	err := db.pool.QueryRow(context.Background(), sqlQuery, id, owner).Scan(
+		&u.Id, &u.Owner, &u.Path, &u.Size, &u.Received, &u.Parts, &u.Header, &u.WrappedKey, &u.HashState, &u.CreatedAt,
+	)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, FileNotFound
+		}
+		return nil, err
+	}
+	return &u, nil
+}
+
+// Moves offset of upload from received to newReceived and sets number of its stored parts
+// and state of checksum of received data
+// Returns UploadConflict if offset of upload was changed in the meantime
+func (db *Database) AdvanceUpload(id uuid.UUID, received, newReceived int64, parts int, hashState []byte) error {
+	sqlFormula := "UPDATE uploads SET received = $3, parts = $4, hash_state = $5 WHERE id = $1 AND received = $2;"
+	tag, err := db.pool.Exec(context.Background(), sqlFormula, id, received, newReceived, parts, hashState)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return UploadConflict
+	}
+	return nil
+}
+
+func (db *Database) DeleteUpload(id uuid.UUID) error {
+	_, err := db.pool.Exec(context.Background(), "DELETE FROM uploads WHERE id = $1;", id)
+	return err
+}
+
+// Lists uploads of all users started before provided time
+// (only Id, Owner, Parts and CreatedAt are filled)
+func (db *Database) ListStaleUploads(createdBefore time.Time) ([]models.Upload, error) {
+	rows, err := db.pool.Query(context.Background(), "SELECT id, owner, parts, created_at FROM uploads WHERE created_at < $1;", createdBefore)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := []models.Upload{}
+	for rows.Next() {
+		u := models.Upload{}
+		if err := rows.Scan(&u.Id, &u.Owner, &u.Parts, &u.CreatedAt); err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, u)
+	}
+	return uploads, rows.Err()
+}
@@ -5,15 +5,13 @@ import (
 	"crypto/sha256"
 	"errors"
 	"fmt"
-	"log"
-	"os"
+	"path"
 	"regexp"
 	"strings"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v4"
-	"github.com/jackc/pgx/v4/pgxpool"
-	"github.com/noisersup/encryptedfs-api/logger"
+	"github.com/noisersup/encryptedfs-api/crypt"
 	"github.com/noisersup/encryptedfs-api/models"
 )
 
@@ -39,6 +37,14 @@ func getHashOfFile(fileName, key []byte) string {
 */
 var FileNotFound error = errors.New("File not found")
 var FileExists error = errors.New("File exists")
+var InvalidMove error = errors.New("Invalid destination")
+var PreconditionFailed error = errors.New("Precondition failed")
+
+// querier is implemented both by connection pool and transaction
+// so lookups can be done inside of transactions
+type querier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+}
 
 /*
 
@@ -47,25 +53,39 @@ var FileExists error = errors.New("File exists")
 */
 
 // Get metadata of specified file from database
-func getFile(pool *pgxpool.Pool, pathNames []string, parent uuid.UUID) (*models.File, error) {
-	if len(pathNames) == 0 {
-		return nil, errors.New("pathNames empty")
+// (names are encrypted with key, keys of the file are returned wrapped with key)
+func getFile(q querier, pathNames []string, key []byte, parent uuid.UUID) (*models.File, error) {
+	f, s, err := lookupFile(q, pathNames, key, parent)
+	if err != nil {
+		return nil, err
+	}
+	if err = exposeFile(f, s.key, key); err != nil {
+		return nil, err
 	}
+	return f, nil
+}
 
+// Get metadata of file with provided name in directory parent
+// (names in the directory are encrypted with key)
+func getEntry(q querier, name string, key []byte, parent uuid.UUID) (*models.File, error) {
 	f := models.File{}
 
-	// Get metadata of first file from pathNames
-	sqlQuery := "SELECT id, encrypted_name, hash, parent_id,duplicate, is_directory FROM file_tree WHERE encrypted_name = $1 AND parent_id = $2;"
-	rows, err := pool.Query(context.Background(), sqlQuery, pathNames[0], parent)
+	encryptedName, err := crypt.EncryptName(key, name)
+	if err != nil {
+		return nil, err
+	}
+
+	sqlQuery := "SELECT " + fileColumns + " FROM file_tree WHERE encrypted_name = $1 AND parent_id = $2;"
+	rows, err := q.Query(context.Background(), sqlQuery, encryptedName, parent)
 	if err != nil {
-		rows.Close()
 		return nil, err
 	}
 
 	fileFound := false
 
 	for rows.Next() {
-		if err := rows.Scan(&f.Id, &f.Name, &f.Hash, &f.ParentId, &f.Duplicate, &f.IsDirectory); err != nil {
+		if err := scanFile(rows, &f, key); err != nil {
+			rows.Close()
 			return nil, err
 		}
 		fileFound = true
@@ -76,54 +96,147 @@ func getFile(pool *pgxpool.Pool, pathNames []string, parent uuid.UUID) (*models.
 	if !fileFound {
 		return nil, FileNotFound
 	}
+	return &f, nil
+}
 
-	// Closes recursion
-	// if it's last file in path returns it
-	if len(pathNames) == 1 {
-		return &f, nil
+// deletes file entry (with whole its subtree) from database
+// Returns names of blobs which are no longer used by any entry
+// (they have to be removed from blob store after the transaction is committed)
+func deleteFile(ctx context.Context, tx pgx.Tx, pathNames []string, key []byte, root uuid.UUID) ([]string, error) {
+	f, _, err := lookupFile(tx, pathNames, key, root)
+	if err != nil {
+		return nil, err
 	}
+	return deleteTree(ctx, tx, []string{f.Id.String()})
+}
 
-	return getFile(pool, pathNames[1:], f.Id)
+/*
+	Moves file (with whole its subtree) from src path to dst path
+	Parent directory of dst must exist
+	Returns FileExists if dst is taken and InvalidMove if dst is inside of moved directory
+*/
+func moveFile(ctx context.Context, tx pgx.Tx, src, dst []string, key []byte, root uuid.UUID) error {
+	f, s, err := lookupFile(tx, src, key, root)
+	if err != nil {
+		return err
+	}
+
+	parentId, dirKey, err := destinationParent(ctx, tx, f, dst, key, root)
+	if err != nil {
+		return err
+	}
+	return relinkFile(ctx, tx, f, dst[len(dst)-1], parentId, s.key, dirKey)
 }
 
-// deletes file entry from database and removes it from disk
-func deleteFile(pool *pgxpool.Pool, ctx context.Context, tx pgx.Tx, pathNames []string, root uuid.UUID) error {
-	f, err := getFile(pool, pathNames, root)
+/*
+	Copies file (with whole its subtree) from src path to dst path
+	Copies share blobs with their originals
+	(blob is removed with the last file_tree entry referencing it)
+	Parent directory of dst must exist
+	Returns FileExists if dst is taken and InvalidMove if dst is inside of copied directory
+*/
+func copyFile(ctx context.Context, tx pgx.Tx, src, dst []string, key []byte, root uuid.UUID) error {
+	f, s, err := lookupFile(tx, src, key, root)
+	if err != nil {
+		return err
+	}
+
+	parentId, dirKey, err := destinationParent(ctx, tx, f, dst, key, root)
 	if err != nil {
 		return err
 	}
 
+	srcId := f.Id
+	srcKey, err := contentKey(f, s.key)
+	if err != nil {
+		return err
+	}
+	if err = copyKeys(f, s.key, dirKey); err != nil {
+		return err
+	}
+	f.Name = dst[len(dst)-1]
+	f.ParentId = parentId
+	if err = newFile(ctx, tx, f, dirKey); err != nil {
+		return err
+	}
+
 	if f.IsDirectory {
-		childs, _ := listDirectory(pool, f.Id)
-		for _, ch := range childs {
-			err = deleteFile(pool, ctx, tx, append(pathNames, ch.Name), root)
-			if err != nil {
-				if strings.Contains(err.Error(), "no such file or directory") {
-					logger.Warn(err.Error())
-				} else {
-					return err
-				}
-			}
-		}
+		return copyTree(ctx, tx, srcId, f.Id, srcKey, dirKey)
 	}
+	return nil
+}
 
-	if _, err = tx.Exec(ctx, "DELETE FROM file_tree WHERE id = $1;", f.Id); err != nil {
+// Copies content of directory src (with names encrypted with key from)
+// into directory dst (with names encrypted with key to)
+func copyTree(ctx context.Context, tx pgx.Tx, src, dst uuid.UUID, from, to []byte) error {
+	childs, err := listDirectory(tx, src, from)
+	if err != nil {
+		if err == FileNotFound {
+			return nil
+		}
 		return err
 	}
 
-	var filePath string
+	for _, ch := range childs {
+		srcId := ch.Id
+		srcKey, err := contentKey(&ch, from)
+		if err != nil {
+			return err
+		}
+		if err = copyKeys(&ch, from, to); err != nil {
+			return err
+		}
+		ch.ParentId = dst
+		if err = newFile(ctx, tx, &ch, to); err != nil {
+			return err
+		}
+		if ch.IsDirectory {
+			if err = copyTree(ctx, tx, srcId, ch.Id, srcKey, to); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
-	if f.Duplicate == 0 {
-		filePath = fmt.Sprintf("./files/%s", f.Hash)
-	} else {
-		filePath = fmt.Sprintf("./files/%s%d", f.Hash, f.Duplicate)
+// Returns id of directory in which f can be placed under dst path with key of names in it
+// Returns InvalidMove if parent of dst is not a directory or dst is inside of f
+func destinationParent(ctx context.Context, tx pgx.Tx, f *models.File, dst []string, key []byte, root uuid.UUID) (uuid.UUID, []byte, error) {
+	parentId, dirKey := root, key
+	if len(dst) > 1 {
+		parent, s, err := lookupFile(tx, dst[:len(dst)-1], key, root)
+		if err != nil {
+			return uuid.UUID{}, nil, err
+		}
+		if !parent.IsDirectory {
+			return uuid.UUID{}, nil, InvalidMove
+		}
+		if dirKey, err = contentKey(parent, s.key); err != nil {
+			return uuid.UUID{}, nil, err
+		}
+		parentId = parent.Id
 	}
 
 	if f.IsDirectory {
-		return nil
+		// directory can't be placed into itself or its descendant
+		// (root of drive of shared directory is the directory itself)
+		sqlQuery := `
+		WITH RECURSIVE ancestors (id, parent_id) AS (
+			SELECT id, parent_id FROM file_tree WHERE id = $1
+			UNION ALL
+			SELECT f.id, f.parent_id FROM file_tree f JOIN ancestors a ON f.id = a.parent_id
+		)
+		SELECT EXISTS (SELECT 1 FROM ancestors WHERE id = $2);
+		`
+		var inside bool
+		if err := tx.QueryRow(ctx, sqlQuery, parentId, f.Id).Scan(&inside); err != nil {
+			return uuid.UUID{}, nil, err
+		}
+		if inside {
+			return uuid.UUID{}, nil, InvalidMove
+		}
 	}
-
-	return os.Remove(filePath)
+	return parentId, dirKey, nil
 }
 
 // Creates empty file
@@ -138,15 +251,25 @@ func newRootEntry(ctx context.Context, tx pgx.Tx) error {
 	return nil
 }
 
-// Creates new file entry in database
-func newFile(ctx context.Context, tx pgx.Tx, name string, hash string, parent uuid.UUID, duplicate int, isDirectory bool) error {
-	log.Print("newFile: ", name)
-	if len(name) > 255 {
+// Creates new file entry in database (with name encrypted with key) and sets id of provided file
+func newFile(ctx context.Context, tx pgx.Tx, f *models.File, key []byte) error {
+	if len(f.Name) > 255 {
 		return errors.New("Filename too big")
 	}
 
-	sqlFormula := "INSERT INTO file_tree (encrypted_name, hash, parent_id, duplicate, is_directory) VALUES ($1, $2, $3, $4, $5);"
-	if _, err := tx.Exec(ctx, sqlFormula, name, hash, parent, duplicate, isDirectory); err != nil {
+	encryptedName, err := crypt.EncryptName(key, f.Name)
+	if err != nil {
+		return err
+	}
+
+	sqlFormula := `
+	INSERT INTO file_tree (encrypted_name, name_encrypted, hash, parent_id, duplicate, is_directory, wrapped_key, size, content_type, checksum, name_tokens)
+	VALUES ($1, TRUE, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	RETURNING id, created_at, modified_at, version;
+	`
+	row := tx.QueryRow(ctx, sqlFormula, encryptedName, f.Hash, f.ParentId, f.Duplicate, f.IsDirectory, f.WrappedKey,
+		f.Size, f.ContentType, f.Checksum, crypt.NameTokens(key, f.Name))
+	if err := row.Scan(&f.Id, &f.CreatedAt, &f.ModifiedAt, &f.Version); err != nil {
 		if strings.Contains(err.Error(), "duplicate key value") {
 			return FileExists
 		}
@@ -155,11 +278,102 @@ func newFile(ctx context.Context, tx pgx.Tx, name string, hash string, parent uu
 	return nil
 }
 
+// Replaces content of file on provided path with content of f and fills the rest of f
+// (data key of f is wrapped with key)
+func replaceFile(ctx context.Context, tx pgx.Tx, pathNames []string, key []byte, f *models.File, root uuid.UUID, ifMatch string) error {
+	old, s, err := lookupFile(tx, pathNames, key, root)
+	if err != nil {
+		return err
+	}
+	if ifMatch != "" && !old.MatchesETag(ifMatch) {
+		return PreconditionFailed
+	}
+	return replaceContent(ctx, tx, old, f, key, s.key)
+}
+
+// Sets content of old entry (read in directory with key dirKey) to content of f
+// with data key wrapped with key and fills the rest of f
+// Replaced content is kept as a version of the file
+func replaceContent(ctx context.Context, tx pgx.Tx, old, f *models.File, key, dirKey []byte) error {
+	if old.IsDirectory {
+		return FileExists
+	}
+	ownKey, err := contentKey(old, dirKey)
+	if err != nil {
+		return err
+	}
+	wrappedKey, err := rewrapKey(f.WrappedKey, key, ownKey)
+	if err != nil {
+		return err
+	}
+	if err := archiveVersion(ctx, tx, old.Id); err != nil {
+		return err
+	}
+
+	sqlFormula := `
+	UPDATE file_tree SET hash = $2, duplicate = $3, wrapped_key = $4, size = $5, content_type = $6, checksum = $7,
+		modified_at = now(), version = version + 1
+	WHERE id = $1
+	RETURNING created_at, modified_at, version;
+	`
+	row := tx.QueryRow(ctx, sqlFormula, old.Id, f.Hash, f.Duplicate, wrappedKey, f.Size, f.ContentType, f.Checksum)
+	if err := row.Scan(&f.CreatedAt, &f.ModifiedAt, &f.Version); err != nil {
+		return err
+	}
+	f.Id = old.Id
+	f.Name = old.Name
+	f.ParentId = old.ParentId
+	return nil
+}
+
+// Maximal number of tried names "name (n).ext" of renamed file
+const maxRenames = 1000
+
+// Stores f with provided name in directory parent resolving conflicts according to policy
+func storeFile(ctx context.Context, tx pgx.Tx, name string, parent uuid.UUID, key []byte, f *models.File, policy models.ConflictPolicy) error {
+	f.ParentId = parent
+	f.Name = name
+
+	existing, err := getEntry(tx, name, key, parent)
+	if err == FileNotFound {
+		return newFile(ctx, tx, f, key)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch policy {
+	case models.ConflictOverwrite:
+		return replaceContent(ctx, tx, existing, f, key, key)
+	case models.ConflictRename:
+		for n := 1; n <= maxRenames; n++ {
+			f.Name = numberedName(name, n)
+			if _, err = getEntry(tx, f.Name, key, parent); err == FileNotFound {
+				return newFile(ctx, tx, f, key)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return FileExists
+}
+
+// Returns name with number n placed before extension ("name (n).ext")
+func numberedName(name string, n int) string {
+	ext := path.Ext(name)
+	if ext == name {
+		ext = ""
+	}
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), n, ext)
+}
+
 // List directory with specified id
-func listDirectory(pool *pgxpool.Pool, id uuid.UUID) ([]models.File, error) {
+// (names are decrypted with key)
+func listDirectory(q querier, id uuid.UUID, key []byte) ([]models.File, error) {
 	files := []models.File{}
-	sqlFormula := "SELECT id, encrypted_name, hash, parent_id,duplicate, is_directory FROM file_tree WHERE parent_id = $1 ;"
-	rows, err := pool.Query(context.Background(), sqlFormula, id)
+	sqlFormula := "SELECT " + fileColumns + " FROM file_tree WHERE parent_id = $1 ;"
+	rows, err := q.Query(context.Background(), sqlFormula, id)
 
 	if err != nil {
 		rows.Close()
@@ -168,7 +382,8 @@ func listDirectory(pool *pgxpool.Pool, id uuid.UUID) ([]models.File, error) {
 
 	for rows.Next() {
 		f := models.File{}
-		if err := rows.Scan(&f.Id, &f.Name, &f.Hash, &f.ParentId, &f.Duplicate, &f.IsDirectory); err != nil {
+		if err := scanFile(rows, &f, key); err != nil {
+			rows.Close()
 			return nil, err
 		}
 		files = append(files, f)
@@ -181,3 +396,122 @@ func listDirectory(pool *pgxpool.Pool, id uuid.UUID) ([]models.File, error) {
 
 	return files, nil
 }
+
+// Columns of file_tree read by scanFile
+// (metadata of files created by older versions is unknown)
+const fileColumns = "id, encrypted_name, hash, parent_id, duplicate, is_directory, wrapped_key, own_key, " +
+	"COALESCE(size, 0), COALESCE(content_type, ''), COALESCE(checksum, ''), created_at, modified_at, version"
+
+// Scans row selected with fileColumns into file and decrypts its name with key
+// (data key of shared file is re-wrapped with key, so keys of the file are wrapped with key of its directory)
+// Name is left empty if key is nil
+// Columns selected after fileColumns are scanned into extra
+func scanFile(row pgx.Row, f *models.File, key []byte, extra ...interface{}) error {
+	var encryptedName string
+	dest := []interface{}{&f.Id, &encryptedName, &f.Hash, &f.ParentId, &f.Duplicate, &f.IsDirectory, &f.WrappedKey, &f.OwnKey,
+		&f.Size, &f.ContentType, &f.Checksum, &f.CreatedAt, &f.ModifiedAt, &f.Version}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return err
+	}
+	if key == nil {
+		return nil
+	}
+	name, err := crypt.DecryptName(key, encryptedName)
+	if err != nil {
+		return err
+	}
+	f.Name = name
+	return wrapWithDirectory(f, key)
+}
+
+/*
+	Encrypts names of files under provided root which were stored in plaintext by older versions
+	Returns number of encrypted names
+*/
+func encryptNames(ctx context.Context, tx pgx.Tx, key []byte, root uuid.UUID) (int, error) {
+	sqlQuery := `
+	WITH RECURSIVE tree (id) AS (
+		SELECT id FROM file_tree WHERE parent_id = $1
+		UNION ALL
+		SELECT f.id FROM file_tree f JOIN tree t ON f.parent_id = t.id
+	)
+	SELECT f.id, f.encrypted_name FROM file_tree f JOIN tree t ON f.id = t.id WHERE f.name_encrypted IS NOT TRUE;
+	`
+	rows, err := tx.Query(ctx, sqlQuery, root)
+	if err != nil {
+		return 0, err
+	}
+
+	type plainName struct {
+		id   uuid.UUID
+		name string
+	}
+	names := []plainName{}
+	for rows.Next() {
+		var n plainName
+		if err := rows.Scan(&n.id, &n.name); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		names = append(names, n)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, n := range names {
+		encryptedName, err := crypt.EncryptName(key, n.name)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(ctx, "UPDATE file_tree SET encrypted_name = $2, name_encrypted = TRUE WHERE id = $1;", n.id, encryptedName)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(names), nil
+}
+
+// Adds search tokens to names under provided root created by older versions
+func indexNames(ctx context.Context, tx pgx.Tx, key []byte, root uuid.UUID) error {
+	sqlQuery := `
+	WITH RECURSIVE tree (id) AS (
+		SELECT id FROM file_tree WHERE parent_id = $1
+		UNION ALL
+		SELECT f.id FROM file_tree f JOIN tree t ON f.parent_id = t.id
+	)
+	SELECT f.id, f.encrypted_name FROM file_tree f JOIN tree t ON f.id = t.id WHERE f.name_tokens IS NULL;
+	`
+	rows, err := tx.Query(ctx, sqlQuery, root)
+	if err != nil {
+		return err
+	}
+
+	tokens := map[uuid.UUID][]string{}
+	for rows.Next() {
+		var id uuid.UUID
+		var encryptedName string
+		if err := rows.Scan(&id, &encryptedName); err != nil {
+			rows.Close()
+			return err
+		}
+		name, err := crypt.DecryptName(key, encryptedName)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		tokens[id] = crypt.NameTokens(key, name)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for id, t := range tokens {
+		if _, err = tx.Exec(ctx, "UPDATE file_tree SET name_tokens = $2 WHERE id = $1;", id, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
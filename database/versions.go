@@ -0,0 +1,263 @@
+/*
+	Version history of files
+
+	When content of a file is replaced, the previous content (its blob, wrapped data key and metadata)
+	is kept in file_versions linked to id of the file.
+	Blob is removed when no file and no version references it anymore.
+*/
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/cockroach-go/v2/crdb/crdbpgx"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/noisersup/encryptedfs-api/models"
+)
+
+// Columns of file_versions read by scanVersion
+const versionColumns = "version, hash, duplicate, wrapped_key, size, COALESCE(content_type, ''), COALESCE(checksum, ''), modified_at"
+
+/*
+	Lists versions of file on provided path (current one first, then older ones from the newest)
+	Versions are copies of the file with content fields (Version, Hash, Duplicate, WrappedKey,
+	Size, ContentType, Checksum and ModifiedAt) taken from the version
+*/
+func (db *Database) ListVersions(pathNames []string, key []byte, userRoot uuid.UUID) ([]models.File, error) {
+	f, s, err := lookupFile(db.pool, pathNames, key, userRoot)
+	if err != nil {
+		return nil, err
+	}
+	ownKey, err := contentKey(f, s.key)
+	if err != nil {
+		return nil, err
+	}
+	if err = exposeFile(f, s.key, key); err != nil {
+		return nil, err
+	}
+
+	sqlQuery := "SELECT " + versionColumns + " FROM file_versions WHERE file_id = $1 ORDER BY version DESC;"
+	rows, err := db.pool.Query(context.Background(), sqlQuery, f.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []models.File{*f}
+	for rows.Next() {
+		v := *f
+		if err := scanVersion(rows, &v, ownKey, key); err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// Gets provided version of file on provided path (see ListVersions)
+// Returns FileNotFound if the version doesn't exist
+func (db *Database) GetVersion(pathNames []string, key []byte, userRoot uuid.UUID, version int64) (*models.File, error) {
+	f, s, err := lookupFile(db.pool, pathNames, key, userRoot)
+	if err != nil {
+		return nil, err
+	}
+	ownKey, err := contentKey(f, s.key)
+	if err != nil {
+		return nil, err
+	}
+	if err = exposeFile(f, s.key, key); err != nil {
+		return nil, err
+	}
+	return getVersion(db.pool, f, version, ownKey, key)
+}
+
+/*
+	Makes content of provided version current content of file on provided path
+	Current content is kept as a version and the file gets a new version number
+	Returns the file with promoted content
+*/
+func (db *Database) PromoteVersion(pathNames []string, key []byte, userRoot uuid.UUID, version int64) (*models.File, error) {
+	var promoted *models.File
+	var dirKey []byte
+	err := crdbpgx.ExecuteTx(context.Background(), db.pool, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		f, s, err := lookupFile(tx, pathNames, key, userRoot)
+		if err != nil {
+			return err
+		}
+		dirKey = s.key
+		ownKey, err := contentKey(f, s.key)
+		if err != nil {
+			return err
+		}
+		if promoted, err = getVersion(tx, f, version, ownKey, s.key); err != nil {
+			return err
+		}
+		if promoted.Version == f.Version {
+			return nil
+		}
+		return replaceContent(context.Background(), tx, f, promoted, s.key, s.key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = exposeFile(promoted, dirKey, key); err != nil {
+		return nil, err
+	}
+	return promoted, nil
+}
+
+// Removes old versions of all files according to retention rules
+// Returns number of removed versions
+func (db *Database) PruneVersions(retention models.VersionRetention) (int, error) {
+	var n int
+	var blobs []string
+	err := crdbpgx.ExecuteTx(context.Background(), db.pool, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		ctx := context.Background()
+		removed := []models.File{}
+		if retention.MaxAge > 0 {
+			sqlFormula := "DELETE FROM file_versions WHERE archived_at < $1 RETURNING hash, duplicate;"
+			old, err := queryBlobRefs(ctx, tx, sqlFormula, time.Now().Add(-retention.MaxAge))
+			if err != nil {
+				return err
+			}
+			removed = append(removed, old...)
+		}
+		if retention.Keep > 0 {
+			sqlFormula := `
+			DELETE FROM file_versions WHERE id IN (
+				SELECT id FROM (
+					SELECT id, row_number() OVER (PARTITION BY file_id ORDER BY version DESC) AS n FROM file_versions
+				) AS v WHERE n > $1
+			)
+			RETURNING hash, duplicate;
+			`
+			excess, err := queryBlobRefs(ctx, tx, sqlFormula, retention.Keep)
+			if err != nil {
+				return err
+			}
+			removed = append(removed, excess...)
+		}
+
+		var err error
+		n = len(removed)
+		blobs, err = unusedBlobs(ctx, tx, removed)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	db.removeBlobs(blobs)
+	return n, nil
+}
+
+// Returns copy of f with content of provided version
+// (data keys of versions are wrapped with ownKey, data key of the copy is wrapped with key like keys of f)
+func getVersion(q querier, f *models.File, version int64, ownKey, key []byte) (*models.File, error) {
+	v := *f
+	if version == f.Version {
+		return &v, nil
+	}
+
+	sqlQuery := "SELECT " + versionColumns + " FROM file_versions WHERE file_id = $1 AND version = $2;"
+	rows, err := q.Query(context.Background(), sqlQuery, f.Id, version)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, FileNotFound
+	}
+	if err = scanVersion(rows, &v, ownKey, key); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Scans row selected with versionColumns into f
+// and re-wraps data key of the version wrapped with ownKey with key
+func scanVersion(row pgx.Row, f *models.File, ownKey, key []byte) error {
+	err := row.Scan(&f.Version, &f.Hash, &f.Duplicate, &f.WrappedKey, &f.Size, &f.ContentType, &f.Checksum, &f.ModifiedAt)
+	if err != nil {
+		return err
+	}
+	f.WrappedKey, err = rewrapKey(f.WrappedKey, ownKey, key)
+	return err
+}
+
+// Keeps current content of file with provided id as its version
+func archiveVersion(ctx context.Context, tx pgx.Tx, id uuid.UUID) error {
+	sqlFormula := `
+	INSERT INTO file_versions (file_id, version, hash, duplicate, wrapped_key, size, content_type, checksum, modified_at)
+	SELECT id, version, hash, duplicate, wrapped_key, COALESCE(size, 0), content_type, checksum, modified_at
+	FROM file_tree WHERE id = $1;
+	`
+	tag, err := tx.Exec(ctx, sqlFormula, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("archiveVersion: file %s not found", id)
+	}
+	return nil
+}
+
+// Returns references to blobs (Hash and Duplicate) selected by query
+// (entries without blob are skipped)
+func queryBlobRefs(ctx context.Context, tx pgx.Tx, sqlQuery string, args ...interface{}) ([]models.File, error) {
+	rows, err := tx.Query(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refs := []models.File{}
+	for rows.Next() {
+		var hash *string
+		var duplicate *int
+		if err := rows.Scan(&hash, &duplicate); err != nil {
+			return nil, err
+		}
+		if hash == nil {
+			continue
+		}
+		f := models.File{Hash: *hash}
+		if duplicate != nil {
+			f.Duplicate = *duplicate
+		}
+		refs = append(refs, f)
+	}
+	return refs, rows.Err()
+}
+
+// Returns names of blobs of provided files which aren't used by any file or version anymore
+func unusedBlobs(ctx context.Context, tx pgx.Tx, files []models.File) ([]string, error) {
+	sqlQuery := `
+	SELECT EXISTS (SELECT 1 FROM file_tree WHERE hash = $1 AND duplicate = $2 AND NOT is_directory)
+		OR EXISTS (SELECT 1 FROM file_versions WHERE hash = $1 AND duplicate = $2);
+	`
+	unused := []string{}
+	seen := map[string]bool{}
+	for _, f := range files {
+		name := f.BlobName()
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		var used bool
+		if err := tx.QueryRow(ctx, sqlQuery, f.Hash, f.Duplicate).Scan(&used); err != nil {
+			return nil, err
+		}
+		if !used {
+			unused = append(unused, name)
+		}
+	}
+	return unused, nil
+}
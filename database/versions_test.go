@@ -0,0 +1,89 @@
+package database
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/noisersup/encryptedfs-api/crypt"
+	"github.com/noisersup/encryptedfs-api/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// Replaces content of file on path with a new blob and returns the new content
+func replaceTestFile(t *testing.T, db *Database, path []string, key []byte, root uuid.UUID) *models.File {
+	dataKey, err := crypt.NewKey()
+	assert.NoError(t, err)
+	wrappedKey, err := crypt.WrapKey(key, dataKey)
+	assert.NoError(t, err)
+	f := models.File{Hash: strings.ReplaceAll(uuid.New().String(), "-", ""), WrappedKey: wrappedKey, Size: 7}
+	assert.NoError(t, db.ReplaceFile(path, key, &f, root, ""))
+	return &f
+}
+
+func Test_PruneVersionsRemovesUnusedBlobs(t *testing.T) {
+	db, blobs := testDB(t)
+	root, key := testUser(t, db)
+
+	first, _ := testFile(t, db, blobs, []string{"a.txt"}, key, root)
+	// copy shares blob of the first version
+	assert.NoError(t, db.CopyFile([]string{"a.txt"}, []string{"b.txt"}, key, root))
+	second := replaceTestFile(t, db, []string{"a.txt"}, key, root)
+	assert.NoError(t, blobs.Put(second.BlobName(), strings.NewReader("second")))
+	third := replaceTestFile(t, db, []string{"a.txt"}, key, root)
+
+	versions, err := db.ListVersions([]string{"a.txt"}, key, root)
+	assert.NoError(t, err)
+	if assert.Len(t, versions, 3) {
+		assert.Equal(t, third.Hash, versions[0].Hash)
+		assert.Equal(t, second.Hash, versions[1].Hash)
+		assert.Equal(t, first.Hash, versions[2].Hash)
+	}
+
+	// the first version is over the limit, but its blob is used by the copy
+	_, err = db.PruneVersions(models.VersionRetention{Keep: 1})
+	assert.NoError(t, err)
+	_, err = db.GetVersion([]string{"a.txt"}, key, root, first.Version)
+	assert.Equal(t, FileNotFound, err)
+	assertBlob(t, blobs, first.BlobName(), true)
+	assertBlob(t, blobs, second.BlobName(), true)
+
+	// expired version is removed with its blob
+	_, err = db.pool.Exec(context.Background(), "UPDATE file_versions SET archived_at = now() - INTERVAL '2 days' WHERE hash = $1;", second.Hash)
+	assert.NoError(t, err)
+	_, err = db.PruneVersions(models.VersionRetention{MaxAge: 24 * time.Hour})
+	assert.NoError(t, err)
+	assertBlob(t, blobs, second.BlobName(), false)
+	versions, err = db.ListVersions([]string{"a.txt"}, key, root)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 1)
+
+	// blob of the first version goes with the copy
+	assert.NoError(t, db.DeleteFile([]string{"b.txt"}, key, root))
+	assertBlob(t, blobs, first.BlobName(), false)
+}
+
+func Test_PromoteVersion(t *testing.T) {
+	db, blobs := testDB(t)
+	root, key := testUser(t, db)
+
+	first, dataKey := testFile(t, db, blobs, []string{"a.txt"}, key, root)
+	replaceTestFile(t, db, []string{"a.txt"}, key, root)
+
+	promoted, err := db.PromoteVersion([]string{"a.txt"}, key, root, first.Version)
+	assert.NoError(t, err)
+	assert.Equal(t, first.Hash, promoted.Hash)
+	f, err := db.GetFile([]string{"a.txt"}, key, root)
+	assert.NoError(t, err)
+	assert.Equal(t, first.Hash, f.Hash)
+	unwrapped, err := crypt.UnwrapKey(key, f.WrappedKey)
+	assert.NoError(t, err)
+	assert.Equal(t, dataKey, unwrapped)
+
+	// promoted content is a new version, the replaced one is kept
+	versions, err := db.ListVersions([]string{"a.txt"}, key, root)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 3)
+}
@@ -0,0 +1,36 @@
+/*
+	Master keys protecting user keys at rest
+*/
+package kms
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var ErrUnknownVersion error = errors.New("unknown master key version")
+var ErrCiphertext error = errors.New("invalid ciphertext")
+
+// KeyManager encrypts data with versioned master keys.
+// Master keys never leave the manager, so it can be backed by external KMS providers
+type KeyManager interface {
+	// Encrypts plaintext with current master key
+	// Returned ciphertext carries version of the master key
+	Encrypt(plaintext []byte) ([]byte, error)
+	// Decrypts ciphertext with master key version it was encrypted with
+	Decrypt(ciphertext []byte) ([]byte, error)
+	// Returns version of master key used by Encrypt
+	CurrentVersion() uint32
+	// Creates new master key version and makes it current
+	// Older versions stay available for decryption
+	Rotate() (uint32, error)
+}
+
+// Returns version of master key with which ciphertext was encrypted
+// Ciphertexts of all managers start with big endian uint32 version
+func Version(ciphertext []byte) (uint32, error) {
+	if len(ciphertext) < 4 {
+		return 0, ErrCiphertext
+	}
+	return binary.BigEndian.Uint32(ciphertext), nil
+}
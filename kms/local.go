@@ -0,0 +1,176 @@
+package kms
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/noisersup/encryptedfs-api/crypt"
+	l "github.com/noisersup/encryptedfs-api/logger"
+)
+
+// LocalKeyManager keeps master keyring in a local file
+type LocalKeyManager struct {
+	mu      sync.RWMutex
+	path    string
+	keyring keyring
+}
+
+// Keyring as stored in file
+type keyring struct {
+	Current uint32            `json:"current"`
+	Keys    map[string][]byte `json:"keys"` // master keys by version
+}
+
+// Loads keyring from provided file.
+// If file doesn't exist creates a new keyring with a single master key
+func NewLocalKeyManager(path string) (*LocalKeyManager, error) {
+	m := LocalKeyManager{path: path}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		l.Log("Keyring %s not found, creating one...", path)
+		m.keyring = keyring{Keys: map[string][]byte{}}
+		if _, err = m.Rotate(); err != nil {
+			return nil, err
+		}
+		return &m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(data, &m.keyring); err != nil {
+		return nil, err
+	}
+	if _, ok := m.keyring.Keys[versionKey(m.keyring.Current)]; !ok {
+		return nil, ErrUnknownVersion
+	}
+	return &m, nil
+}
+
+func (m *LocalKeyManager) Encrypt(plaintext []byte) ([]byte, error) {
+	m.mu.RLock()
+	version := m.keyring.Current
+	key := m.keyring.Keys[versionKey(version)]
+	m.mu.RUnlock()
+
+	wrapped, err := crypt.WrapKey(key, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext := make([]byte, 4, 4+len(wrapped))
+	binary.BigEndian.PutUint32(ciphertext, version)
+	return append(ciphertext, wrapped...), nil
+}
+
+func (m *LocalKeyManager) Decrypt(ciphertext []byte) ([]byte, error) {
+	version, err := Version(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := m.key(version)
+	if !ok {
+		// keyring could be rotated by another process (-rotate-keys) after it was loaded
+		if err = m.reload(); err != nil {
+			return nil, err
+		}
+		if key, ok = m.key(version); !ok {
+			return nil, ErrUnknownVersion
+		}
+	}
+
+	return crypt.UnwrapKey(key, ciphertext[4:])
+}
+
+// Returns master key of provided version
+func (m *LocalKeyManager) key(version uint32) ([]byte, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	key, ok := m.keyring.Keys[versionKey(version)]
+	return key, ok
+}
+
+// Loads keyring from file again
+// Keyring in memory is replaced only if the file holds the same or newer version
+func (m *LocalKeyManager) reload() error {
+	data, err := os.ReadFile(m.path)
+	if err != nil {
+		return err
+	}
+	var kr keyring
+	if err = json.Unmarshal(data, &kr); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if kr.Current >= m.keyring.Current {
+		m.keyring = kr
+	}
+	return nil
+}
+
+func (m *LocalKeyManager) CurrentVersion() uint32 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.keyring.Current
+}
+
+// Adds new master key to keyring and saves it to file
+func (m *LocalKeyManager) Rotate() (uint32, error) {
+	key, err := crypt.NewKey()
+	if err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	kr := keyring{Current: m.keyring.Current + 1, Keys: map[string][]byte{}}
+	for v, k := range m.keyring.Keys {
+		kr.Keys[v] = k
+	}
+	kr.Keys[versionKey(kr.Current)] = key
+
+	if err = saveKeyring(m.path, &kr); err != nil {
+		return 0, err
+	}
+	m.keyring = kr
+	l.Log("Master key rotated to version %d", kr.Current)
+	return kr.Current, nil
+}
+
+// Writes keyring to temporary file first so the keyring is never left half written
+func saveKeyring(path string, kr *keyring) error {
+	data, err := json.MarshalIndent(kr, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".keyring-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func versionKey(version uint32) string {
+	return strconv.FormatUint(uint64(version), 10)
+}
@@ -0,0 +1,69 @@
+package kms
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/noisersup/encryptedfs-api/crypt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalKeyManager(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	m, err := NewLocalKeyManager(path)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1), m.CurrentVersion())
+
+	secret := []byte("user key")
+	c1, err := m.Encrypt(secret)
+	assert.NoError(t, err)
+	v, err := Version(c1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1), v)
+
+	v, err = m.Rotate()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), v)
+
+	c2, err := m.Encrypt(secret)
+	assert.NoError(t, err)
+	v, _ = Version(c2)
+	assert.Equal(t, uint32(2), v)
+
+	// keyring is persisted with all versions
+	m, err = NewLocalKeyManager(path)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), m.CurrentVersion())
+	for _, c := range [][]byte{c1, c2} {
+		plain, err := m.Decrypt(c)
+		assert.NoError(t, err)
+		assert.Equal(t, secret, plain)
+	}
+
+	c2[len(c2)-1] ^= 1
+	_, err = m.Decrypt(c2)
+	assert.Equal(t, crypt.ErrUnwrap, err)
+
+	c1[3] = 9
+	_, err = m.Decrypt(c1)
+	assert.Equal(t, ErrUnknownVersion, err)
+}
+
+func TestLocalKeyManagerReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	running, err := NewLocalKeyManager(path)
+	assert.NoError(t, err)
+
+	// keyring rotated by another process
+	rotating, err := NewLocalKeyManager(path)
+	assert.NoError(t, err)
+	_, err = rotating.Rotate()
+	assert.NoError(t, err)
+	c, err := rotating.Encrypt([]byte("user key"))
+	assert.NoError(t, err)
+
+	plain, err := running.Decrypt(c)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("user key"), plain)
+	assert.Equal(t, uint32(2), running.CurrentVersion())
+}
@@ -1,17 +1,26 @@
 package main
 
 import (
+	"encoding/base64"
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
+	"time"
 
+	"github.com/noisersup/encryptedfs-api/crypt"
 	"github.com/noisersup/encryptedfs-api/database"
+	"github.com/noisersup/encryptedfs-api/kms"
 	l "github.com/noisersup/encryptedfs-api/logger"
+	"github.com/noisersup/encryptedfs-api/models"
 	"github.com/noisersup/encryptedfs-api/server"
+	"github.com/noisersup/encryptedfs-api/storage"
 )
 
 func main() {
 	v := flag.Bool("v", false, "verbose output")
+	rotate := flag.Bool("rotate-keys", false, "rotate master key, re-encrypt keys of all users with it and exit")
+	rewrap := flag.Bool("rewrap-keys", false, "re-encrypt keys of users not using current master key and exit (resumes interrupted -rotate-keys)")
 	flag.Parse()
 
 	dbName := getEnv("DB_NAME", "filestorage")
@@ -27,15 +36,115 @@ func main() {
 
 	l.LogV("Connecting to database %s with payload: %s", dbName, dbPayload)
 
-	db, err := database.ConnectDB(dbPayload, dbName, "ef4ebb18-b915-49fe-ba90-443aba9762d2")
+	blobs, err := newBlobStore(getEnv("STORAGE_BACKEND", "local"))
+	if err != nil {
+		l.Fatal(err.Error())
+	}
+
+	keys, err := newKeyManager(getEnv("KMS_PROVIDER", "local"))
+	if err != nil {
+		l.Fatal(err.Error())
+	}
+
+	db, err := database.ConnectDB(dbPayload, dbName, "ef4ebb18-b915-49fe-ba90-443aba9762d2", blobs, keys)
 	if err != nil {
 		l.Fatal(err.Error())
 	}
 	defer db.Close()
 
-	if err = server.InitServer(db, cacheHost); err != nil {
+	// running servers load rotated keyring when they find a key wrapped with the new version
+	if *rotate || *rewrap {
+		if *rotate {
+			if _, err = keys.Rotate(); err != nil {
+				l.Fatal(err.Error())
+			}
+		}
+		// every key is rewrapped in its own transaction and older master keys stay available,
+		// so after a failure keys can be rewrapped again with -rewrap-keys
+		n, err := db.RewrapKeys()
+		if err != nil {
+			l.Fatal("%s (%d keys rewrapped, run again with -rewrap-keys)", err.Error(), n)
+		}
+		l.Log("Keys of %d users rewrapped with master key version %d", n, keys.CurrentVersion())
+		return
+	}
+
+	sessionSecret, err := getSessionSecret()
+	if err != nil {
 		l.Fatal(err.Error())
 	}
+
+	trashRetention, err := time.ParseDuration(getEnv("TRASH_RETENTION", "720h"))
+	if err != nil {
+		l.Fatal("invalid TRASH_RETENTION: %s", err.Error())
+	}
+
+	versions, err := getVersionRetention()
+	if err != nil {
+		l.Fatal(err.Error())
+	}
+
+	if err = server.InitServer(db, blobs, cacheHost, sessionSecret, trashRetention, versions); err != nil {
+		l.Fatal(err.Error())
+	}
+}
+
+// Creates storage of encrypted files
+// configured with environment variables
+func newBlobStore(backend string) (storage.BlobStore, error) {
+	switch backend {
+	case "local":
+		filesPath := getEnv("FILES_PATH", "./files")
+		l.LogV("Storing files in %s", filesPath)
+		return storage.NewLocalStore(filesPath)
+	case "s3":
+		cfg := storage.S3Config{
+			Endpoint:  getEnv("S3_ENDPOINT", "https://s3.amazonaws.com"),
+			Region:    getEnv("S3_REGION", "us-east-1"),
+			Bucket:    getEnv("S3_BUCKET", "filestorage"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+		}
+		l.LogV("Storing files in bucket %s on %s", cfg.Bucket, cfg.Endpoint)
+		return storage.NewS3Store(cfg)
+	}
+	return nil, fmt.Errorf("unknown storage backend: %s", backend)
+}
+
+// Creates manager of master keys
+// configured with environment variables
+func newKeyManager(provider string) (kms.KeyManager, error) {
+	switch provider {
+	case "local":
+		return kms.NewLocalKeyManager(getEnv("MASTER_KEYRING", "./keyring.json"))
+	}
+	return nil, fmt.Errorf("unknown KMS provider: %s", provider)
+}
+
+// Reads base64 encoded secret protecting user keys in sessions
+// If not provided generates random one (sessions won't survive restart of the server)
+func getSessionSecret() ([]byte, error) {
+	env := os.Getenv("SESSION_SECRET")
+	if env == "" {
+		l.Warn("SESSION_SECRET not set, generating random one")
+		return crypt.NewKey()
+	}
+	return base64.StdEncoding.DecodeString(env)
+}
+
+// Reads rules of removing old versions of files
+// VERSIONS_KEEP - number of kept old versions of a file, VERSIONS_MAX_AGE - how long they are kept
+// (0 disables the rule)
+func getVersionRetention() (models.VersionRetention, error) {
+	keep, err := strconv.Atoi(getEnv("VERSIONS_KEEP", "10"))
+	if err != nil {
+		return models.VersionRetention{}, fmt.Errorf("invalid VERSIONS_KEEP: %s", err.Error())
+	}
+	maxAge, err := time.ParseDuration(getEnv("VERSIONS_MAX_AGE", "0"))
+	if err != nil {
+		return models.VersionRetention{}, fmt.Errorf("invalid VERSIONS_MAX_AGE: %s", err.Error())
+	}
+	return models.VersionRetention{Keep: keep, MaxAge: maxAge}, nil
 }
 
 func getEnv(envName, defValue string) string {
@@ -1,6 +1,12 @@
 package models
 
-import "github.com/google/uuid"
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
 
 type File struct {
 	Id          uuid.UUID
@@ -9,16 +15,228 @@ type File struct {
 	ParentId    uuid.UUID
 	Duplicate   int
 	IsDirectory bool
+	WrappedKey  []byte // data key of the file wrapped with owner's key (nil for directories)
+	OwnKey      []byte // own key of shared file or directory wrapped with owner's key (nil if it has none)
+	Size        int64  // size of plaintext content
+	ContentType string
+	Checksum    string // hex encoded SHA-256 of plaintext content
+	CreatedAt   time.Time
+	ModifiedAt  time.Time
+	Version     int64 // incremented every time content of the file is replaced
+}
+
+// Returns strong entity tag of content of the file
+// (checksum of content and version, files from older versions use name of their blob)
+func (f *File) ETag() string {
+	if f.Checksum == "" {
+		return fmt.Sprintf(`"%s-%d"`, f.BlobName(), f.Version)
+	}
+	return fmt.Sprintf(`"%s-%d"`, f.Checksum, f.Version)
+}
+
+// Checks if entity tag of the file matches value of If-Match header
+// (comma separated list of tags or "*")
+func (f *File) MatchesETag(header string) bool {
+	etag := f.ETag()
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns name of the blob that holds encrypted content of the file
+func (f *File) BlobName() string {
+	if f.Duplicate == 0 {
+		return f.Hash
+	}
+	return fmt.Sprintf("%s%d", f.Hash, f.Duplicate)
+}
+
+// Unfinished resumable upload
+type Upload struct {
+	Id         uuid.UUID
+	Owner      string // username of user who started the upload
+	Path       []byte // target path of the file encrypted with owner's key
+	Size       int64  // size of the whole file
+	Received   int64  // number of bytes already stored
+	Parts      int    // number of stored parts of encrypted blob
+	Header     []byte // header of encrypted blob
+	WrappedKey []byte // data key of the file wrapped with owner's key
+	HashState  []byte // state of SHA-256 of received data encrypted with data key
+	CreatedAt  time.Time
+}
+
+// Key of a user as stored in the database
+type UserKey struct {
+	Wrapped []byte // user's key encrypted with key derived from user's password
+	Salt    []byte // salt of password based key derivation (nil if key was stored in plaintext by older versions)
+}
+
+// Options of directory listing
+type ListOptions struct {
+	Limit  int    // maximal number of returned files
+	Cursor string // position after which listing starts (returned with previous page)
+	SortBy string // name (default, costs decrypting names of the whole directory per page), size or modified
+	Desc   bool   // sort in descending order
+	Type   string // list only files of type: file or directory (all if empty)
+}
+
+// Page of directory listing
+type DirectoryPage struct {
+	Files      []File
+	NextCursor string // empty if it's the last page
+}
+
+// Query of file name search
+type SearchQuery struct {
+	Pattern string // searched text or glob pattern
+	Mode    string // substring, prefix or glob
+	Limit   int    // maximal number of results
+}
+
+// File found by search with its path relative to searched directory
+type SearchResult struct {
+	Path []string
+	File File
 }
 
+// File moved to trash (detached from the tree with its whole subtree)
+type TrashItem struct {
+	File
+	Path      []string // original path of the file
+	DeletedAt time.Time
+}
+
+// Rules of removing old versions of files (zero value of a rule disables it)
+type VersionRetention struct {
+	Keep   int           // number of kept old versions of a file
+	MaxAge time.Duration // how long old versions are kept after being replaced
+}
+
+// Link giving access to a file or directory without an account
+type ShareLink struct {
+	Id           uuid.UUID
+	TokenHash    string // hex encoded SHA-256 of token of the link
+	FileId       uuid.UUID
+	Owner        uuid.UUID // root of owner of the file
+	WrappedKey   []byte    // own key of the file wrapped with key derived from the token (and password)
+	HasPassword  bool
+	ExpiresAt    *time.Time // nil if the link doesn't expire
+	MaxDownloads int        // 0 if number of downloads isn't limited
+	Downloads    int
+	CreatedAt    time.Time
+}
+
+// Key pair of a user with which keys are shared with them
+type KeyPair struct {
+	Public         []byte // X25519 public key
+	WrappedPrivate []byte // private key wrapped with user's key
+}
+
+// Access of a user to file shared with them
+type Permission string
+
+const (
+	PermissionRead  Permission = "read"
+	PermissionWrite Permission = "write"
+)
+
+// File or directory shared with another user
+type Share struct {
+	Id         uuid.UUID
+	FileId     uuid.UUID
+	Owner      uuid.UUID // root of owner of the file
+	OwnerName  string    // username of owner of the file
+	Recipient  string    // username of user with whom the file is shared
+	Permission Permission
+	WrappedKey []byte // own key of the file sealed with public key of the recipient
+	CreatedAt  time.Time
+}
+
+// Role of a member of a group
+type GroupRole string
+
+const (
+	RoleOwner  GroupRole = "owner"  // manages members and files of the group
+	RoleEditor GroupRole = "editor" // modifies files of the group
+	RoleViewer GroupRole = "viewer" // only reads files of the group
+)
+
+// Membership of a user in a group with its own drive
+type GroupMember struct {
+	GroupId    uuid.UUID // id of the group (and root of its drive)
+	GroupName  string
+	Username   string
+	Role       GroupRole
+	WrappedKey []byte // key of the group sealed with public key of the member
+	AddedAt    time.Time
+}
+
+// Way of resolving conflict with existing file when a file is stored
+type ConflictPolicy string
+
+const (
+	ConflictFail      ConflictPolicy = "fail"
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	ConflictRename    ConflictPolicy = "rename"
+)
+
 type Database interface {
 	Close()
-	NewFile(pathNames []string, key []byte, duplicate int, isDirectory bool, userRoot uuid.UUID) error
-	GetFile(pathNames []string, userRoot uuid.UUID) (*File, error)
-	ListDirectory(id ...uuid.UUID) ([]File, error)
-	DeleteFile(pathNames []string, userRoot uuid.UUID) error
-	NewUser(username, hashedPassword string) error
+	NewFile(pathNames []string, key []byte, file *File, userRoot uuid.UUID) error
+	GetFile(pathNames []string, key []byte, userRoot uuid.UUID) (*File, error)
+	ListDirectory(id uuid.UUID, key []byte) ([]File, error)
+	ListDirectoryPage(id uuid.UUID, key []byte, opts ListOptions) (*DirectoryPage, error)
+	ListTree(id uuid.UUID, key []byte, maxDepth int, fn func(path []string, f *File) error) error
+	SearchFiles(dir uuid.UUID, key []byte, query SearchQuery) ([]SearchResult, error)
+	MoveFile(src, dst []string, key []byte, userRoot uuid.UUID) error
+	CopyFile(src, dst []string, key []byte, userRoot uuid.UUID) error
+	StoreFile(pathNames []string, key []byte, file *File, userRoot uuid.UUID, policy ConflictPolicy) error
+	ReplaceFile(pathNames []string, key []byte, file *File, userRoot uuid.UUID, ifMatch string) error
+	DeleteFile(pathNames []string, key []byte, userRoot uuid.UUID) error
+	ListVersions(pathNames []string, key []byte, userRoot uuid.UUID) ([]File, error)
+	GetVersion(pathNames []string, key []byte, userRoot uuid.UUID, version int64) (*File, error)
+	PromoteVersion(pathNames []string, key []byte, userRoot uuid.UUID, version int64) (*File, error)
+	PruneVersions(retention VersionRetention) (int, error)
+	NewShareLink(link *ShareLink) error
+	GetShareLink(tokenHash string) (*ShareLink, error)
+	ListShareLinks(owner uuid.UUID) ([]ShareLink, error)
+	DeleteShareLink(id uuid.UUID, owner uuid.UUID) error
+	CountDownload(id uuid.UUID) error
+	GetFileById(id uuid.UUID, key []byte, userRoot uuid.UUID) (*File, []string, error)
+	ShareKey(pathNames []string, key []byte, userRoot uuid.UUID) (*File, []byte, error)
+	GetSharedFile(id uuid.UUID, key []byte, owner uuid.UUID) (*File, error)
+	ShareFile(share *Share) error
+	GetShare(id uuid.UUID) (*Share, error)
+	ListSharesByOwner(owner uuid.UUID) ([]Share, error)
+	ListSharesWithUser(recipient string) ([]Share, error)
+	DeleteShare(id uuid.UUID, username string) error
+	NewGroup(owner *GroupMember) error
+	GetGroupMember(groupId uuid.UUID, username string) (*GroupMember, error)
+	ListGroups(username string) ([]GroupMember, error)
+	ListGroupMembers(groupId uuid.UUID) ([]GroupMember, error)
+	SetGroupMember(member *GroupMember) error
+	RemoveGroupMember(groupId uuid.UUID, username string, key, newKey []byte, sealedKeys map[string][]byte) error
+	TrashFile(pathNames []string, key []byte, userRoot uuid.UUID) error
+	ListTrash(key []byte, userRoot uuid.UUID) ([]TrashItem, error)
+	RestoreFile(id uuid.UUID, key []byte, userRoot uuid.UUID) ([]string, error)
+	DeleteFromTrash(id uuid.UUID, userRoot uuid.UUID) error
+	EmptyTrash(userRoot uuid.UUID) (int, error)
+	PurgeTrash(deletedBefore time.Time) (int, error)
+	EncryptNames(key []byte, userRoot uuid.UUID) (int, error)
+	NewUser(username, hashedPassword string, key *UserKey) error
 	GetPasswordOfUser(username string) (string, error)
-	GetKey(username string) ([]byte, error)
+	GetKey(username string) (*UserKey, error)
+	SetKey(username string, key *UserKey) error
 	GetRoot(username string) (uuid.UUID, error)
+	GetKeyPair(username string) (*KeyPair, error)
+	SetKeyPair(username string, pair *KeyPair) error
+	NewUpload(u *Upload) error
+	GetUpload(id uuid.UUID, owner string) (*Upload, error)
+	AdvanceUpload(id uuid.UUID, received, newReceived int64, parts int, hashState []byte) error
+	DeleteUpload(id uuid.UUID) error
+	ListStaleUploads(createdBefore time.Time) ([]Upload, error)
 }
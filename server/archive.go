@@ -0,0 +1,196 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/noisersup/encryptedfs-api/database"
+	l "github.com/noisersup/encryptedfs-api/logger"
+	"github.com/noisersup/encryptedfs-api/models"
+)
+
+/*
+	Archive downloads of directories
+
+	Contents of files are decrypted chunk by chunk straight into the archive,
+	so plaintext is never staged on disk nor held whole in memory.
+	Metadata of all entries is gathered before the response is started
+	so missing selected paths can still be reported with 404.
+*/
+
+// File or directory placed into archive
+type archiveEntry struct {
+	path string // path inside of the archive
+	f    models.File
+	key  []byte // key with which keys of the file are wrapped
+}
+
+// archiveWriter writes entries in one of supported formats
+type archiveWriter interface {
+	// returns writer of content of the file (nil for directories)
+	create(e *archiveEntry, size int64) (io.Writer, error)
+	Close() error
+}
+
+// Streams directory with provided id (with names encrypted with key) as archive in format requested with archive query parameter (zip or tar.gz)
+// Only paths (relative to the directory) selected with select query parameters are archived if any are provided
+func (s *Server) serveArchive(w http.ResponseWriter, r *http.Request, dir uuid.UUID, name string, key []byte) {
+	query := r.URL.Query()
+	format := query.Get("archive")
+	if format != "zip" && format != "tar.gz" {
+		resp400(w, "unsupported archive format")
+		return
+	}
+
+	entries, status := s.archiveEntries(dir, query["select"], key)
+	if status != http.StatusOK {
+		errResponse(w, status, http.StatusText(status))
+		return
+	}
+
+	w.Header().Set("Content-Disposition", "attachment; filename="+name+"."+format)
+	var aw archiveWriter
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		aw = &zipArchive{zip.NewWriter(w)}
+	} else {
+		w.Header().Set("Content-Type", "application/gzip")
+		gz := gzip.NewWriter(w)
+		aw = &tarArchive{tar.NewWriter(gz), gz}
+	}
+
+	for i := range entries {
+		if err := s.writeArchiveEntry(aw, &entries[i]); err != nil {
+			// response is already started, client gets truncated archive
+			l.Err("archiving %s: %s", entries[i].path, err.Error())
+			return
+		}
+	}
+	if err := aw.Close(); err != nil {
+		l.Err("archiving: %s", err.Error())
+	}
+}
+
+// Gathers entries of the whole directory or its selected paths
+// Returns entries and http status
+func (s *Server) archiveEntries(dir uuid.UUID, selected []string, key []byte) ([]archiveEntry, int) {
+	entries := []archiveEntry{}
+	addTree := func(id uuid.UUID, prefix string, key []byte) error {
+		return s.db.ListTree(id, key, 0, func(path []string, f *models.File) error {
+			entries = append(entries, archiveEntry{prefix + strings.Join(path, "/"), *f, key})
+			return nil
+		})
+	}
+
+	if len(selected) == 0 {
+		if err := addTree(dir, "", key); err != nil {
+			l.Err("%s", err.Error())
+			return nil, http.StatusInternalServerError
+		}
+		return entries, http.StatusOK
+	}
+
+	for _, sel := range selected {
+		path, ok := cleanPath(sel)
+		if !ok {
+			return nil, http.StatusBadRequest
+		}
+		f, err := s.db.GetFile(path, key, dir)
+		if err != nil {
+			if err == database.FileNotFound {
+				return nil, http.StatusNotFound
+			}
+			l.Err("%s", err.Error())
+			return nil, http.StatusInternalServerError
+		}
+		p := strings.Join(path, "/")
+		entries = append(entries, archiveEntry{p, *f, key})
+		if f.IsDirectory {
+			subKey, err := dirKey(f, key)
+			if err != nil {
+				l.Err("%s", err.Error())
+				return nil, http.StatusInternalServerError
+			}
+			if err = addTree(f.Id, p+"/", subKey); err != nil {
+				l.Err("%s", err.Error())
+				return nil, http.StatusInternalServerError
+			}
+		}
+	}
+	return entries, http.StatusOK
+}
+
+// Decrypts content of entry into archive
+func (s *Server) writeArchiveEntry(aw archiveWriter, e *archiveEntry) error {
+	if e.f.IsDirectory {
+		_, err := aw.create(e, 0)
+		return err
+	}
+
+	dataKey, err := fileKey(&e.f, e.key)
+	if err != nil {
+		return err
+	}
+	blob, err := s.blobs.Get(e.f.BlobName())
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	content, err := decryptReader(blob, dataKey)
+	if err != nil {
+		return err
+	}
+	// size stored in metadata is unknown for files from older versions
+	out, err := aw.create(e, content.Size())
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, content); err != nil {
+		return err
+	}
+	return content.Err()
+}
+
+type zipArchive struct {
+	*zip.Writer
+}
+
+func (z *zipArchive) create(e *archiveEntry, size int64) (io.Writer, error) {
+	h := &zip.FileHeader{Name: e.path, Method: zip.Deflate, Modified: e.f.ModifiedAt}
+	if e.f.IsDirectory {
+		h.Name += "/"
+		h.Method = zip.Store
+	}
+	return z.CreateHeader(h)
+}
+
+type tarArchive struct {
+	*tar.Writer
+	gz *gzip.Writer
+}
+
+func (t *tarArchive) create(e *archiveEntry, size int64) (io.Writer, error) {
+	h := &tar.Header{Name: e.path, Mode: 0644, Size: size, ModTime: e.f.ModifiedAt, Typeflag: tar.TypeReg}
+	if e.f.IsDirectory {
+		h.Name += "/"
+		h.Mode = 0755
+		h.Typeflag = tar.TypeDir
+	}
+	if err := t.WriteHeader(h); err != nil {
+		return nil, err
+	}
+	return t.Writer, nil
+}
+
+func (t *tarArchive) Close() error {
+	if err := t.Writer.Close(); err != nil {
+		return err
+	}
+	return t.gz.Close()
+}
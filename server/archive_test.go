@@ -0,0 +1,73 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ArchiveZip(t *testing.T) {
+	mockDB := MockDB{}
+	s := Server{maxUpload: 1024 << 20, db: &mockDB, blobs: newTestStore(t, &mockDB)}
+
+	req := httptest.NewRequest(http.MethodGet, "/drive/test?archive=zip", nil)
+	w := httptest.NewRecorder()
+	s.GetFile(w, req, []string{"test"}, testSession(t, "user1"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "attachment; filename=test.zip", w.Header().Get("Content-Disposition"))
+
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	assert.NoError(t, err)
+	files := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		assert.NoError(t, err)
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(data)
+	}
+	assert.Equal(t, map[string]string{
+		"foo.txt":   "foo.txt content\n",
+		"docs/":     "",
+		"docs/a.md": "foo.txt content\n",
+	}, files)
+}
+
+func Test_ArchiveTarSelected(t *testing.T) {
+	mockDB := MockDB{}
+	s := Server{maxUpload: 1024 << 20, db: &mockDB, blobs: newTestStore(t, &mockDB)}
+	user := testSession(t, "user1")
+
+	req := httptest.NewRequest(http.MethodGet, "/drive?archive=tar.gz&select=test/foo.txt", nil)
+	w := httptest.NewRecorder()
+	s.GetFile(w, req, []string{""}, user)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	gz, err := gzip.NewReader(w.Body)
+	assert.NoError(t, err)
+	tr := tar.NewReader(gz)
+	h, err := tr.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "test/foo.txt", h.Name)
+	data, _ := io.ReadAll(tr)
+	assert.Equal(t, "foo.txt content\n", string(data))
+	_, err = tr.Next()
+	assert.Equal(t, io.EOF, err)
+
+	req = httptest.NewRequest(http.MethodGet, "/drive?archive=tar.gz&select=test/missing", nil)
+	w = httptest.NewRecorder()
+	s.GetFile(w, req, []string{""}, user)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/drive?archive=rar", nil)
+	w = httptest.NewRecorder()
+	s.GetFile(w, req, []string{""}, user)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
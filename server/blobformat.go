@@ -0,0 +1,452 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/noisersup/encryptedfs-api/logger"
+)
+
+/*
+	On-disk format of encrypted blobs (version 1)
+
+	header:  magic "EFSB" | version (1 byte) | chunk size (uint32 BE) | nonce prefix (7 bytes)
+	chunks:  AES-256-GCM(plaintext chunk) || tag (16 bytes)
+
+	Every chunk except the last one holds exactly chunk size bytes of plaintext.
+	Nonce of a chunk is nonce prefix || chunk index (uint32 BE) || last chunk flag (1 byte)
+	and the whole header is authenticated as additional data of every chunk (STREAM construction),
+	so modification, reordering and truncation of chunks are all detected.
+	Empty plaintext is stored as a single empty last chunk.
+
+	Blobs stored by older versions have no header, they are encrypted with AES-256-CTR
+	and followed by IV (16 bytes). They aren't authenticated and are only read.
+*/
+
+const (
+	blobVersion     = 1
+	blobChunkSize   = 64 << 10
+	blobHeaderSize  = 16
+	blobPrefixSize  = 7
+	blobTagSize     = 16
+	blobMaxChunkNum = 1<<32 - 1
+)
+
+var blobMagic = []byte("EFSB")
+
+var ErrBlobCorrupted error = errors.New("encrypted file is corrupted or was modified")
+var ErrBlobFormat error = errors.New("unknown format of encrypted file")
+
+func newBlobAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Nonce of chunk with provided index
+func chunkNonce(header []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, header[blobHeaderSize-blobPrefixSize:])
+	binary.BigEndian.PutUint32(nonce[blobPrefixSize:], index)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// blobSealer encrypts chunks of a single blob
+type blobSealer struct {
+	aead   cipher.AEAD
+	header []byte
+}
+
+// Creates sealer of a new blob
+func newBlobSealer(key []byte) (*blobSealer, error) {
+	header := make([]byte, blobHeaderSize)
+	copy(header, blobMagic)
+	header[4] = blobVersion
+	binary.BigEndian.PutUint32(header[5:9], blobChunkSize)
+	if _, err := io.ReadFull(rand.Reader, header[blobHeaderSize-blobPrefixSize:]); err != nil {
+		return nil, err
+	}
+	return resumeBlobSealer(key, header)
+}
+
+// Creates sealer of a blob with provided header
+// (to continue encryption of blob stored in parts)
+func resumeBlobSealer(key, header []byte) (*blobSealer, error) {
+	if len(header) != blobHeaderSize || !bytes.Equal(header[:4], blobMagic) || header[4] != blobVersion ||
+		binary.BigEndian.Uint32(header[5:9]) != blobChunkSize {
+		return nil, ErrBlobFormat
+	}
+	aead, err := newBlobAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &blobSealer{aead: aead, header: header}, nil
+}
+
+// Appends encrypted chunk with provided index to dst
+func (s *blobSealer) seal(dst, plain []byte, index uint32, last bool) []byte {
+	return s.aead.Seal(dst, chunkNonce(s.header, index, last), plain, s.header)
+}
+
+// encryptingReader reads plaintext from src and returns it as an encrypted blob
+type encryptingReader struct {
+	sealer  *blobSealer
+	src     *bufio.Reader
+	index   uint32
+	plain   []byte
+	out     []byte
+	pending []byte // encrypted bytes not yet returned by Read
+	done    bool
+}
+
+// Returns reader of encrypted src
+func encryptReader(src io.Reader, key []byte) (io.Reader, error) {
+	sealer, err := newBlobSealer(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptingReader{
+		sealer:  sealer,
+		src:     bufio.NewReader(src),
+		plain:   make([]byte, blobChunkSize),
+		out:     make([]byte, 0, blobChunkSize+blobTagSize),
+		pending: sealer.header,
+	}, nil
+}
+
+func (e *encryptingReader) Read(p []byte) (int, error) {
+	if len(e.pending) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if err := e.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, e.pending)
+	e.pending = e.pending[n:]
+	return n, nil
+}
+
+func (e *encryptingReader) nextChunk() error {
+	n, err := io.ReadFull(e.src, e.plain)
+	last := false
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF:
+		last = true
+	case nil:
+		// chunk is the last one if nothing follows it
+		if _, err = e.src.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	if e.index == blobMaxChunkNum && !last {
+		return errors.New("file too big")
+	}
+
+	e.pending = e.sealer.seal(e.out[:0], e.plain[:n], e.index, last)
+	e.index++
+	e.done = last
+	return nil
+}
+
+// Reader of plaintext of a blob
+type plainReader interface {
+	io.ReadSeeker
+	Size() int64 // size of plaintext
+	Err() error  // first error returned by Read
+}
+
+// decryptingReader reads encrypted blob and returns its verified plaintext.
+// It can seek to any position of plaintext decrypting only chunks that are read
+type decryptingReader struct {
+	aead      cipher.AEAD
+	blob      io.ReadSeeker
+	header    []byte
+	chunkSize int64
+	chunks    int64 // number of chunks in the blob
+	size      int64 // size of plaintext
+	pos       int64 // position in plaintext
+	loaded    int64 // index of chunk in plain (-1 if none)
+	buf       []byte
+	plain     []byte
+	err       error // first error returned by Read
+}
+
+// Reads header of blob and returns reader of its plaintext.
+// Reader returns ErrBlobCorrupted if any part of blob doesn't pass authentication
+// Blobs without header are read as blobs stored by older versions
+func decryptReader(blob io.ReadSeeker, key []byte) (plainReader, error) {
+	aead, err := newBlobAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := blob.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = blob.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, blobHeaderSize)
+	if _, err = io.ReadFull(blob, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrBlobFormat
+		}
+		return nil, err
+	}
+	if !bytes.Equal(header[:4], blobMagic) {
+		return newLegacyReader(blob, size, key)
+	}
+	if header[4] != blobVersion {
+		return nil, ErrBlobFormat
+	}
+
+	chunkSize := int64(binary.BigEndian.Uint32(header[5:9]))
+	if chunkSize == 0 || chunkSize > 16<<20 {
+		return nil, ErrBlobCorrupted
+	}
+
+	// every blob has at least one (possibly empty) chunk
+	encChunk := chunkSize + blobTagSize
+	chunks := (size - blobHeaderSize + encChunk - 1) / encChunk
+	plainSize := size - blobHeaderSize - chunks*blobTagSize
+	if chunks == 0 || plainSize < (chunks-1)*chunkSize {
+		return nil, ErrBlobCorrupted
+	}
+
+	return &decryptingReader{
+		aead:      aead,
+		blob:      blob,
+		header:    header,
+		chunkSize: chunkSize,
+		chunks:    chunks,
+		size:      plainSize,
+		loaded:    -1,
+		buf:       make([]byte, encChunk),
+	}, nil
+}
+
+// Returns size of plaintext
+func (d *decryptingReader) Size() int64 {
+	return d.size
+}
+
+func (d *decryptingReader) Err() error {
+	return d.err
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	// the last chunk is read (and verified) even at the end of plaintext
+	index := d.pos / d.chunkSize
+	if index >= d.chunks {
+		index = d.chunks - 1
+	}
+	if index != d.loaded {
+		if err := d.loadChunk(index); err != nil {
+			if d.err == nil {
+				d.err = err
+			}
+			return 0, err
+		}
+	}
+
+	within := d.pos - index*d.chunkSize
+	if within >= int64(len(d.plain)) {
+		return 0, io.EOF
+	}
+	n := copy(p, d.plain[within:])
+	d.pos += int64(n)
+	return n, nil
+}
+
+func (d *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	d.pos = offset
+	return offset, nil
+}
+
+// Decrypts and verifies chunk with provided index
+func (d *decryptingReader) loadChunk(index int64) error {
+	last := index == d.chunks-1
+	encChunk := d.chunkSize + blobTagSize
+	if _, err := d.blob.Seek(blobHeaderSize+index*encChunk, io.SeekStart); err != nil {
+		return err
+	}
+
+	n, err := io.ReadFull(d.blob, d.buf)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		if !last {
+			return ErrBlobCorrupted
+		}
+	} else if err != nil {
+		return err
+	}
+
+	plain, err := d.aead.Open(d.buf[:0], chunkNonce(d.header, uint32(index), last), d.buf[:n], d.header)
+	if err != nil {
+		d.loaded = -1
+		return ErrBlobCorrupted
+	}
+	d.plain = plain
+	d.loaded = index
+	return nil
+}
+
+// Decrypts a blob from argument, verifies it in chunks and sends them to writer
+func decrypt(blob io.ReadSeeker, w io.Writer, key []byte) error {
+	r, err := decryptReader(blob, key)
+	if err != nil {
+		return err
+	}
+
+	d := logger.CreateDots(100)
+	buf := make([]byte, blobChunkSize)
+	for {
+		if logger.Verbose {
+			d.PrintDots()
+		}
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// legacyReader reads blob stored by older versions (AES-CTR ciphertext followed by IV)
+// It can seek to any position as CTR keystream can be started at any block
+type legacyReader struct {
+	block cipher.Block
+	blob  io.ReadSeeker
+	iv    []byte
+	size  int64 // size of plaintext
+	pos   int64 // position in plaintext
+	err   error // first error returned by Read
+}
+
+func newLegacyReader(blob io.ReadSeeker, size int64, key []byte) (*legacyReader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if size < aes.BlockSize {
+		return nil, ErrBlobFormat
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	if _, err = blob.Seek(size-aes.BlockSize, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err = io.ReadFull(blob, iv); err != nil {
+		return nil, err
+	}
+	return &legacyReader{block: block, blob: blob, iv: iv, size: size - aes.BlockSize}, nil
+}
+
+func (r *legacyReader) Size() int64 {
+	return r.size
+}
+
+func (r *legacyReader) Err() error {
+	return r.err
+}
+
+func (r *legacyReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if rest := r.size - r.pos; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	if _, err := r.blob.Seek(r.pos, io.SeekStart); err != nil {
+		return 0, r.fail(err)
+	}
+	n, err := io.ReadFull(r.blob, p)
+	if err != nil {
+		return 0, r.fail(err)
+	}
+
+	// keystream is started at the block holding the position
+	stream := cipher.NewCTR(r.block, ctrAt(r.iv, uint64(r.pos/aes.BlockSize)))
+	skip := make([]byte, r.pos%aes.BlockSize)
+	stream.XORKeyStream(skip, skip)
+	stream.XORKeyStream(p[:n], p[:n])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *legacyReader) fail(err error) error {
+	if r.err == nil {
+		r.err = err
+	}
+	return err
+}
+
+func (r *legacyReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// Returns counter of CTR mode after provided number of blocks
+// (IV is a big endian counter incremented with every block)
+func ctrAt(iv []byte, blocks uint64) []byte {
+	ctr := append([]byte{}, iv...)
+	carry := uint64(0)
+	for i := len(ctr) - 1; i >= 0 && (blocks > 0 || carry > 0); i-- {
+		sum := uint64(ctr[i]) + blocks&0xff + carry
+		ctr[i] = byte(sum)
+		carry = sum >> 8
+		blocks >>= 8
+	}
+	return ctr
+}
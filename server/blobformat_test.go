@@ -0,0 +1,168 @@
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encryptTestBlob(t *testing.T, plain, key []byte) []byte {
+	r, err := encryptReader(bytes.NewReader(plain), key)
+	assert.NoError(t, err)
+	blob, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	return blob
+}
+
+func decryptTestBlob(blob, key []byte) ([]byte, error) {
+	out := bytes.Buffer{}
+	err := decrypt(bytes.NewReader(blob), &out, key)
+	return out.Bytes(), err
+}
+
+func Test_BlobRoundTrip(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	for _, size := range []int{0, 1, blobChunkSize - 1, blobChunkSize, blobChunkSize + 1, 3 * blobChunkSize} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+
+		blob := encryptTestBlob(t, plain, key)
+		chunks := size/blobChunkSize + 1
+		if size > 0 && size%blobChunkSize == 0 {
+			chunks--
+		}
+		assert.Equal(t, blobHeaderSize+size+chunks*blobTagSize, len(blob), "size %d", size)
+
+		out, err := decryptTestBlob(blob, key)
+		assert.NoError(t, err, "size %d", size)
+		assert.True(t, bytes.Equal(plain, out), "size %d", size)
+	}
+}
+
+func Test_BlobTampering(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	plain := make([]byte, 2*blobChunkSize+100)
+	rand.Read(plain)
+	blob := encryptTestBlob(t, plain, key)
+	encChunk := blobChunkSize + blobTagSize
+
+	flipped := append([]byte{}, blob...)
+	flipped[blobHeaderSize+encChunk+10] ^= 1
+
+	header := append([]byte{}, blob...)
+	header[blobHeaderSize-1] ^= 1
+
+	reordered := append([]byte{}, blob[:blobHeaderSize]...)
+	reordered = append(reordered, blob[blobHeaderSize+encChunk:blobHeaderSize+2*encChunk]...)
+	reordered = append(reordered, blob[blobHeaderSize:blobHeaderSize+encChunk]...)
+	reordered = append(reordered, blob[blobHeaderSize+2*encChunk:]...)
+
+	wrongKey := make([]byte, 32)
+	rand.Read(wrongKey)
+
+	cases := map[string]struct {
+		blob []byte
+		key  []byte
+		err  error
+	}{
+		"flipped bit":        {flipped, key, ErrBlobCorrupted},
+		"modified header":    {header, key, ErrBlobCorrupted},
+		"reordered chunks":   {reordered, key, ErrBlobCorrupted},
+		"truncated chunk":    {blob[:len(blob)-1], key, ErrBlobCorrupted},
+		"truncated at chunk": {blob[:blobHeaderSize+2*encChunk], key, ErrBlobCorrupted},
+		"only header":        {blob[:blobHeaderSize], key, ErrBlobCorrupted},
+		"no header":          {blob[:10], key, ErrBlobFormat},
+		"wrong key":          {blob, wrongKey, ErrBlobCorrupted},
+	}
+
+	for name, c := range cases {
+		_, err := decryptTestBlob(c.blob, c.key)
+		assert.Equal(t, c.err, err, name)
+	}
+}
+
+func Test_BlobSeek(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	plain := make([]byte, 3*blobChunkSize+100)
+	rand.Read(plain)
+	blob := encryptTestBlob(t, plain, key)
+
+	r, err := decryptReader(bytes.NewReader(blob), key)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(plain)), r.Size())
+
+	for _, off := range []int64{0, 10, blobChunkSize - 1, blobChunkSize, 2*blobChunkSize + 7, int64(len(plain)) - 1} {
+		_, err := r.Seek(off, io.SeekStart)
+		assert.NoError(t, err)
+
+		out := make([]byte, 20)
+		n, err := io.ReadFull(r, out)
+		if off+20 > int64(len(plain)) {
+			assert.Equal(t, io.ErrUnexpectedEOF, err)
+		} else {
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, plain[off:off+int64(n)], out[:n], "offset %d", off)
+	}
+
+	// corrupted chunk is detected only when it's read
+	blob[blobHeaderSize+10] ^= 1
+	r, err = decryptReader(bytes.NewReader(blob), key)
+	assert.NoError(t, err)
+	_, err = r.Seek(blobChunkSize, io.SeekStart)
+	assert.NoError(t, err)
+	_, err = io.ReadFull(r, make([]byte, 10))
+	assert.NoError(t, err)
+	_, err = r.Seek(0, io.SeekStart)
+	assert.NoError(t, err)
+	_, err = r.Read(make([]byte, 10))
+	assert.Equal(t, ErrBlobCorrupted, err)
+}
+
+// Encrypts plaintext as older versions did (CTR ciphertext followed by IV)
+func encryptLegacyBlob(t *testing.T, plain, key, iv []byte) []byte {
+	block, err := aes.NewCipher(key)
+	assert.NoError(t, err)
+	blob := make([]byte, len(plain))
+	cipher.NewCTR(block, iv).XORKeyStream(blob, plain)
+	return append(blob, iv...)
+}
+
+func Test_LegacyBlob(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	plain := make([]byte, 3000)
+	rand.Read(plain)
+	// counter overflows lower bytes of IV
+	iv := bytes.Repeat([]byte{0xff}, aes.BlockSize)
+	iv[0] = 0
+	blob := encryptLegacyBlob(t, plain, key, iv)
+
+	out, err := decryptTestBlob(blob, key)
+	assert.NoError(t, err)
+	assert.Equal(t, plain, out)
+
+	empty, err := decryptTestBlob(encryptLegacyBlob(t, nil, key, iv), key)
+	assert.NoError(t, err)
+	assert.Empty(t, empty)
+
+	r, err := decryptReader(bytes.NewReader(blob), key)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(plain)), r.Size())
+	for _, off := range []int64{0, 7, aes.BlockSize, 1001, int64(len(plain)) - 5} {
+		_, err := r.Seek(off, io.SeekStart)
+		assert.NoError(t, err)
+		out := make([]byte, 20)
+		n, _ := io.ReadFull(r, out)
+		assert.Equal(t, plain[off:off+int64(n)], out[:n], "offset %d", off)
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/noisersup/encryptedfs-api/auth"
+	"github.com/noisersup/encryptedfs-api/database"
+	l "github.com/noisersup/encryptedfs-api/logger"
+	"github.com/noisersup/encryptedfs-api/models"
+)
+
+/*
+	Drives on which file handlers operate
+
+	Handlers of /drive/path work on user's own files, handlers of /shared/id/path
+	on files shared with the user and handlers of /groups/id/drive/path on files of a group.
+	Drive of shared file is rooted at the shared file itself and opened with its own key,
+	so paths requested by the recipient are resolved under it (empty path is the shared file).
+*/
+
+// Files accessible with a request
+type drive struct {
+	root  uuid.UUID    // root of the drive (user, group or shared file)
+	key   []byte       // key of the drive (own key of shared file)
+	entry *models.File // shared file or directory (nil in drives of users and groups)
+	write bool         // false if files can be only read
+}
+
+// Opens drive addressed by request:
+// /shared/(id)/... and /trash/shared/(id)/... is file shared with the user, /groups/(id)/... drive of a group
+// and other routes user's own drive
+// Returns the drive and matches of the route following id of the drive
+// If the drive can't be opened writes error response and returns nil
+func (s *Server) openDrive(w http.ResponseWriter, r *http.Request, paths []string, user *auth.Session) (*drive, []string) {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/shared/"), strings.HasPrefix(r.URL.Path, "/trash/shared/"):
+		return s.openShare(w, paths[0], user), paths[1:]
+	case strings.HasPrefix(r.URL.Path, "/groups/"):
+		return s.openGroupDrive(w, paths[0], user), paths[1:]
+	}
+
+	root, err := s.db.GetRoot(user.Username)
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return nil, nil
+	}
+	return &drive{root: root, key: user.Key, write: true}, paths
+}
+
+// Opens drive addressed by request of drive route (see openDrive)
+// Returns the drive and path requested inside of it
+func (s *Server) openPath(w http.ResponseWriter, r *http.Request, paths []string, user *auth.Session) (*drive, []string) {
+	d, paths := s.openDrive(w, r, paths, user)
+	if d == nil {
+		return nil, nil
+	}
+	path := database.PathToArr(paths[0])
+	// shared file has no children
+	if d.entry != nil && !d.entry.IsDirectory && len(path) > 0 {
+		resp404(w)
+		return nil, nil
+	}
+	return d, path
+}
+
+// Checks if files can be placed into the drive (its root is a directory)
+// If they can't writes error response and returns false
+func (d *drive) holdsFiles(w http.ResponseWriter) bool {
+	if d.entry != nil && !d.entry.IsDirectory {
+		resp400(w, "Shared file is not a directory")
+		return false
+	}
+	return true
+}
+
+// Checks if file on path (inside of the drive) can be modified
+// removes is true if the file is removed from its location (deleted or moved),
+// which isn't allowed for shared file itself (recipients can modify only its content or children)
+// If the file can't be modified writes error response and returns false
+func (d *drive) writable(w http.ResponseWriter, path []string, removes bool) bool {
+	if !d.write {
+		resp403(w, "Read only access")
+		return false
+	}
+	if removes && d.entry != nil && len(path) == 0 {
+		resp403(w, "Shared file can be moved or deleted only by its owner")
+		return false
+	}
+	return true
+}
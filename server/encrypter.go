@@ -1,23 +1,28 @@
 package server
 
 import (
-	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
-	"log"
+	"mime"
 	"mime/multipart"
-	"os"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/google/uuid"
+	"github.com/noisersup/encryptedfs-api/crypt"
 	"github.com/noisersup/encryptedfs-api/database"
-	"github.com/noisersup/encryptedfs-api/logger"
 	l "github.com/noisersup/encryptedfs-api/logger"
 	"github.com/noisersup/encryptedfs-api/models"
+	"github.com/noisersup/encryptedfs-api/storage"
 )
 
 func encryptBytes(input, key []byte) ([]byte, error) {
@@ -63,182 +68,282 @@ func getHashOfFile(fileName, key []byte) string {
 	return fmt.Sprintf("%x", hash)
 }
 
-// Encrypts a file from multipart reader and stores it in provided directory
-func encryptMultipart(r *multipart.Reader, dir string, key []byte, db models.Database, userRoot uuid.UUID) error {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return err
-	}
+// Statuses of files in response to multipart upload
+const (
+	uploadCreated            = "created"
+	uploadReplaced           = "replaced"
+	uploadExists             = "exists" // directory of extracted archive already exists
+	uploadConflict           = "conflict"
+	uploadPreconditionFailed = "precondition failed"
+	uploadError              = "error"
+)
 
-	iv := make([]byte, block.BlockSize())
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		return err
+// Sets status of result from error returned by encryptFile
+func (res *UploadResult) setError(err error) {
+	switch err {
+	case nil:
+		return
+	case database.FileExists:
+		res.Status = uploadConflict
+		res.Error = "File already exists"
+	case database.PreconditionFailed:
+		res.Status = uploadPreconditionFailed
+		res.Error = "File was changed"
+	case errArchiveTooBig:
+		res.Status = uploadError
+		res.Error = err.Error()
+	default:
+		l.Err("%s: %s", res.Name, err.Error())
+		res.Status = uploadError
+		res.Error = "Internal server error"
 	}
+}
 
-	//buf := bytes.NewBuffer(make([]byte, 0, 1024))
-	buf := make([]byte, 1024)
-	stream := cipher.NewCTR(block, iv)
-
-	part, err := r.NextPart()
-	if err != nil {
-		return err
+// Fills result of upload with stored file which was requested under provided name
+func (res *UploadResult) setFile(f *models.File, requested string) {
+	res.ETag = f.ETag()
+	if f.Version > 1 {
+		res.Status = uploadReplaced
 	}
-	partRead := true
-
-	//newFilepath := "./files/" + dir
-
-	hash := getHashOfFile([]byte(part.FileName()), key)
-
-	path := "./files/" + hash
-	n := 0
-
-	newPath := path
-
-	for {
-		if _, err := os.Stat(newPath); !errors.Is(err, os.ErrNotExist) {
-			n++
-			newPath = fmt.Sprintf("%s%d", path, n)
-		} else {
-			break
-		}
+	if f.Name != requested {
+		res.RenamedTo = f.Name
 	}
+}
 
-	log.Print(part.FileName())
-
-	err = db.NewFile(append(database.PathToArr(dir), part.FileName()), key, n, false, userRoot)
-	if err != nil {
-		return err
-	}
+// Options of multipart upload set with non-file form fields
+// (a field applies to files sent after it)
+type uploadOptions struct {
+	conflict models.ConflictPolicy // what to do when a file with the same name exists
+	extract  bool                  // expand uploaded archives into target directory
+	ifMatch  string                // replace only files with matching entity tag (If-Match header)
+	maxSize  int64                 // maximal size of data extracted from an archive
+}
 
-	err = os.MkdirAll("./files", os.ModePerm)
-	if err != nil {
-		return err
-	}
-	outFile, err := os.OpenFile(newPath, os.O_RDWR|os.O_CREATE, os.ModePerm)
-	if err != nil {
-		return err
+// Sets option from form field with provided name and value
+func (o *uploadOptions) set(name, value string) error {
+	switch name {
+	case "conflict":
+		switch p := models.ConflictPolicy(value); p {
+		case models.ConflictFail, models.ConflictOverwrite, models.ConflictRename:
+			o.conflict = p
+			return nil
+		}
+		return fmt.Errorf("invalid value of conflict: %s", value)
+	case "overwrite":
+		// kept for older clients, same as conflict=overwrite
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid value of overwrite: %s", value)
+		}
+		o.conflict = models.ConflictFail
+		if v {
+			o.conflict = models.ConflictOverwrite
+		}
+		return nil
+	case "extract":
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid value of extract: %s", value)
+		}
+		o.extract = v
+		return nil
 	}
+	return fmt.Errorf("unknown option: %s", name)
+}
 
-	defer outFile.Close()
-	partRead = true // part of file was read once (for metadata purposes)
+// Encrypts every file from multipart reader as a separate file in provided directory
+// opts are initial options of the upload (changed by form fields)
+// Returns results of all files in order they were sent
+// Error is returned only if the request itself couldn't be read
+func encryptMultipart(r *multipart.Reader, dir string, key []byte, db models.Database, userRoot uuid.UUID, blobs storage.BlobStore, opts uploadOptions) ([]UploadResult, error) {
+	results := []UploadResult{}
 
 	for {
-		if !partRead {
-			l.LogV("NextPart")
-			part, err = r.NextPart()
-			l.LogV("Part found")
-		}
-		partRead = false
+		part, err := r.NextPart()
 		if err == io.EOF {
-			break
+			return results, nil
 		}
-
 		if err != nil {
-			//rmFile(newFilepath)
-			return fmt.Errorf("Read %d bytes: %v", len(buf), err)
+			return results, err
 		}
 
-		for {
-			if l.Verbose {
-				fmt.Print(".")
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, 1024))
+			if err != nil {
+				return results, err
 			}
-			n, err := part.Read(buf)
-			if n > 0 {
-				stream.XORKeyStream(buf, buf[:n])
-				outFile.Write(buf[:n])
+			if err = opts.set(part.FormName(), string(value)); err != nil {
+				return results, &optionError{err}
 			}
-			if err == io.EOF {
-				break
+			continue
+		}
+
+		name := part.FileName()
+		if opts.extract {
+			x := extractor{dir: database.PathToArr(dir), key: key, db: db, userRoot: userRoot, blobs: blobs, opts: opts}
+			results = append(results, x.extract(part, name)...)
+			if _, err = io.Copy(io.Discard, part); err != nil {
+				return results, err
 			}
-			if err != nil {
-				return err
+			continue
+		}
+
+		// names with path separators could escape target directory
+		result := UploadResult{Name: name, Status: uploadCreated}
+		if strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+			result.Status = uploadError
+			result.Error = "invalid file name"
+		} else {
+			f, err := encryptFile(part, append(database.PathToArr(dir), name), key, db, userRoot, blobs, opts)
+			result.setError(err)
+			if f != nil {
+				result.setFile(f, name)
 			}
 		}
+		results = append(results, result)
+
+		// drain rest of the part so the next one can be read
+		if _, err = io.Copy(io.Discard, part); err != nil {
+			return results, err
+		}
 	}
-	l.LogV("outFile.Write(iv)")
-	outFile.Write(iv)
-	l.LogV("written iv")
+}
 
-	return nil
+// optionError is returned by encryptMultipart when form contains invalid option
+type optionError struct {
+	err error
 }
 
-// Decrypts a file from argument, creates chunks od it and send them to writer
-func decrypt(file *os.File, part io.Writer, key []byte) error {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return err
-	}
+func (e *optionError) Error() string {
+	return e.err.Error()
+}
 
-	finfo, err := file.Stat()
-	if err != nil {
-		return err
+// Encrypts content read from r and stores it as a file on provided path
+// Returns the stored file
+func encryptFile(r io.Reader, pathNames []string, key []byte, db models.Database, userRoot uuid.UUID, blobs storage.BlobStore, opts uploadOptions) (*models.File, error) {
+	// fail before the content is stored (conditions are checked again when the file is linked)
+	existing, err := db.GetFile(pathNames, key, userRoot)
+	if err == nil {
+		if opts.ifMatch != "" {
+			if existing.IsDirectory {
+				return nil, database.FileExists
+			}
+			if !existing.MatchesETag(opts.ifMatch) {
+				return nil, database.PreconditionFailed
+			}
+		} else if opts.conflict == models.ConflictRename {
+			// file will be stored under another name
+		} else if opts.conflict != models.ConflictOverwrite || existing.IsDirectory {
+			return nil, database.FileExists
+		}
+	} else if err != database.FileNotFound {
+		return nil, err
+	} else if opts.ifMatch != "" {
+		return nil, database.PreconditionFailed
 	}
 
-	iv := make([]byte, block.BlockSize())
+	name := newBlobName()
 
-	length := finfo.Size() - int64(len(iv))
+	// every file is encrypted with its own data key
+	// which is stored wrapped with user's key
+	dataKey, err := crypt.NewKey()
+	if err != nil {
+		return nil, err
+	}
+	wrappedKey, err := crypt.WrapKey(key, dataKey)
+	if err != nil {
+		return nil, err
+	}
 
-	_, err = file.ReadAt(iv, length)
+	meta := newMetadataReader(r)
+	encrypted, err := encryptReader(meta, dataKey)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	// content is stored before the file is linked
+	// so an interrupted upload doesn't leave entry without content
+	if err = blobs.Put(name, encrypted); err != nil {
+		return nil, err
 	}
 
-	d := logger.CreateDots(1000)
+	f := models.File{
+		Hash:        name,
+		WrappedKey:  wrappedKey,
+		Size:        meta.size,
+		ContentType: detectContentType(pathNames[len(pathNames)-1], meta.head),
+		Checksum:    fmt.Sprintf("%x", meta.hash.Sum(nil)),
+	}
+	if opts.ifMatch != "" {
+		err = db.ReplaceFile(pathNames, key, &f, userRoot, opts.ifMatch)
+	} else {
+		err = db.StoreFile(pathNames, key, &f, userRoot, opts.conflict)
+	}
+	if err != nil {
+		blobs.Delete(name)
+		return nil, err
+	}
+	return &f, nil
+}
 
-	buf := make([]byte, 1024)
-	stream := cipher.NewCTR(block, iv)
-	for {
-		n, err := file.Read(buf)
-		if n > 0 {
-			if logger.Verbose {
-				d.PrintDots()
-			}
-			// IV bytes don't belong the original message
-			if n > int(length) {
-				n = int(length)
-			}
+// metadataReader collects size, checksum and beginning of content read through it
+type metadataReader struct {
+	r    io.Reader
+	size int64
+	hash hash.Hash
+	head []byte // first bytes of content used to detect its type
+}
 
-			length -= int64(n)
-			stream.XORKeyStream(buf, buf[:n])
+func newMetadataReader(r io.Reader) *metadataReader {
+	return &metadataReader{r: r, hash: sha256.New()}
+}
 
-			if _, err = io.Copy(part, bytes.NewReader(buf[:n])); err != nil {
-				return err
-			}
-			if err != nil {
-				return err
-			}
+func (m *metadataReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	m.size += int64(n)
+	m.hash.Write(p[:n])
+	if free := sniffLen - len(m.head); free > 0 {
+		if free > n {
+			free = n
 		}
+		m.head = append(m.head, p[:free]...)
+	}
+	return n, err
+}
 
-		if err == io.EOF {
-			break
-		}
+// Number of bytes used by http.DetectContentType
+const sniffLen = 512
 
-		if err != nil {
-			return err
-		}
+// Returns MIME type of file based on extension of its name
+// or (if extension is unknown) its first bytes
+func detectContentType(name string, head []byte) string {
+	if ctype := mime.TypeByExtension(filepath.Ext(name)); ctype != "" {
+		return ctype
 	}
-	return nil
+	return http.DetectContentType(head)
 }
 
-func saveFile(infile multipart.File, outFile *os.File) error {
-	buf := make([]byte, 1024)
-	for {
-		n, err := infile.Read(buf)
-		if n > 0 {
-			outFile.Write(buf[:n])
-		}
-
-		if err == io.EOF {
-			break
-		}
+// Returns random name for a new blob
+// Names are never reused, so concurrent uploads can't overwrite blobs of each other
+func newBlobName() string {
+	id := uuid.New()
+	return hex.EncodeToString(id[:])
+}
 
-		if err != nil {
-			return fmt.Errorf("Read %d bytes: %v", n, err)
-		}
+// Returns key with which content of the file is encrypted
+func fileKey(f *models.File, userKey []byte) ([]byte, error) {
+	// files uploaded before introduction of data keys are encrypted with user's key
+	// (their blobs are in the old format read by legacyReader)
+	if f.WrappedKey == nil {
+		return userKey, nil
 	}
-	return nil
+	return crypt.UnwrapKey(userKey, f.WrappedKey)
 }
 
-func rmFile(path string) {
-	os.Remove(path)
+// Returns key with which names of children of the directory are encrypted
+// (shared directory has its own key)
+func dirKey(f *models.File, userKey []byte) ([]byte, error) {
+	if f.OwnKey == nil {
+		return userKey, nil
+	}
+	return crypt.UnwrapKey(userKey, f.OwnKey)
 }
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_UploadMultipleFiles(t *testing.T) {
+	mockDB := MockDB{}
+	blobs := newTestStore(t, &mockDB)
+	s := Server{maxUpload: 1024 << 20, db: &mockDB, blobs: blobs}
+	user := testSession(t, "user1")
+
+	files := map[string]string{
+		"a.txt": "first file",
+		"b.txt": "second file",
+		"c.txt": "third file",
+	}
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for _, name := range []string{"a.txt", "b.txt", "foo.txt", "c.txt"} {
+		fw, err := mw.CreateFormFile("file", name)
+		assert.NoError(t, err)
+		fw.Write([]byte(files[name]))
+	}
+	assert.NoError(t, mw.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/drive/test", body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	s.uploadFile(w, req, []string{"test"}, user)
+
+	assert.Equal(t, http.StatusMultiStatus, w.Code)
+	var resp UploadResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, []UploadResult{
+		{Name: "a.txt", Status: uploadCreated},
+		{Name: "b.txt", Status: uploadCreated},
+		{Name: "foo.txt", Status: uploadConflict, Error: "File already exists"},
+		{Name: "c.txt", Status: uploadCreated},
+	}, withoutETags(resp.Files))
+
+	for name, content := range files {
+		f := mockDB.created["test/"+name]
+		if !assert.NotNil(t, f, name) {
+			continue
+		}
+		dataKey, err := fileKey(f, user.Key)
+		assert.NoError(t, err)
+		blob, err := blobs.Get(f.BlobName())
+		assert.NoError(t, err)
+		out := bytes.Buffer{}
+		assert.NoError(t, decrypt(blob, &out, dataKey))
+		assert.Equal(t, content, out.String())
+	}
+}
+
+func Test_UploadOverwrite(t *testing.T) {
+	mockDB := MockDB{}
+	blobs := newTestStore(t, &mockDB)
+	s := Server{maxUpload: 1024 << 20, db: &mockDB, blobs: blobs}
+	user := testSession(t, "user1")
+
+	upload := func(content string, overwrite bool) int {
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		if overwrite {
+			mw.WriteField("overwrite", "true")
+		}
+		fw, _ := mw.CreateFormFile("file", "new.txt")
+		fw.Write([]byte(content))
+		mw.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/drive/test", body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		s.uploadFile(w, req, []string{"test"}, user)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusCreated, upload("old", false))
+	assert.Equal(t, http.StatusMultiStatus, upload("new", false))
+	assert.Equal(t, http.StatusCreated, upload("new", true))
+
+	f := mockDB.created["test/new.txt"]
+	dataKey, err := fileKey(f, user.Key)
+	assert.NoError(t, err)
+	blob, err := blobs.Get(f.BlobName())
+	assert.NoError(t, err)
+	out := bytes.Buffer{}
+	assert.NoError(t, decrypt(blob, &out, dataKey))
+	assert.Equal(t, "new", out.String())
+}
+
+func Test_UploadConflictRename(t *testing.T) {
+	mockDB := MockDB{}
+	blobs := newTestStore(t, &mockDB)
+	s := Server{maxUpload: 1024 << 20, db: &mockDB, blobs: blobs}
+	user := testSession(t, "user1")
+
+	upload := func(content, conflict string) (int, UploadResponse) {
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		fw, _ := mw.CreateFormFile("file", "new.txt")
+		fw.Write([]byte(content))
+		mw.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/drive/test?conflict="+conflict, body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		s.uploadFile(w, req, []string{"test"}, user)
+		var resp UploadResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp
+	}
+
+	code, _ := upload("first", "fail")
+	assert.Equal(t, http.StatusCreated, code)
+	code, _ = upload("second", "fail")
+	assert.Equal(t, http.StatusMultiStatus, code)
+
+	code, resp := upload("second", "rename")
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, "new (1).txt", resp.Files[0].RenamedTo)
+	code, resp = upload("third", "rename")
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, "new (2).txt", resp.Files[0].RenamedTo)
+
+	code, _ = upload("x", "skip")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	for name, content := range map[string]string{"new.txt": "first", "new (1).txt": "second", "new (2).txt": "third"} {
+		f := mockDB.created["test/"+name]
+		if !assert.NotNil(t, f, name) {
+			continue
+		}
+		dataKey, err := fileKey(f, user.Key)
+		assert.NoError(t, err)
+		blob, err := blobs.Get(f.BlobName())
+		assert.NoError(t, err)
+		out := bytes.Buffer{}
+		assert.NoError(t, decrypt(blob, &out, dataKey))
+		assert.Equal(t, content, out.String())
+	}
+}
+
+func Test_UploadMetadata(t *testing.T) {
+	mockDB := MockDB{}
+	s := Server{maxUpload: 1024 << 20, db: &mockDB, blobs: newTestStore(t, &mockDB)}
+	user := testSession(t, "user1")
+
+	content := "<!DOCTYPE html><html><body>hello</body></html>"
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	fw, _ := mw.CreateFormFile("file", "page")
+	fw.Write([]byte(content))
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/drive/test", body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	s.uploadFile(w, req, []string{"test"}, user)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	checksum := fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+
+	req = httptest.NewRequest(http.MethodHead, "/drive/test/page", nil)
+	w = httptest.NewRecorder()
+	s.statFile(w, req, []string{"test/page"}, user)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, strconv.Itoa(len(content)), w.Header().Get("Content-Length"))
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, checksum, w.Header().Get("X-Checksum-Sha256"))
+	assert.NotEmpty(t, w.Header().Get("Last-Modified"))
+	assert.Empty(t, w.Body.String())
+
+	req = httptest.NewRequest(http.MethodGet, "/drive/test/page?stat", nil)
+	w = httptest.NewRecorder()
+	s.GetFile(w, req, []string{"test/page"}, user)
+	var stat ListedFile
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&stat))
+	assert.Equal(t, "page", stat.Name)
+	assert.Equal(t, int64(len(content)), stat.Size)
+	assert.Equal(t, checksum, stat.Checksum)
+	assert.False(t, stat.ModifiedAt.IsZero())
+}
+
+func Test_UploadIfMatch(t *testing.T) {
+	mockDB := MockDB{}
+	s := Server{maxUpload: 1024 << 20, db: &mockDB, blobs: newTestStore(t, &mockDB)}
+	user := testSession(t, "user1")
+
+	upload := func(content, ifMatch string) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		fw, _ := mw.CreateFormFile("file", "doc.txt")
+		fw.Write([]byte(content))
+		mw.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/drive/test", body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		s.uploadFile(w, req, []string{"test"}, user)
+		return w
+	}
+
+	// file has to exist
+	assert.Equal(t, http.StatusPreconditionFailed, upload("v1", "*").Code)
+
+	w := upload("v1", "")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	v1 := w.Header().Get("ETag")
+	assert.NotEmpty(t, v1)
+
+	w = upload("v2", v1)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	v2 := w.Header().Get("ETag")
+	assert.NotEqual(t, v1, v2)
+	var resp UploadResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, uploadReplaced, resp.Files[0].Status)
+	assert.Equal(t, int64(2), mockDB.created["test/doc.txt"].Version)
+
+	// concurrent change made with stale tag is rejected
+	assert.Equal(t, http.StatusPreconditionFailed, upload("v3", v1).Code)
+	assert.Equal(t, v2, mockDB.created["test/doc.txt"].ETag())
+}
+
+// Clears entity tags of results so only names and statuses are compared
+func withoutETags(results []UploadResult) []UploadResult {
+	for i := range results {
+		results[i].ETag = ""
+	}
+	return results
+}
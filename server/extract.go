@@ -0,0 +1,292 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/noisersup/encryptedfs-api/crypt"
+	"github.com/noisersup/encryptedfs-api/database"
+	l "github.com/noisersup/encryptedfs-api/logger"
+	"github.com/noisersup/encryptedfs-api/models"
+	"github.com/noisersup/encryptedfs-api/storage"
+)
+
+/*
+	Extraction of uploaded archives (zip, tar, tar.gz)
+
+	Tar archives are expanded while they are received.
+	Zip archives need random access, so they are staged first as a blob
+	encrypted with a temporary key (which is never stored) and read back through
+	the seekable decrypting reader.
+
+	Protections:
+	- names of entries are cleaned and entries escaping target directory are rejected (zip-slip)
+	- only regular files and directories are extracted (links are rejected)
+	- number of entries and total size of extracted data are limited
+	  (sizes declared in archive headers are not trusted) (zip-bomb)
+*/
+
+const maxArchiveEntries = 10000
+
+var errArchiveTooBig = errors.New("archive exceeds size limit")
+var errArchiveFormat = errors.New("unsupported archive format")
+
+// extractor expands archives into directory
+type extractor struct {
+	dir      []string
+	key      []byte
+	db       models.Database
+	userRoot uuid.UUID
+	blobs    storage.BlobStore
+	opts     uploadOptions // maxSize of options limits size of extracted data
+	written  int64         // size of data extracted so far
+	entries  int
+}
+
+// Extracts archive with provided name
+// Returns results of all entries
+// (extraction stops at the first entry exceeding limits)
+func (x *extractor) extract(r io.Reader, name string) []UploadResult {
+	var err error
+	results := []UploadResult{}
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		results, err = x.extractZip(r)
+	case strings.HasSuffix(lower, ".tar"):
+		results, err = x.extractTar(r)
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(r); err == nil {
+			results, err = x.extractTar(gz)
+		}
+	default:
+		err = errArchiveFormat
+	}
+
+	if err != nil {
+		result := UploadResult{Name: name, Status: uploadError, Error: err.Error()}
+		if err != errArchiveFormat && err != errArchiveTooBig {
+			l.Err("extracting %s: %s", name, err.Error())
+			result.Error = "invalid archive"
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func (x *extractor) extractTar(r io.Reader) ([]UploadResult, error) {
+	results := []UploadResult{}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return results, nil
+		}
+		if err != nil {
+			return results, err
+		}
+
+		if isArchiveRoot(h.Name) {
+			continue
+		}
+		var result UploadResult
+		switch h.Typeflag {
+		case tar.TypeDir:
+			result = x.entry(h.Name, true, nil)
+		case tar.TypeReg, tar.TypeRegA:
+			result = x.entry(h.Name, false, tr)
+		default:
+			result = UploadResult{Name: h.Name, Status: uploadError, Error: "unsupported entry type"}
+		}
+		results = append(results, result)
+		if result.Error == errArchiveTooBig.Error() {
+			return results, nil
+		}
+	}
+}
+
+func (x *extractor) extractZip(r io.Reader) ([]UploadResult, error) {
+	stageKey, err := crypt.NewKey()
+	if err != nil {
+		return nil, err
+	}
+	stageName := "extract-" + uuid.New().String()
+
+	// size of staged archive is limited too
+	limited := &limitedReader{r: r, left: x.opts.maxSize}
+	encrypted, err := encryptReader(limited, stageKey)
+	if err != nil {
+		return nil, err
+	}
+	if err = x.blobs.Put(stageName, encrypted); err != nil {
+		x.blobs.Delete(stageName)
+		if limited.exceeded {
+			return nil, errArchiveTooBig
+		}
+		return nil, err
+	}
+	defer x.blobs.Delete(stageName)
+
+	blob, err := x.blobs.Get(stageName)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+	content, err := decryptReader(blob, stageKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// reader is returned also with error about insecure names (they are checked for every entry)
+	zr, err := zip.NewReader(&seekReaderAt{r: content}, content.Size())
+	if zr == nil {
+		return nil, err
+	}
+
+	results := []UploadResult{}
+	for _, f := range zr.File {
+		if isArchiveRoot(f.Name) {
+			continue
+		}
+		var result UploadResult
+		mode := f.Mode()
+		switch {
+		case mode.IsDir():
+			result = x.entry(f.Name, true, nil)
+		case mode.IsRegular():
+			rc, err := f.Open()
+			if err != nil {
+				result = UploadResult{Name: f.Name, Status: uploadError, Error: "invalid archive"}
+				break
+			}
+			result = x.entry(f.Name, false, rc)
+			rc.Close()
+		default:
+			result = UploadResult{Name: f.Name, Status: uploadError, Error: "unsupported entry type"}
+		}
+		results = append(results, result)
+		if result.Error == errArchiveTooBig.Error() {
+			break
+		}
+	}
+	return results, nil
+}
+
+// Creates directory or file (with content read from r) from archive entry
+func (x *extractor) entry(name string, isDir bool, r io.Reader) UploadResult {
+	result := UploadResult{Name: name, Status: uploadCreated}
+
+	x.entries++
+	if x.entries > maxArchiveEntries {
+		result.Status = uploadError
+		result.Error = errArchiveTooBig.Error()
+		return result
+	}
+
+	entryPath, ok := archivePath(name)
+	if !ok {
+		result.Status = uploadError
+		result.Error = "invalid entry name"
+		return result
+	}
+	result.Name = strings.Join(entryPath, "/")
+	pathNames := append(append([]string{}, x.dir...), entryPath...)
+
+	var err error
+	if isDir {
+		err = x.db.NewFile(pathNames, x.key, &models.File{IsDirectory: true}, x.userRoot)
+		if err == database.FileExists {
+			if f, gerr := x.db.GetFile(pathNames, x.key, x.userRoot); gerr == nil && f.IsDirectory {
+				result.Status = uploadExists
+				return result
+			}
+		}
+	} else {
+		limited := &limitedReader{r: r, left: x.opts.maxSize - x.written}
+		var f *models.File
+		f, err = encryptFile(limited, pathNames, x.key, x.db, x.userRoot, x.blobs, x.opts)
+		x.written += limited.read
+		if limited.exceeded {
+			err = errArchiveTooBig
+		}
+		if f != nil {
+			result.setFile(f, pathNames[len(pathNames)-1])
+		}
+	}
+	result.setError(err)
+	return result
+}
+
+// Converts name of archive entry to path inside of target directory
+// Returns false if the entry would be placed outside of it
+func archivePath(name string) ([]string, bool) {
+	if strings.Contains(name, `\`) || strings.HasPrefix(name, "/") {
+		return nil, false
+	}
+	cleaned := path.Clean(name)
+	if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return nil, false
+	}
+	return cleanPath(cleaned)
+}
+
+// Reports entries of archived directory itself (like "./" in tar archives)
+func isArchiveRoot(name string) bool {
+	return path.Clean(name) == "."
+}
+
+// limitedReader returns errArchiveTooBig after more than left bytes were read
+type limitedReader struct {
+	r        io.Reader
+	left     int64
+	read     int64
+	exceeded bool
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.left <= 0 {
+		// check if there is anything more to read
+		var b [1]byte
+		n, err := l.r.Read(b[:])
+		if n > 0 {
+			l.exceeded = true
+			return 0, errArchiveTooBig
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	l.read += int64(n)
+	return n, err
+}
+
+// seekReaderAt implements io.ReaderAt on top of io.ReadSeeker
+type seekReaderAt struct {
+	mu sync.Mutex
+	r  io.ReadSeeker
+}
+
+func (s *seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.r.Seek(off, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("seek: %w", err)
+	}
+	n, err := io.ReadFull(s.r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Uploads archive with extract option to test directory
+func uploadArchive(t *testing.T, s *Server, name string, archive []byte) (int, []UploadResult) {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	mw.WriteField("extract", "true")
+	fw, _ := mw.CreateFormFile("file", name)
+	fw.Write(archive)
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/drive/test", body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	s.uploadFile(w, req, []string{"test"}, testSession(t, "user1"))
+
+	var resp UploadResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	return w.Code, resp.Files
+}
+
+func Test_ExtractZip(t *testing.T) {
+	mockDB := MockDB{}
+	blobs := newTestStore(t, &mockDB)
+	s := Server{maxUpload: 1024 << 20, db: &mockDB, blobs: blobs}
+
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	zw.Create("docs/")
+	f, _ := zw.Create("docs/a.txt")
+	f.Write([]byte("content of a"))
+	f, _ = zw.Create("../evil.txt")
+	f.Write([]byte("evil"))
+	f, _ = zw.Create("foo.txt")
+	f.Write([]byte("conflict"))
+	assert.NoError(t, zw.Close())
+
+	status, results := uploadArchive(t, &s, "archive.zip", buf.Bytes())
+	assert.Equal(t, http.StatusMultiStatus, status)
+	assert.Equal(t, []UploadResult{
+		{Name: "docs", Status: uploadCreated},
+		{Name: "docs/a.txt", Status: uploadCreated},
+		{Name: "../evil.txt", Status: uploadError, Error: "invalid entry name"},
+		{Name: "foo.txt", Status: uploadConflict, Error: "File already exists"},
+	}, withoutETags(results))
+
+	a := mockDB.created["test/docs/a.txt"]
+	if assert.NotNil(t, a) {
+		assert.Equal(t, int64(12), a.Size)
+	}
+
+	// staged archive is removed
+	list, err := blobs.List()
+	assert.NoError(t, err)
+	assert.Len(t, list, 2)
+}
+
+func Test_ExtractTarLimit(t *testing.T) {
+	mockDB := MockDB{}
+	s := Server{maxUpload: 10, db: &mockDB, blobs: newTestStore(t, &mockDB)}
+
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range []struct{ name, content string }{{"./", ""}, {"small.txt", "1234"}, {"big.txt", "1234567890"}, {"next.txt", "1"}} {
+		h := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.content)), Typeflag: tar.TypeReg}
+		if e.name == "./" {
+			h.Typeflag = tar.TypeDir
+		}
+		tw.WriteHeader(h)
+		tw.Write([]byte(e.content))
+	}
+	tw.Close()
+	gz.Close()
+
+	status, results := uploadArchive(t, &s, "archive.tar.gz", buf.Bytes())
+	assert.Equal(t, http.StatusMultiStatus, status)
+	assert.Equal(t, []UploadResult{
+		{Name: "small.txt", Status: uploadCreated},
+		{Name: "big.txt", Status: uploadError, Error: errArchiveTooBig.Error()},
+	}, withoutETags(results))
+	assert.Nil(t, mockDB.created["test/big.txt"])
+}
+
+func Test_ArchivePath(t *testing.T) {
+	for name, expected := range map[string][]string{
+		"a/b.txt":        {"a", "b.txt"},
+		"./a/./b/":       {"a", "b"},
+		"a/../b":         {"b"},
+		"../a":           nil,
+		"/etc/passwd":    nil,
+		`..\windows.txt`: nil,
+		"a/../../b":      nil,
+	} {
+		p, ok := archivePath(name)
+		assert.Equal(t, expected != nil, ok, name)
+		assert.Equal(t, expected, p, name)
+	}
+}
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/noisersup/encryptedfs-api/auth"
+	"github.com/noisersup/encryptedfs-api/crypt"
+	"github.com/noisersup/encryptedfs-api/database"
+	l "github.com/noisersup/encryptedfs-api/logger"
+	"github.com/noisersup/encryptedfs-api/models"
+)
+
+// Handler function for POST requests on /groups
+// Creates group with a new key and its own drive, the user becomes its owner
+func (s *Server) createGroup(w http.ResponseWriter, r *http.Request, _ []string, user *auth.Session) {
+	var req GroupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		resp400(w)
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		resp400(w, "no group name provided")
+		return
+	}
+
+	pair, err := s.db.GetKeyPair(user.Username)
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+	key, err := crypt.NewKey()
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+	wrappedKey, err := crypt.SealKey(pair.Public, key)
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+
+	owner := models.GroupMember{GroupName: name, Username: user.Username, Role: models.RoleOwner, WrappedKey: wrappedKey}
+	if err = s.db.NewGroup(&owner); err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+	writeResponse(w, groupInfo(&owner), http.StatusCreated)
+}
+
+// Handler function for GET requests on /groups
+// Lists groups of the user with the user's roles
+func (s *Server) listGroups(w http.ResponseWriter, r *http.Request, _ []string, user *auth.Session) {
+	memberships, err := s.db.ListGroups(user.Username)
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+
+	groups := make([]GroupInfo, 0, len(memberships))
+	for i := range memberships {
+		groups = append(groups, groupInfo(&memberships[i]))
+	}
+	writeResponse(w, GroupsResponse{Groups: groups}, http.StatusOK)
+}
+
+// Handler function for GET requests on /groups/{id}/members
+// Lists members of the group (only for its members)
+func (s *Server) listMembers(w http.ResponseWriter, r *http.Request, paths []string, user *auth.Session) {
+	member := s.groupMember(w, paths[0], user)
+	if member == nil {
+		return
+	}
+
+	members, err := s.db.ListGroupMembers(member.GroupId)
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+
+	infos := make([]MemberInfo, 0, len(members))
+	for i := range members {
+		infos = append(infos, memberInfo(&members[i]))
+	}
+	writeResponse(w, MembersResponse{Members: infos}, http.StatusOK)
+}
+
+// Handler function for POST requests on /groups/{id}/members
+// Adds member to the group or changes role of existing member (only for owners)
+// Key of the group is sealed with public key of the member
+func (s *Server) setMember(w http.ResponseWriter, r *http.Request, paths []string, user *auth.Session) {
+	member, key := s.openGroup(w, paths[0], user)
+	if member == nil {
+		return
+	}
+	if member.Role != models.RoleOwner {
+		resp403(w, "Only owners can manage members of the group")
+		return
+	}
+
+	var req MemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		resp400(w)
+		return
+	}
+	role := models.GroupRole(req.Role)
+	switch role {
+	case "":
+		role = models.RoleViewer
+	case models.RoleOwner, models.RoleEditor, models.RoleViewer:
+	default:
+		resp400(w, "invalid role")
+		return
+	}
+
+	public := s.publicKey(w, req.Username)
+	if public == nil {
+		return
+	}
+	wrappedKey, err := crypt.SealKey(public, key)
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+
+	newMember := models.GroupMember{
+		GroupId:    member.GroupId,
+		GroupName:  member.GroupName,
+		Username:   req.Username,
+		Role:       role,
+		WrappedKey: wrappedKey,
+	}
+	if err = s.db.SetGroupMember(&newMember); err != nil {
+		if err == database.LastGroupOwner {
+			resp409(w, err.Error())
+			return
+		}
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+	writeResponse(w, memberInfo(&newMember), http.StatusOK)
+}
+
+// Handler function for DELETE requests on /groups/{id}/members/{username}
+// Removes member from the group (owners can remove anyone, other members only themselves)
+// The group gets a new key sealed for the remaining members, so the removed member can't use the old one
+// (names and keys of files are re-wrapped with it, content of files isn't re-encrypted)
+func (s *Server) removeMember(w http.ResponseWriter, r *http.Request, paths []string, user *auth.Session) {
+	member, key := s.openGroup(w, paths[0], user)
+	if member == nil {
+		return
+	}
+	if paths[1] != user.Username && member.Role != models.RoleOwner {
+		resp403(w, "Only owners can manage members of the group")
+		return
+	}
+
+	members, err := s.db.ListGroupMembers(member.GroupId)
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+	newKey, err := crypt.NewKey()
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+	sealedKeys := map[string][]byte{}
+	for _, m := range members {
+		if m.Username == paths[1] {
+			continue
+		}
+		pair, err := s.db.GetKeyPair(m.Username)
+		if err != nil {
+			l.Err("%s", err.Error())
+			resp500(w)
+			return
+		}
+		if sealedKeys[m.Username], err = crypt.SealKey(pair.Public, newKey); err != nil {
+			l.Err("%s", err.Error())
+			resp500(w)
+			return
+		}
+	}
+
+	if err = s.db.RemoveGroupMember(member.GroupId, paths[1], key, newKey, sealedKeys); err != nil {
+		switch err {
+		case database.FileNotFound:
+			resp404(w)
+		case database.LastGroupOwner, database.GroupChanged:
+			resp409(w, err.Error())
+		default:
+			l.Err("%s", err.Error())
+			resp500(w)
+		}
+		return
+	}
+	respOK(w)
+}
+
+// Gets membership of the user in group with provided id
+// If the user isn't a member of the group writes error response and returns nil
+func (s *Server) groupMember(w http.ResponseWriter, id string, user *auth.Session) *models.GroupMember {
+	groupId, err := uuid.Parse(id)
+	if err != nil {
+		resp404(w)
+		return nil
+	}
+	member, err := s.db.GetGroupMember(groupId, user.Username)
+	if err != nil {
+		if err == database.FileNotFound {
+			resp404(w)
+			return nil
+		}
+		l.Err("%s", err.Error())
+		resp500(w)
+		return nil
+	}
+	return member
+}
+
+// Gets membership of the user in group with provided id and opens key of the group
+// If the user isn't a member of the group writes error response and returns nil
+func (s *Server) openGroup(w http.ResponseWriter, id string, user *auth.Session) (*models.GroupMember, []byte) {
+	member := s.groupMember(w, id, user)
+	if member == nil {
+		return nil, nil
+	}
+
+	private, err := s.privateKey(user)
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return nil, nil
+	}
+	key, err := crypt.OpenKey(private, member.WrappedKey)
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return nil, nil
+	}
+	return member, key
+}
+
+// Opens drive of group with provided id (viewers can only read its files)
+// If the user isn't a member of the group writes error response and returns nil
+func (s *Server) openGroupDrive(w http.ResponseWriter, id string, user *auth.Session) *drive {
+	member, key := s.openGroup(w, id, user)
+	if member == nil {
+		return nil
+	}
+	return &drive{root: member.GroupId, key: key, write: member.Role != models.RoleViewer}
+}
+
+func groupInfo(member *models.GroupMember) GroupInfo {
+	return GroupInfo{
+		Id:   member.GroupId.String(),
+		Name: member.GroupName,
+		Role: string(member.Role),
+		Url:  "/groups/" + member.GroupId.String() + "/drive",
+	}
+}
+
+func memberInfo(member *models.GroupMember) MemberInfo {
+	return MemberInfo{Username: member.Username, Role: string(member.Role), AddedAt: member.AddedAt}
+}
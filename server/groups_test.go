@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/noisersup/encryptedfs-api/crypt"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Groups(t *testing.T) {
+	mockDB := MockDB{}
+	s := Server{maxUpload: 1024 << 20, db: &mockDB, blobs: newTestStore(t, &mockDB)}
+	setTestKeyPair(t, &mockDB, "user1")
+	setTestKeyPair(t, &mockDB, "user2")
+	user1 := testSession(t, "user1")
+	user2 := testSession(t, "user2")
+
+	w := httptest.NewRecorder()
+	s.createGroup(w, httptest.NewRequest(http.MethodPost, "/groups", strings.NewReader(`{"name": " "}`)), nil, user1)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	s.createGroup(w, httptest.NewRequest(http.MethodPost, "/groups", strings.NewReader(`{"name": "team"}`)), nil, user1)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var group GroupInfo
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&group))
+	assert.Equal(t, "team", group.Name)
+	assert.Equal(t, "owner", group.Role)
+	assert.Equal(t, "/groups/"+group.Id+"/drive", group.Url)
+
+	// files of the group are encrypted with key of the group
+	private, err := crypt.UnwrapKey(user1.Key, mockDB.keyPairs["user1"].WrappedPrivate)
+	assert.NoError(t, err)
+	groupKey, err := crypt.OpenKey(private, mockDB.members[0].WrappedKey)
+	assert.NoError(t, err)
+
+	mkdir := func(path string, user string) int {
+		w := httptest.NewRecorder()
+		s.uploadFile(w, httptest.NewRequest(http.MethodPost, group.Url+"/"+path, nil), []string{group.Id, path}, testSession(t, user))
+		return w.Code
+	}
+	setMember := func(body string, user string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/groups/"+group.Id+"/members", strings.NewReader(body))
+		s.setMember(w, req, []string{group.Id}, testSession(t, user))
+		return w.Code
+	}
+	removeMember := func(username string, user string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodDelete, "/groups/"+group.Id+"/members/"+username, nil)
+		s.removeMember(w, req, []string{group.Id, username}, testSession(t, user))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusCreated, mkdir("docs", "user1"))
+	assert.Equal(t, getHashOfFile([]byte("docs"), groupKey), mockDB.created["docs"].Hash)
+
+	// only members have access to the group
+	assert.Equal(t, http.StatusNotFound, mkdir("other", "user2"))
+	assert.Equal(t, http.StatusNotFound, setMember(`{"username": "user2"}`, "user2"))
+
+	assert.Equal(t, http.StatusBadRequest, setMember(`{"username": "user2", "role": "admin"}`, "user1"))
+	assert.Equal(t, http.StatusNotFound, setMember(`{"username": "nobody"}`, "user1"))
+	assert.Equal(t, http.StatusOK, setMember(`{"username": "user2"}`, "user1"))
+
+	// viewers can only read
+	w = httptest.NewRecorder()
+	s.statFile(w, httptest.NewRequest(http.MethodHead, group.Url+"/docs", nil), []string{group.Id, "docs"}, user2)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusForbidden, mkdir("other", "user2"))
+	assert.Equal(t, http.StatusForbidden, setMember(`{"username": "user2", "role": "owner"}`, "user2"))
+
+	assert.Equal(t, http.StatusOK, setMember(`{"username": "user2", "role": "editor"}`, "user1"))
+	assert.Equal(t, http.StatusCreated, mkdir("docs/sub", "user2"))
+	assert.Equal(t, getHashOfFile([]byte("sub"), groupKey), mockDB.created["docs/sub"].Hash)
+
+	w = httptest.NewRecorder()
+	s.deleteFile(w, httptest.NewRequest(http.MethodDelete, group.Url+"/docs/sub", nil), []string{group.Id, "docs/sub"}, user2)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	s.listTrash(w, httptest.NewRequest(http.MethodGet, "/groups/"+group.Id+"/trash", nil), []string{group.Id}, user2)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var trash TrashResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&trash))
+	if assert.Len(t, trash.Files, 1) {
+		assert.Equal(t, "docs/sub", trash.Files[0].Path)
+		w = httptest.NewRecorder()
+		s.restoreFile(w, httptest.NewRequest(http.MethodPost, "/groups/"+group.Id+"/trash/"+trash.Files[0].Id, nil), []string{group.Id, trash.Files[0].Id}, user2)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NotNil(t, mockDB.created["docs/sub"])
+	}
+	w = httptest.NewRecorder()
+	s.emptyTrash(w, httptest.NewRequest(http.MethodDelete, "/groups/"+group.Id+"/trash", nil), []string{group.Id}, user2)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	s.listMembers(w, httptest.NewRequest(http.MethodGet, "/groups/"+group.Id+"/members", nil), []string{group.Id}, user2)
+	var members MembersResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&members))
+	assert.Len(t, members.Members, 2)
+
+	// group can't be left without an owner
+	assert.Equal(t, http.StatusConflict, setMember(`{"username": "user1", "role": "editor"}`, "user1"))
+	assert.Equal(t, http.StatusConflict, removeMember("user1", "user1"))
+	assert.Equal(t, http.StatusForbidden, removeMember("user1", "user2"))
+
+	// removed member loses access to files of the group
+	assert.Equal(t, http.StatusOK, removeMember("user2", "user2"))
+	// and the key of the group, which is replaced for the remaining members
+	if assert.Len(t, mockDB.members, 1) {
+		newKey, err := crypt.OpenKey(private, mockDB.members[0].WrappedKey)
+		assert.NoError(t, err)
+		assert.NotEqual(t, groupKey, newKey)
+	}
+	assert.Equal(t, http.StatusNotFound, mkdir("other", "user2"))
+	assert.Equal(t, http.StatusNotFound, removeMember("user2", "user1"))
+
+	w = httptest.NewRecorder()
+	s.listGroups(w, httptest.NewRequest(http.MethodGet, "/groups", nil), nil, user1)
+	var groups GroupsResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&groups))
+	if assert.Len(t, groups.Groups, 1) {
+		assert.Equal(t, group, groups.Groups[0])
+	}
+}
@@ -0,0 +1,368 @@
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/noisersup/encryptedfs-api/auth"
+	"github.com/noisersup/encryptedfs-api/crypt"
+	"github.com/noisersup/encryptedfs-api/database"
+	l "github.com/noisersup/encryptedfs-api/logger"
+	"github.com/noisersup/encryptedfs-api/models"
+)
+
+// Header with password of share link
+const linkPasswordHeader = "X-Link-Password"
+
+// Every password is checked with memory-hard key derivation, so only limited number of wrong passwords
+// is accepted in a time window from a client (for all links) and for a link (from all clients)
+// Limit of a link is higher, so a single client can't lock the link for others
+const (
+	maxClientAttempts = 10
+	maxLinkAttempts   = 50
+	linkAttemptWindow = 15 * time.Minute
+)
+
+// Counts failed attempts shared by all servers (see auth.Auth)
+type attemptLimiter interface {
+	// Returns how long requests under key have to wait after limit of failed attempts was reached (0 if they don't)
+	RetryAfter(key string, limit int) (time.Duration, error)
+	// Counts failed attempt under key, counts expire after window
+	Fail(key string, window time.Duration) error
+}
+
+// Returns keys under which wrong passwords of the link provided by client are counted with their limits
+func linkAttemptKeys(r *http.Request, id uuid.UUID) map[string]int {
+	return map[string]int{
+		"link:" + id.String():     maxLinkAttempts,
+		"client:" + clientAddr(r): maxClientAttempts,
+	}
+}
+
+// Returns address of client which sent the request
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Handler function for POST requests on /links
+// Creates share link to file or directory and responds with its token (it can't be retrieved later)
+func (s *Server) createLink(w http.ResponseWriter, r *http.Request, _ []string, user *auth.Session) {
+	var req LinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		resp400(w)
+		return
+	}
+	path, ok := cleanPath(req.Path)
+	if !ok {
+		resp400(w, "invalid path")
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		resp400(w, "expiration time has passed")
+		return
+	}
+	if req.MaxDownloads < 0 {
+		resp400(w, "invalid maximal number of downloads")
+		return
+	}
+
+	userRoot, err := s.db.GetRoot(user.Username)
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+	// only own key of the shared file is handed out, not key of the whole drive
+	f, ownKey, err := s.db.ShareKey(path, user.Key, userRoot)
+	if err != nil {
+		switch err {
+		case database.FileNotFound:
+			resp404(w)
+		case database.LegacyFile:
+			resp409(w, err.Error())
+		default:
+			l.Err("%s", err.Error())
+			resp500(w)
+		}
+		return
+	}
+
+	token, err := crypt.NewLinkToken()
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+	wrappedKey, err := crypt.WrapKey(crypt.LinkKey(token, req.Password), ownKey)
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+
+	link := models.ShareLink{
+		TokenHash:    crypt.LinkTokenHash(token),
+		FileId:       f.Id,
+		Owner:        userRoot,
+		WrappedKey:   wrappedKey,
+		HasPassword:  req.Password != "",
+		ExpiresAt:    req.ExpiresAt,
+		MaxDownloads: req.MaxDownloads,
+	}
+	if err = s.db.NewShareLink(&link); err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+
+	info := linkInfo(&link, f, path)
+	info.Token = token
+	info.Url = "/s/" + token
+	writeResponse(w, info, http.StatusCreated)
+}
+
+// Handler function for GET requests on /links
+// Lists share links created by the user with current paths of shared files
+func (s *Server) listLinks(w http.ResponseWriter, r *http.Request, _ []string, user *auth.Session) {
+	userRoot, err := s.db.GetRoot(user.Username)
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+
+	links, err := s.db.ListShareLinks(userRoot)
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+
+	infos := make([]LinkInfo, 0, len(links))
+	for i := range links {
+		// shared file could be moved to trash in the meantime
+		f, path, err := s.db.GetFileById(links[i].FileId, user.Key, userRoot)
+		if err != nil && err != database.FileNotFound {
+			l.Err("%s", err.Error())
+			resp500(w)
+			return
+		}
+		infos = append(infos, linkInfo(&links[i], f, path))
+	}
+	writeResponse(w, LinksResponse{Links: infos}, http.StatusOK)
+}
+
+// Handler function for DELETE requests on /links/{id}
+// Revokes share link
+func (s *Server) revokeLink(w http.ResponseWriter, r *http.Request, paths []string, user *auth.Session) {
+	id, err := uuid.Parse(paths[0])
+	if err != nil {
+		resp404(w)
+		return
+	}
+
+	userRoot, err := s.db.GetRoot(user.Username)
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+
+	if err = s.db.DeleteShareLink(id, userRoot); err != nil {
+		if err == database.FileNotFound {
+			resp404(w)
+			return
+		}
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+	respOK(w)
+}
+
+// Handler function for GET requests on /s/{token}/{path}
+// Doesn't require account, password of the link is read from X-Link-Password header
+// (after too many wrong passwords of the link or of the client it responds with 429 until the time window passes)
+// Serves shared file or lists shared directory (path selects file inside of shared directory)
+// Directories can be downloaded as archives with ?archive=zip|tar.gz
+// Downloads of content (except of requests for its later part) are counted
+func (s *Server) serveLink(w http.ResponseWriter, r *http.Request, paths []string, _ *auth.Session) {
+	token := paths[0]
+	link, err := s.db.GetShareLink(crypt.LinkTokenHash(token))
+	if err != nil {
+		if err == database.FileNotFound {
+			resp404(w)
+			return
+		}
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+	if linkExpired(link) {
+		errResponse(w, http.StatusGone, database.LinkExpired.Error())
+		return
+	}
+
+	password := r.Header.Get(linkPasswordHeader)
+	if link.HasPassword && password == "" {
+		resp401(w, "Password required")
+		return
+	}
+	if link.HasPassword {
+		// password isn't checked at all while the link or the client waits for the end of the time window
+		var wait time.Duration
+		for key, limit := range linkAttemptKeys(r, link.Id) {
+			d, err := s.attempts.RetryAfter(key, limit)
+			if err != nil {
+				l.Err("%s", err.Error())
+				resp500(w)
+				return
+			}
+			if d > wait {
+				wait = d
+			}
+		}
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			errResponse(w, http.StatusTooManyRequests, "Too many wrong passwords")
+			return
+		}
+	}
+	key, err := crypt.UnwrapKey(crypt.LinkKey(token, password), link.WrappedKey)
+	if err != nil {
+		if err == crypt.ErrUnwrap {
+			for key := range linkAttemptKeys(r, link.Id) {
+				if err = s.attempts.Fail(key, linkAttemptWindow); err != nil {
+					l.Err("%s", err.Error())
+				}
+			}
+			resp401(w, "Invalid password")
+			return
+		}
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+
+	f, err := s.db.GetSharedFile(link.FileId, key, link.Owner)
+	if err == nil && paths[1] != "" {
+		sub, ok := cleanPath(paths[1])
+		if !ok {
+			resp400(w, "invalid path")
+			return
+		}
+		if !f.IsDirectory {
+			resp404(w)
+			return
+		}
+		// keys of files inside of the directory are returned wrapped with its key
+		if key, err = dirKey(f, key); err == nil {
+			f, err = s.db.GetFile(sub, key, f.Id)
+		}
+	}
+	if err != nil {
+		if err == database.FileNotFound {
+			resp404(w)
+			return
+		}
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+
+	var childKey []byte
+	if f.IsDirectory {
+		if childKey, err = dirKey(f, key); err != nil {
+			l.Err("%s", err.Error())
+			resp500(w)
+			return
+		}
+	}
+	if f.IsDirectory && !r.URL.Query().Has("archive") {
+		s.listDirectory(w, r, f.Id, childKey)
+		return
+	}
+
+	if countedDownload(r, f) {
+		if err = s.db.CountDownload(link.Id); err != nil {
+			if err == database.LinkExpired {
+				errResponse(w, http.StatusGone, err.Error())
+				return
+			}
+			l.Err("%s", err.Error())
+			resp500(w)
+			return
+		}
+	}
+
+	if f.IsDirectory {
+		s.serveArchive(w, r, f.Id, f.Name, childKey)
+		return
+	}
+	s.sendFile(w, r, f, key)
+}
+
+// Returns true if link expired or its downloads limit was reached
+func linkExpired(link *models.ShareLink) bool {
+	if link.ExpiresAt != nil && !link.ExpiresAt.After(time.Now()) {
+		return true
+	}
+	return link.MaxDownloads > 0 && link.Downloads >= link.MaxDownloads
+}
+
+// Returns false for requests continuing interrupted downloads of a file
+// (they request a single range starting after beginning of the content)
+// Range is parsed the way http.ServeContent parses it, every other request which can
+// get the content from its beginning is counted (e.g. archives and If-Range which can be ignored)
+func countedDownload(r *http.Request, f *models.File) bool {
+	ranges := r.Header.Get("Range")
+	if f.IsDirectory || ranges == "" || r.Header.Get("If-Range") != "" {
+		return true
+	}
+	if !strings.HasPrefix(ranges, "bytes=") {
+		return true
+	}
+	specs := []string{}
+	for _, spec := range strings.Split(ranges[len("bytes="):], ",") {
+		if spec = strings.TrimSpace(spec); spec != "" {
+			specs = append(specs, spec)
+		}
+	}
+	if len(specs) != 1 {
+		return true
+	}
+	i := strings.Index(specs[0], "-")
+	if i < 0 {
+		return true
+	}
+	// suffix ranges (-n) can request the whole content
+	start, err := strconv.ParseInt(strings.TrimSpace(specs[0][:i]), 10, 64)
+	return err != nil || start <= 0
+}
+
+// Converts link to response (f and path are nil if shared file doesn't exist anymore)
+func linkInfo(link *models.ShareLink, f *models.File, path []string) LinkInfo {
+	info := LinkInfo{
+		Id:           link.Id.String(),
+		Path:         strings.Join(path, "/"),
+		HasPassword:  link.HasPassword,
+		ExpiresAt:    link.ExpiresAt,
+		MaxDownloads: link.MaxDownloads,
+		Downloads:    link.Downloads,
+		CreatedAt:    link.CreatedAt,
+	}
+	if f != nil {
+		info.IsDirectory = f.IsDirectory
+	}
+	return info
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/noisersup/encryptedfs-api/crypt"
+	"github.com/noisersup/encryptedfs-api/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func createTestLink(t *testing.T, s *Server, req LinkRequest) (int, LinkInfo) {
+	body, _ := json.Marshal(req)
+	w := httptest.NewRecorder()
+	s.createLink(w, httptest.NewRequest(http.MethodPost, "/links", bytes.NewReader(body)), nil, testSession(t, "user1"))
+	var info LinkInfo
+	json.NewDecoder(w.Body).Decode(&info)
+	return w.Code, info
+}
+
+func getLink(s *Server, token, path, password string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/s/"+token+"/"+path, nil)
+	if password != "" {
+		req.Header.Set(linkPasswordHeader, password)
+	}
+	w := httptest.NewRecorder()
+	s.serveLink(w, req, []string{token, path}, nil)
+	return w
+}
+
+func Test_ShareLinkFile(t *testing.T) {
+	mockDB := MockDB{}
+	s := Server{maxUpload: 1024 << 20, db: &mockDB, blobs: newTestStore(t, &mockDB), attempts: &mockAttempts{}}
+
+	code, link := createTestLink(t, &s, LinkRequest{Path: "test/foo.txt", Password: "secret", MaxDownloads: 1})
+	assert.Equal(t, http.StatusCreated, code)
+	assert.NotEmpty(t, link.Token)
+	assert.Equal(t, "/s/"+link.Token, link.Url)
+	assert.True(t, link.HasPassword)
+	// only hash of the token is stored
+	assert.NotEqual(t, link.Token, mockDB.links[0].TokenHash)
+	// and only own key of the shared file is wrapped for the link
+	key, err := crypt.UnwrapKey(crypt.LinkKey(link.Token, "secret"), mockDB.links[0].WrappedKey)
+	assert.NoError(t, err)
+	assert.NotEqual(t, testSession(t, "user1").Key, key)
+
+	assert.Equal(t, http.StatusUnauthorized, getLink(&s, link.Token, "", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, getLink(&s, link.Token, "", "wrong").Code)
+	assert.Equal(t, http.StatusNotFound, getLink(&s, link.Token+"x", "", "secret").Code)
+
+	w := getLink(&s, link.Token, "", "secret")
+	assert.Equal(t, http.StatusOK, w.Code)
+	data, _ := ioutil.ReadAll(w.Body)
+	assert.Equal(t, "foo.txt content\n", string(data))
+
+	// downloads limit is reached
+	assert.Equal(t, http.StatusGone, getLink(&s, link.Token, "", "secret").Code)
+
+	w = httptest.NewRecorder()
+	s.listLinks(w, httptest.NewRequest(http.MethodGet, "/links", nil), nil, testSession(t, "user1"))
+	var links LinksResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&links))
+	if assert.Len(t, links.Links, 1) {
+		assert.Equal(t, link.Id, links.Links[0].Id)
+		assert.Equal(t, "test/foo.txt", links.Links[0].Path)
+		assert.Equal(t, 1, links.Links[0].Downloads)
+		assert.Empty(t, links.Links[0].Token)
+	}
+
+	w = httptest.NewRecorder()
+	s.revokeLink(w, httptest.NewRequest(http.MethodDelete, "/links/"+link.Id, nil), []string{link.Id}, testSession(t, "user1"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, mockDB.links)
+}
+
+func Test_ShareLinkDirectory(t *testing.T) {
+	mockDB := MockDB{}
+	s := Server{maxUpload: 1024 << 20, db: &mockDB, blobs: newTestStore(t, &mockDB), attempts: &mockAttempts{}}
+
+	code, _ := createTestLink(t, &s, LinkRequest{Path: "test", ExpiresAt: &time.Time{}})
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = createTestLink(t, &s, LinkRequest{Path: "missing"})
+	assert.Equal(t, http.StatusNotFound, code)
+
+	expires := time.Now().Add(time.Hour)
+	code, link := createTestLink(t, &s, LinkRequest{Path: "test", ExpiresAt: &expires})
+	assert.Equal(t, http.StatusCreated, code)
+	assert.True(t, link.IsDirectory)
+
+	w := getLink(&s, link.Token, "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var list ListFilesResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+	if assert.Len(t, list.Files, 1) {
+		assert.Equal(t, "foo.txt", list.Files[0].Name)
+	}
+
+	w = getLink(&s, link.Token, "foo.txt", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	data, _ := ioutil.ReadAll(w.Body)
+	assert.Equal(t, "foo.txt content\n", string(data))
+
+	assert.Equal(t, http.StatusBadRequest, getLink(&s, link.Token, "../bar.md", "").Code)
+	assert.Equal(t, http.StatusNotFound, getLink(&s, link.Token, "bar.md", "").Code)
+
+	past := time.Now().Add(-time.Minute)
+	mockDB.links[0].ExpiresAt = &past
+	assert.Equal(t, http.StatusGone, getLink(&s, link.Token, "foo.txt", "").Code)
+}
+
+func Test_ShareLinkPasswordAttempts(t *testing.T) {
+	mockDB := MockDB{}
+	attempts := mockAttempts{}
+	s := Server{maxUpload: 1024 << 20, db: &mockDB, blobs: newTestStore(t, &mockDB), attempts: &attempts}
+
+	code, link := createTestLink(t, &s, LinkRequest{Path: "test/foo.txt", Password: "secret"})
+	assert.Equal(t, http.StatusCreated, code)
+	code, other := createTestLink(t, &s, LinkRequest{Path: "test/foo.txt", Password: "other"})
+	assert.Equal(t, http.StatusCreated, code)
+
+	for i := 0; i < maxClientAttempts; i++ {
+		assert.Equal(t, http.StatusUnauthorized, getLink(&s, link.Token, "", "wrong").Code)
+	}
+	// even the right password isn't checked until the time window passes
+	w := getLink(&s, link.Token, "", "secret")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	// for any link of the client
+	assert.Equal(t, http.StatusTooManyRequests, getLink(&s, other.Token, "", "other").Code)
+	// while other clients can still use the link
+	assert.Equal(t, http.StatusOK, getLinkFrom(&s, "198.51.100.1:1234", link.Token, "secret").Code)
+
+	// wrong passwords from many clients lock the link
+	for i := maxClientAttempts; i < maxLinkAttempts; i++ {
+		addr := fmt.Sprintf("198.51.100.%d:1234", 2+i/maxClientAttempts)
+		assert.Equal(t, http.StatusUnauthorized, getLinkFrom(&s, addr, link.Token, "wrong").Code)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, getLinkFrom(&s, "203.0.113.1:1234", link.Token, "secret").Code)
+	assert.Equal(t, http.StatusOK, getLinkFrom(&s, "203.0.113.1:1234", other.Token, "other").Code)
+
+	attempts.failures = nil
+	assert.Equal(t, http.StatusOK, getLink(&s, link.Token, "", "secret").Code)
+}
+
+func getLinkFrom(s *Server, addr, token, password string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/s/"+token+"/", nil)
+	req.RemoteAddr = addr
+	req.Header.Set(linkPasswordHeader, password)
+	w := httptest.NewRecorder()
+	s.serveLink(w, req, []string{token, ""}, nil)
+	return w
+}
+
+// Counts failed attempts in memory (time window never passes)
+type mockAttempts struct {
+	failures map[string]int
+}
+
+func (m *mockAttempts) RetryAfter(key string, limit int) (time.Duration, error) {
+	if m.failures[key] < limit {
+		return 0, nil
+	}
+	return linkAttemptWindow, nil
+}
+
+func (m *mockAttempts) Fail(key string, window time.Duration) error {
+	if m.failures == nil {
+		m.failures = map[string]int{}
+	}
+	m.failures[key]++
+	return nil
+}
+
+func Test_CountedDownload(t *testing.T) {
+	file := &models.File{Name: "foo.txt"}
+	for ranges, counted := range map[string]bool{
+		"":               true,
+		"bytes=0-":       true,
+		"bytes= 0-":      true,
+		"bytes=0-0":      true,
+		"bytes=-100":     true,
+		"bytes=1-,0-0":   true,
+		"bytes=100-,0-":  true,
+		"items=1-":       true,
+		"bytes=1-":       false,
+		"bytes= 1-":      false,
+		"bytes=100-199":  false,
+		"bytes=100-199,": false,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/s/token/", nil)
+		if ranges != "" {
+			req.Header.Set("Range", ranges)
+		}
+		assert.Equal(t, counted, countedDownload(req, file), ranges)
+	}
+
+	// If-Range can make the server ignore the range
+	req := httptest.NewRequest(http.MethodGet, "/s/token/", nil)
+	req.Header.Set("Range", "bytes=1-")
+	req.Header.Set("If-Range", `"etag"`)
+	assert.True(t, countedDownload(req, file))
+	// archives are always sent whole
+	req.Header.Del("If-Range")
+	assert.True(t, countedDownload(req, &models.File{Name: "dir", IsDirectory: true}))
+}
@@ -1,5 +1,7 @@
 package server
 
+import "time"
+
 // RESPONSES
 
 type ErrResponse struct {
@@ -7,13 +9,123 @@ type ErrResponse struct {
 }
 
 type ListFilesResponse struct {
-	Files []ListedFile `json:"files"`
-	Error string       `json:"error"`
+	Files      []ListedFile `json:"files"`
+	NextCursor string       `json:"nextCursor,omitempty"` // cursor of the next page (empty on the last page)
+	Error      string       `json:"error"`
 }
 
 type ListedFile struct {
-	Name        string `json:"name"`
-	IsDirectory bool   `json:"isDirectory"`
+	Name        string    `json:"name"`
+	Path        string    `json:"path,omitempty"` // path relative to listed directory (only in recursive listings and search), original path in trash
+	IsDirectory bool      `json:"isDirectory"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"contentType,omitempty"`
+	Checksum    string    `json:"checksum,omitempty"` // hex encoded SHA-256 of content
+	CreatedAt   time.Time `json:"createdAt"`
+	ModifiedAt  time.Time `json:"modifiedAt"`
+}
+
+type TrashResponse struct {
+	Files []TrashedFile `json:"files"`
+	Error string        `json:"error"`
+}
+
+type TrashedFile struct {
+	Id string `json:"id"`
+	ListedFile
+	DeletedAt time.Time  `json:"deletedAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"` // when the file will be purged from trash
+}
+
+type RestoreResponse struct {
+	Path  string `json:"path"` // path to which the file was restored
+	Error string `json:"error"`
+}
+
+type VersionsResponse struct {
+	Versions []FileVersion `json:"versions"`
+	Error    string        `json:"error"`
+}
+
+type FileVersion struct {
+	Version     int64     `json:"version"`
+	Current     bool      `json:"current"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"contentType,omitempty"`
+	Checksum    string    `json:"checksum,omitempty"` // hex encoded SHA-256 of content
+	ModifiedAt  time.Time `json:"modifiedAt"`         // when the version was created
+	ETag        string    `json:"etag"`
+}
+
+type LinksResponse struct {
+	Links []LinkInfo `json:"links"`
+	Error string     `json:"error"`
+}
+
+type LinkInfo struct {
+	Id           string     `json:"id"`
+	Token        string     `json:"token,omitempty"` // only in response to creation of the link
+	Url          string     `json:"url,omitempty"`   // only in response to creation of the link
+	Path         string     `json:"path"`            // current path of shared file (empty if it was deleted)
+	IsDirectory  bool       `json:"isDirectory"`
+	HasPassword  bool       `json:"hasPassword"`
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+	MaxDownloads int        `json:"maxDownloads,omitempty"`
+	Downloads    int        `json:"downloads"`
+	CreatedAt    time.Time  `json:"createdAt"`
+}
+
+type SharesResponse struct {
+	Shares []ShareInfo `json:"shares"`
+	Error  string      `json:"error"`
+}
+
+type ShareInfo struct {
+	Id          string    `json:"id"`
+	Url         string    `json:"url"`            // location of shared file for the recipient
+	Name        string    `json:"name,omitempty"` // name of shared file (empty if it was deleted)
+	Path        string    `json:"path,omitempty"` // current path of shared file (only for its owner)
+	IsDirectory bool      `json:"isDirectory"`
+	Owner       string    `json:"owner"`
+	Recipient   string    `json:"recipient"`
+	Permission  string    `json:"permission"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+type GroupsResponse struct {
+	Groups []GroupInfo `json:"groups"`
+	Error  string      `json:"error"`
+}
+
+type GroupInfo struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	Role string `json:"role"` // role of the user in the group
+	Url  string `json:"url"`  // location of drive of the group
+}
+
+type MembersResponse struct {
+	Members []MemberInfo `json:"members"`
+	Error   string       `json:"error"`
+}
+
+type MemberInfo struct {
+	Username string    `json:"username"`
+	Role     string    `json:"role"`
+	AddedAt  time.Time `json:"addedAt"`
+}
+
+type UploadResponse struct {
+	Files []UploadResult `json:"files"`
+	Error string         `json:"error"`
+}
+
+type UploadResult struct {
+	Name      string `json:"name"`
+	Status    string `json:"status"` // created, replaced, exists, conflict, precondition failed or error
+	ETag      string `json:"etag,omitempty"`
+	RenamedTo string `json:"renamedTo,omitempty"` // name under which the file was stored if it was renamed
+	Error     string `json:"error,omitempty"`
 }
 
 // REQUESTS
@@ -21,3 +133,34 @@ type Credentials struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
 }
+
+// body of POST /links requests
+type LinkRequest struct {
+	Path         string     `json:"path"`
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+	Password     string     `json:"password,omitempty"`
+	MaxDownloads int        `json:"maxDownloads,omitempty"`
+}
+
+// body of POST /shares requests
+type ShareRequest struct {
+	Path       string `json:"path"`
+	Username   string `json:"username"`             // user with whom the file is shared
+	Permission string `json:"permission,omitempty"` // read (default) or write
+}
+
+// body of POST /groups requests
+type GroupRequest struct {
+	Name string `json:"name"`
+}
+
+// body of POST /groups/{id}/members requests
+type MemberRequest struct {
+	Username string `json:"username"`
+	Role     string `json:"role,omitempty"` // owner, editor or viewer (default)
+}
+
+// body of MOVE and COPY requests
+type DestinationRequest struct {
+	Destination string `json:"destination"`
+}
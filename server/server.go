@@ -6,16 +6,19 @@ import (
 	"log"
 	"mime"
 	"net/http"
-	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/noisersup/encryptedfs-api/auth"
 	"github.com/noisersup/encryptedfs-api/database"
 	l "github.com/noisersup/encryptedfs-api/logger"
 	"github.com/noisersup/encryptedfs-api/models"
+	"github.com/noisersup/encryptedfs-api/storage"
 )
 
 // Server is a structure responsible for handling all http requests.
@@ -23,33 +26,83 @@ type Server struct {
 	maxUpload int64 //TODO: implement maxuploads
 	db        models.Database
 	auth      *auth.Auth
-	filesPath string
+	blobs     storage.BlobStore
+
+	trashRetention time.Duration           // how long deleted files are kept in trash (forever if not positive)
+	versions       models.VersionRetention // rules of removing old versions of files
+
+	uploadLocks sync.Map       // locks of resumable uploads being written
+	attempts    attemptLimiter // wrong passwords of share links
 }
 
-func InitServer(db models.Database, cacheHost string, filesPath ...string) error {
-	a, err := auth.InitAuth(db, cacheHost)
+// sessionSecret protects user keys kept in sessions
+// trashRetention is time after which deleted files are purged from trash (never if not positive)
+// versions are rules of removing old versions of files
+func InitServer(db models.Database, blobs storage.BlobStore, cacheHost string, sessionSecret []byte, trashRetention time.Duration, versions models.VersionRetention) error {
+	a, err := auth.InitAuth(db, cacheHost, sessionSecret)
 	if err != nil {
 		return err
 	}
 
-	s := Server{maxUpload: 1024 << 20, db: db, auth: a}
-
-	if len(filesPath) == 0 {
-		s.filesPath = "./files"
-	} else {
-		s.filesPath = filesPath[0]
-	}
+	s := &Server{maxUpload: 1024 << 20, db: db, auth: a, blobs: blobs, attempts: a, trashRetention: trashRetention, versions: versions}
+	go s.cleanup(cleanupInterval)
 
 	//Handle requests
 	handlers := []struct {
 		regex      *regexp.Regexp
 		methods    []string
-		handle     func(w http.ResponseWriter, r *http.Request, paths []string, user string) // paths are regex matches (in this example they capture the storage server paths)
+		handle     func(w http.ResponseWriter, r *http.Request, paths []string, user *auth.Session) // paths are regex matches (in this example they capture the storage server paths)
 		authNeeded bool
 	}{
-		{regexp.MustCompile(`^/drive(?:/(.*[^/]))?$`), []string{"POST"}, s.uploadFile, true}, // /drive/path/of/target/directory ex. posting d.jpg with /drive/images/ will put to images/d.jpg and /drive/ will result with puting to root dir
-		{regexp.MustCompile(`^/drive(?:/(.*[^/]))?$`), []string{"GET"}, s.GetFile, true},
-		{regexp.MustCompile(`^/drive/(.*[^/])$`), []string{"DELETE"}, s.deleteFile, true},
+		{regexp.MustCompile(`^/drive(?:/(.*[^/]))?$`), []string{"POST"}, s.uploadFile, true}, // /drive/path/of/target/directory ex. posting d.jpg with /drive/images/ will put to images/d.jpg and /drive/ will result with puting to root dir, /drive/path/of/file?promote=N makes version N current
+		{regexp.MustCompile(`^/drive(?:/(.*[^/]))?$`), []string{"GET"}, s.GetFile, true},     // with ?stat query returns only metadata of the file, with ?archive=zip|tar.gz (and &select=path...) directory as archive, with ?versions versions of the file and with ?version=N its content
+		{regexp.MustCompile(`^/drive(?:/(.*[^/]))?$`), []string{"HEAD"}, s.statFile, true},
+		{regexp.MustCompile(`^/drive/(.*[^/])$`), []string{"DELETE"}, s.deleteFile, true},      // moves file to trash, with ?permanent deletes it permanently
+		{regexp.MustCompile(`^/drive/(.*[^/])$`), []string{"MOVE", "PATCH"}, s.moveFile, true}, // body {"destination": "new/path/of/file"}
+		{regexp.MustCompile(`^/drive/(.*[^/])$`), []string{"COPY"}, s.copyFile, true},          // body {"destination": "path/of/copy"}
+		{regexp.MustCompile(`^/search$`), []string{"GET"}, s.search, true},                     // ?q=text&mode=substring|prefix|glob&path=scope/directory&limit=100
+		{regexp.MustCompile(`^/trash$`), []string{"GET"}, s.listTrash, true},
+		{regexp.MustCompile(`^/trash$`), []string{"DELETE"}, s.emptyTrash, true},
+		{regexp.MustCompile(`^/trash/([^/]+)$`), []string{"POST"}, s.restoreFile, true}, // restores file to its original path
+		{regexp.MustCompile(`^/trash/([^/]+)$`), []string{"DELETE"}, s.deleteFromTrash, true},
+		{regexp.MustCompile(`^/trash/shared/([^/]+)$`), []string{"GET"}, s.listTrash, true}, // files deleted inside of directory shared with the user (restoring and deleting them requires write permission)
+		{regexp.MustCompile(`^/trash/shared/([^/]+)$`), []string{"DELETE"}, s.emptyTrash, true},
+		{regexp.MustCompile(`^/trash/shared/([^/]+)/([^/]+)$`), []string{"POST"}, s.restoreFile, true},
+		{regexp.MustCompile(`^/trash/shared/([^/]+)/([^/]+)$`), []string{"DELETE"}, s.deleteFromTrash, true},
+		{regexp.MustCompile(`^/links$`), []string{"GET"}, s.listLinks, true},
+		{regexp.MustCompile(`^/links$`), []string{"POST"}, s.createLink, true}, // body {"path": "shared/file", "expiresAt": "2006-01-02T15:04:05Z", "password": "...", "maxDownloads": 10}
+		{regexp.MustCompile(`^/links/([^/]+)$`), []string{"DELETE"}, s.revokeLink, true},
+		{regexp.MustCompile(`^/s/([^/]+)(?:/(.*[^/]))?$`), []string{"GET"}, s.serveLink, false},   // /s/token/path/inside/of/shared/directory
+		{regexp.MustCompile(`^/shares$`), []string{"GET"}, s.listShares, true},                    // files shared by the user
+		{regexp.MustCompile(`^/shares$`), []string{"POST"}, s.createShare, true},                  // body {"path": "shared/file", "username": "recipient", "permission": "read|write"}
+		{regexp.MustCompile(`^/shares/([^/]+)$`), []string{"DELETE"}, s.deleteShare, true},        // revokes share (or removes file from files shared with the user)
+		{regexp.MustCompile(`^/shared$`), []string{"GET"}, s.listSharedWithMe, true},              // files shared with the user
+		{regexp.MustCompile(`^/shared/([^/]+)(?:/(.*[^/]))?$`), []string{"GET"}, s.GetFile, true}, // /shared/id/path/inside/of/shared/directory accepts the same requests as /drive
+		{regexp.MustCompile(`^/shared/([^/]+)(?:/(.*[^/]))?$`), []string{"HEAD"}, s.statFile, true},
+		{regexp.MustCompile(`^/shared/([^/]+)(?:/(.*[^/]))?$`), []string{"POST"}, s.uploadFile, true},        // requires write permission
+		{regexp.MustCompile(`^/shared/([^/]+)(?:/(.*[^/]))?$`), []string{"DELETE"}, s.deleteFile, true},      // deleted files are moved to trash of the shared directory (/trash/shared/id)
+		{regexp.MustCompile(`^/shared/([^/]+)(?:/(.*[^/]))?$`), []string{"MOVE", "PATCH"}, s.moveFile, true}, // destination is relative to the shared directory
+		{regexp.MustCompile(`^/shared/([^/]+)(?:/(.*[^/]))?$`), []string{"COPY"}, s.copyFile, true},
+		{regexp.MustCompile(`^/groups$`), []string{"GET"}, s.listGroups, true},
+		{regexp.MustCompile(`^/groups$`), []string{"POST"}, s.createGroup, true}, // body {"name": "team"}
+		{regexp.MustCompile(`^/groups/([^/]+)/members$`), []string{"GET"}, s.listMembers, true},
+		{regexp.MustCompile(`^/groups/([^/]+)/members$`), []string{"POST"}, s.setMember, true},              // body {"username": "member", "role": "owner|editor|viewer"}
+		{regexp.MustCompile(`^/groups/([^/]+)/members/([^/]+)$`), []string{"DELETE"}, s.removeMember, true}, // owners remove members, other members can leave
+		{regexp.MustCompile(`^/groups/([^/]+)/drive(?:/(.*[^/]))?$`), []string{"GET"}, s.GetFile, true},     // /groups/id/drive/path accepts the same requests as /drive (viewers can only read)
+		{regexp.MustCompile(`^/groups/([^/]+)/drive(?:/(.*[^/]))?$`), []string{"HEAD"}, s.statFile, true},
+		{regexp.MustCompile(`^/groups/([^/]+)/drive(?:/(.*[^/]))?$`), []string{"POST"}, s.uploadFile, true},
+		{regexp.MustCompile(`^/groups/([^/]+)/drive/(.*[^/])$`), []string{"DELETE"}, s.deleteFile, true},
+		{regexp.MustCompile(`^/groups/([^/]+)/drive/(.*[^/])$`), []string{"MOVE", "PATCH"}, s.moveFile, true},
+		{regexp.MustCompile(`^/groups/([^/]+)/drive/(.*[^/])$`), []string{"COPY"}, s.copyFile, true},
+		{regexp.MustCompile(`^/groups/([^/]+)/trash$`), []string{"GET"}, s.listTrash, true}, // files deleted from drive of the group (restoring and deleting them requires editor role)
+		{regexp.MustCompile(`^/groups/([^/]+)/trash$`), []string{"DELETE"}, s.emptyTrash, true},
+		{regexp.MustCompile(`^/groups/([^/]+)/trash/([^/]+)$`), []string{"POST"}, s.restoreFile, true},
+		{regexp.MustCompile(`^/groups/([^/]+)/trash/([^/]+)$`), []string{"DELETE"}, s.deleteFromTrash, true},
+		{regexp.MustCompile(`^/uploads$`), []string{"OPTIONS"}, s.uploadOptions, false},
+		{regexp.MustCompile(`^/uploads$`), []string{"POST"}, s.createUpload, true},
+		{regexp.MustCompile(`^/uploads/([^/]+)$`), []string{"HEAD"}, s.headUpload, true},
+		{regexp.MustCompile(`^/uploads/([^/]+)$`), []string{"PATCH"}, s.patchUpload, true},
+		{regexp.MustCompile(`^/uploads/([^/]+)$`), []string{"DELETE"}, s.terminateUpload, true},
 		{regexp.MustCompile(`^/signin$`), []string{"POST"}, s.signIn, false},
 		{regexp.MustCompile(`^/signup$`), []string{"POST"}, s.signUp, false},
 		{regexp.MustCompile(`^/refresh$`), []string{"POST"}, s.refresh, true},
@@ -66,10 +119,10 @@ func InitServer(db models.Database, cacheHost string, filesPath ...string) error
 			}
 			for _, allowed := range handler.methods {
 				if r.Method == allowed {
-					var authResp string
+					var authResp *auth.Session
 					if handler.authNeeded {
 						authResp = a.Authorize(w, r)
-						if authResp == "" {
+						if authResp == nil {
 							return
 						}
 					}
@@ -88,73 +141,111 @@ func InitServer(db models.Database, cacheHost string, filesPath ...string) error
 	return http.ListenAndServe(fmt.Sprintf(":%d", port), http.HandlerFunc(hanFunc))
 }
 
+// How often expired files are purged from trash and old versions are removed
+const cleanupInterval = time.Hour
+
+// Periodically purges files kept in trash longer than retention period,
+// removes old versions of files according to retention rules and expired uploads
+// Never returns, so it should be run in a separate goroutine
+func (s *Server) cleanup(interval time.Duration) {
+	for {
+		if s.trashRetention > 0 {
+			n, err := s.db.PurgeTrash(time.Now().Add(-s.trashRetention))
+			if err != nil {
+				l.Err("purging trash: %s", err.Error())
+			} else if n > 0 {
+				l.Log("%d expired files purged from trash", n)
+			}
+		}
+		if s.versions.Keep > 0 || s.versions.MaxAge > 0 {
+			n, err := s.db.PruneVersions(s.versions)
+			if err != nil {
+				l.Err("pruning versions: %s", err.Error())
+			} else if n > 0 {
+				l.Log("%d old versions of files removed", n)
+			}
+		}
+		n, err := s.purgeUploads(time.Now().Add(-uploadExpiration))
+		if err != nil {
+			l.Err("purging uploads: %s", err.Error())
+		} else if n > 0 {
+			l.Log("%d expired uploads removed", n)
+		}
+		time.Sleep(interval)
+	}
+}
+
 //
 //
 //
 
 // Handler function for GET requests.
 // Decrypts file and send it in chunks to user
-func (s *Server) GetFile(w http.ResponseWriter, r *http.Request, paths []string, user string) {
-	l.Log(user)
+func (s *Server) GetFile(w http.ResponseWriter, r *http.Request, paths []string, user *auth.Session) {
+	l.Log(user.Username)
 	l.LogV("Fetching file...")
 
-	path := database.PathToArr(paths[0])
-
-	userRoot, err := s.db.GetRoot(user)
-	if err != nil {
-		l.Err("%s", err.Error())
-		resp500(w)
+	d, path := s.openPath(w, r, paths, user)
+	if d == nil {
+		return
 	}
 
-	if len(path) == 0 {
-		l.LogV("Listing root directory")
-		files, err := s.db.ListDirectory(userRoot)
-		if err != nil {
-			if err == database.FileNotFound {
-				resp404(w, "Directory is empty")
-				return
-			}
-			l.Err(err.Error())
+	// root of shared drive is the shared file itself
+	if len(path) == 0 && d.entry == nil {
+		if r.URL.Query().Has("archive") {
+			s.serveArchive(w, r, d.root, "drive", d.key)
 			return
 		}
-		outFiles := []ListedFile{}
-		for _, f := range files {
-			outFiles = append(outFiles, ListedFile{f.Name, f.IsDirectory})
-		}
-		writeResponse(w, ListFilesResponse{outFiles, ""}, http.StatusOK)
+		l.LogV("Listing root directory")
+		s.listDirectory(w, r, d.root, d.key)
 		return
 	}
 
 	l.LogV("Getting file")
-	f, err := s.db.GetFile(path, userRoot)
+	f, err := s.db.GetFile(path, d.key, d.root)
 	if err != nil {
 		resp404(w)
 		return
 	}
+	if r.URL.Query().Has("versions") || r.URL.Query().Has("version") {
+		if f.IsDirectory {
+			resp400(w, "directory has no versions")
+			return
+		}
+		if r.URL.Query().Has("versions") {
+			s.listVersions(w, path, d)
+			return
+		}
+		if f = s.getVersion(w, r.URL.Query().Get("version"), path, d); f == nil {
+			return
+		}
+	}
+	if r.URL.Query().Has("stat") {
+		writeResponse(w, listedFile(f), http.StatusOK)
+		return
+	}
 	if f.IsDirectory {
-		l.LogV("Listing directory")
-		files, err := s.db.ListDirectory(f.Id)
+		key, err := dirKey(f, d.key)
 		if err != nil {
-			l.Err(err.Error())
+			l.Err("%s", err.Error())
 			resp500(w)
 			return
 		}
-		outFiles := []ListedFile{}
-		for _, f := range files {
-			outFiles = append(outFiles, ListedFile{f.Name, f.IsDirectory})
+		if r.URL.Query().Has("archive") {
+			s.serveArchive(w, r, f.Id, f.Name, key)
+			return
 		}
-		writeResponse(w, ListFilesResponse{outFiles, ""}, http.StatusOK)
+		l.LogV("Listing directory")
+		s.listDirectory(w, r, f.Id, key)
 		return
 	}
 
-	var filePath string
-	if f.Duplicate == 0 {
-		filePath = fmt.Sprintf("%s/%s", s.filesPath, f.Hash)
-	} else {
-		filePath = fmt.Sprintf("%s/%s%d", s.filesPath, f.Hash, f.Duplicate)
-	}
+	s.sendFile(w, r, f, d.key)
+}
 
-	key, err := s.db.GetKey(user)
+// Decrypts content of file with data key unwrapped with userKey and sends it
+func (s *Server) sendFile(w http.ResponseWriter, r *http.Request, f *models.File, userKey []byte) {
+	dataKey, err := fileKey(f, userKey)
 	if err != nil {
 		l.Err("%s", err.Error())
 		resp500(w)
@@ -162,12 +253,15 @@ func (s *Server) GetFile(w http.ResponseWriter, r *http.Request, paths []string,
 	}
 
 	l.LogV("Serving file")
-	err, status := serveFile(w, filePath, f.Name, key)
+	err, status := serveFile(w, r, s.blobs, f, dataKey)
 	if err != nil {
 		switch status {
+		case http.StatusOK:
+			// response is already (partially) sent
+			l.Err("getFile transfer of %s interrupted: %s", f.BlobName(), err.Error())
 		case http.StatusNotFound:
 			resp404(w, "File not found")
-			l.Err("File %s not found [error: %s]", filePath, err.Error())
+			l.Err("File %s not found [error: %s]", f.BlobName(), err.Error())
 			break
 		case http.StatusInternalServerError:
 			resp500(w)
@@ -182,7 +276,247 @@ func (s *Server) GetFile(w http.ResponseWriter, r *http.Request, paths []string,
 	l.LogV("File transfer done!")
 }
 
-func (s *Server) logout(w http.ResponseWriter, r *http.Request, paths []string, user string) {
+// Writes page of directory with provided id
+// Listing is controlled by query parameters:
+// limit, cursor (nextCursor of the previous page), sort (name, size or modified),
+// order (asc or desc) and type (file or directory)
+// Pages sorted by size or modified are read with index, but names are encrypted,
+// so every page sorted by name (the default) decrypts names of the whole directory
+// With recursive parameter the whole subtree is listed (see listTree)
+func (s *Server) listDirectory(w http.ResponseWriter, r *http.Request, id uuid.UUID, key []byte) {
+	query := r.URL.Query()
+	if query.Has("recursive") {
+		s.listTree(w, r, id, key)
+		return
+	}
+	opts := models.ListOptions{
+		Cursor: query.Get("cursor"),
+		SortBy: query.Get("sort"),
+		Type:   query.Get("type"),
+	}
+	if limit := query.Get("limit"); limit != "" {
+		var err error
+		if opts.Limit, err = strconv.Atoi(limit); err != nil || opts.Limit <= 0 {
+			resp400(w, "invalid limit")
+			return
+		}
+	}
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		opts.Desc = true
+	default:
+		resp400(w, "invalid order")
+		return
+	}
+
+	page, err := s.db.ListDirectoryPage(id, key, opts)
+	if err != nil {
+		if err == database.InvalidCursor || err == database.InvalidListOptions {
+			resp400(w, err.Error())
+			return
+		}
+		l.Err(err.Error())
+		resp500(w)
+		return
+	}
+
+	outFiles := []ListedFile{}
+	for _, f := range page.Files {
+		outFiles = append(outFiles, listedFile(&f))
+	}
+	writeResponse(w, ListFilesResponse{Files: outFiles, NextCursor: page.NextCursor}, http.StatusOK)
+}
+
+// Streams the whole subtree of directory with provided id as NDJSON
+// (one ListedFile with path relative to the directory per line)
+// depth query parameter limits depth of listing (1 lists only direct children)
+func (s *Server) listTree(w http.ResponseWriter, r *http.Request, id uuid.UUID, key []byte) {
+	maxDepth := 0
+	if depth := r.URL.Query().Get("depth"); depth != "" {
+		var err error
+		if maxDepth, err = strconv.Atoi(depth); err != nil || maxDepth <= 0 {
+			resp400(w, "invalid depth")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	n := 0
+	err := s.db.ListTree(id, key, maxDepth, func(path []string, f *models.File) error {
+		entry := listedFile(f)
+		entry.Path = strings.Join(path, "/")
+		if err := enc.Encode(entry); err != nil {
+			return err
+		}
+		n++
+		if n%100 == 0 && flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		// status is already sent with the first entry
+		l.Err("listing tree: %s", err.Error())
+		if n == 0 {
+			resp500(w)
+			return
+		}
+		enc.Encode(ErrResponse{"Internal server error"})
+	}
+}
+
+// Handler function for GET /search requests.
+// Finds files with names matching query (q) in directory (path, root by default) and its subdirectories
+// Returns found files with their full paths
+func (s *Server) search(w http.ResponseWriter, r *http.Request, _ []string, user *auth.Session) {
+	query := r.URL.Query()
+	q := models.SearchQuery{Pattern: query.Get("q"), Mode: query.Get("mode")}
+	if limit := query.Get("limit"); limit != "" {
+		var err error
+		if q.Limit, err = strconv.Atoi(limit); err != nil || q.Limit <= 0 {
+			resp400(w, "invalid limit")
+			return
+		}
+	}
+
+	dir, err := s.db.GetRoot(user.Username)
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+
+	key := user.Key
+	scope := []string{}
+	if p := query.Get("path"); strings.Trim(p, "/") != "" {
+		var ok bool
+		if scope, ok = cleanPath(p); !ok {
+			resp400(w, "invalid path")
+			return
+		}
+		f, err := s.db.GetFile(scope, user.Key, dir)
+		if err != nil {
+			if err == database.FileNotFound {
+				resp404(w)
+				return
+			}
+			l.Err("%s", err.Error())
+			resp500(w)
+			return
+		}
+		if !f.IsDirectory {
+			resp400(w, "path is not a directory")
+			return
+		}
+		dir = f.Id
+		if key, err = dirKey(f, user.Key); err != nil {
+			l.Err("%s", err.Error())
+			resp500(w)
+			return
+		}
+	}
+
+	results, err := s.db.SearchFiles(dir, key, q)
+	if err != nil {
+		if err == database.InvalidSearch {
+			resp400(w, err.Error())
+			return
+		}
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+
+	outFiles := []ListedFile{}
+	for _, res := range results {
+		entry := listedFile(&res.File)
+		entry.Path = strings.Join(append(append([]string{}, scope...), res.Path...), "/")
+		outFiles = append(outFiles, entry)
+	}
+	writeResponse(w, ListFilesResponse{Files: outFiles}, http.StatusOK)
+}
+
+// Handler function for HEAD requests.
+// Returns metadata of file in headers without touching its content
+func (s *Server) statFile(w http.ResponseWriter, r *http.Request, paths []string, user *auth.Session) {
+	d, path := s.openPath(w, r, paths, user)
+	if d == nil {
+		return
+	}
+	if len(path) == 0 && d.entry == nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	f, err := s.db.GetFile(path, d.key, d.root)
+	if err != nil {
+		if err == database.FileNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		l.Err("%s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	setFileHeaders(w, f)
+	if !f.IsDirectory {
+		if notModified(r, f) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(f.Size, 10))
+		w.Header().Set("Accept-Ranges", "bytes")
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Checks If-None-Match and If-Modified-Since conditions of request
+// (GET requests are checked by http.ServeContent)
+func notModified(r *http.Request, f *models.File) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return f.MatchesETag(inm)
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || f.ModifiedAt.IsZero() {
+		return false
+	}
+	return !f.ModifiedAt.Truncate(time.Second).After(ims)
+}
+
+// Sets headers describing file
+func setFileHeaders(w http.ResponseWriter, f *models.File) {
+	if !f.ModifiedAt.IsZero() {
+		w.Header().Set("Last-Modified", f.ModifiedAt.UTC().Format(http.TimeFormat))
+	}
+	if f.ContentType != "" {
+		w.Header().Set("Content-Type", f.ContentType)
+	}
+	if f.Checksum != "" {
+		w.Header().Set("X-Checksum-Sha256", f.Checksum)
+	}
+	if !f.IsDirectory {
+		w.Header().Set("ETag", f.ETag())
+	}
+}
+
+// Converts file to its representation in responses
+func listedFile(f *models.File) ListedFile {
+	return ListedFile{
+		Name:        f.Name,
+		IsDirectory: f.IsDirectory,
+		Size:        f.Size,
+		ContentType: f.ContentType,
+		Checksum:    f.Checksum,
+		CreatedAt:   f.CreatedAt,
+		ModifiedAt:  f.ModifiedAt,
+	}
+}
+
+func (s *Server) logout(w http.ResponseWriter, r *http.Request, paths []string, user *auth.Session) {
 	l.LogV("Logout...")
 	status := s.auth.Logout(r)
 
@@ -201,26 +535,30 @@ func (s *Server) logout(w http.ResponseWriter, r *http.Request, paths []string,
 }
 
 // Handler function for POST requests.
-// Encrypts multipart file and store it in provided by user location
-func (s *Server) uploadFile(w http.ResponseWriter, r *http.Request, args []string, user string) {
+// Encrypts every file of multipart form and stores them in provided by user location
+// (non-file form fields set options of the upload e.g. conflict=rename or extract=true)
+// Conflict policy (fail, overwrite or rename) can be also set with conflict query parameter
+// With If-Match header files are replaced only if their entity tag matches
+// With promote query makes provided version of the file its current content
+// Without multipart form creates directory
+func (s *Server) uploadFile(w http.ResponseWriter, r *http.Request, args []string, user *auth.Session) {
 	l.LogV("Uploading file...")
 
-	key, err := s.db.GetKey(user)
-	if err != nil {
-		l.Err("%s", err.Error())
-		resp500(w)
+	d, path := s.openPath(w, r, args, user)
+	if d == nil || !d.writable(w, path, false) {
 		return
 	}
 
-	userRoot, err := s.db.GetRoot(user)
-	if err != nil {
-		l.Err("%s", err.Error())
-		resp500(w)
+	if r.URL.Query().Has("promote") {
+		s.promoteVersion(w, r.URL.Query().Get("promote"), path, d)
+		return
+	}
+	if !d.holdsFiles(w) {
 		return
 	}
 
 	if !strings.Contains(r.Header.Get("Content-Type"), "multipart/form-data") {
-		err = s.db.NewFile(database.PathToArr(args[0]), key, 0, true, userRoot)
+		err := s.db.NewFile(path, d.key, &models.File{IsDirectory: true}, d.root)
 		if err != nil {
 			l.Err(err.Error())
 			if err == database.FileExists {
@@ -245,42 +583,155 @@ func (s *Server) uploadFile(w http.ResponseWriter, r *http.Request, args []strin
 		return
 	}
 
-	err = encryptMultipart(reader, args[0], key, s.db, userRoot)
+	opts := uploadOptions{conflict: models.ConflictFail, ifMatch: r.Header.Get("If-Match"), maxSize: s.maxUpload}
+	if conflict := r.URL.Query().Get("conflict"); conflict != "" {
+		if err = opts.set("conflict", conflict); err != nil {
+			resp400(w, err.Error())
+			return
+		}
+	}
+	results, err := encryptMultipart(reader, strings.Join(path, "/"), d.key, s.db, d.root, s.blobs, opts)
 	if err != nil {
 		l.Err(err.Error())
-		if err == database.FileExists {
-			resp409(w, "File already exists")
+		if _, ok := err.(*optionError); ok {
+			writeResponse(w, UploadResponse{Files: results, Error: err.Error()}, http.StatusBadRequest)
 			return
 		}
-		resp500(w)
+		writeResponse(w, UploadResponse{Files: results, Error: "Internal server error"}, http.StatusInternalServerError)
 		return
 	}
-	resp201(w)
-	l.LogV("File uploaded!")
+	if len(results) == 0 {
+		resp400(w, "no files provided")
+		return
+	}
+
+	// if some of files weren't stored results of all of them are returned with 207 Multi-Status
+	// (or 412 if any of them didn't meet If-Match condition)
+	status := http.StatusCreated
+	for _, res := range results {
+		switch res.Status {
+		case uploadCreated, uploadReplaced:
+		case uploadPreconditionFailed:
+			status = http.StatusPreconditionFailed
+		default:
+			if status != http.StatusPreconditionFailed {
+				status = http.StatusMultiStatus
+			}
+		}
+	}
+	if len(results) == 1 && results[0].ETag != "" {
+		w.Header().Set("ETag", results[0].ETag)
+	}
+	writeResponse(w, UploadResponse{Files: results}, status)
+	l.LogV("Files uploaded!")
 }
 
 // Handler function for DELETE requests.
 // Finds file on provided by user location
-// and removes it
-func (s *Server) deleteFile(w http.ResponseWriter, r *http.Request, paths []string, user string) {
+// and moves it to trash (or removes it permanently with ?permanent)
+func (s *Server) deleteFile(w http.ResponseWriter, r *http.Request, paths []string, user *auth.Session) {
 	l.LogV("Deleting file...")
 
-	userRoot, err := s.db.GetRoot(user)
+	d, path := s.openPath(w, r, paths, user)
+	if d == nil || !d.writable(w, path, true) {
+		return
+	}
+
+	// files deleted by recipients of shared directory are moved to its trash
+	var err error
+	if _, permanent := r.URL.Query()["permanent"]; permanent {
+		err = s.db.DeleteFile(path, d.key, d.root)
+	} else {
+		err = s.db.TrashFile(path, d.key, d.root)
+	}
 	if err != nil {
-		l.Err("%s", err.Error())
+		if err == database.FileNotFound {
+			resp404(w)
+			return
+		}
+		l.Err(err.Error())
 		resp500(w)
 		return
 	}
+}
 
-	err = s.db.DeleteFile(database.PathToArr(paths[0]), userRoot)
+// Handler function for MOVE (and PATCH) requests.
+// Moves or renames file or directory to destination provided in request body
+func (s *Server) moveFile(w http.ResponseWriter, r *http.Request, paths []string, user *auth.Session) {
+	l.LogV("Moving file...")
+	d, path := s.openPath(w, r, paths, user)
+	if d == nil || !d.writable(w, path, true) {
+		return
+	}
+	s.relocate(w, r, d, path, s.db.MoveFile, http.StatusOK)
+}
+
+// Handler function for COPY requests.
+// Copies file or directory to destination provided in request body
+func (s *Server) copyFile(w http.ResponseWriter, r *http.Request, paths []string, user *auth.Session) {
+	l.LogV("Copying file...")
+	d, path := s.openPath(w, r, paths, user)
+	if d == nil || !d.writable(w, path, false) {
+		return
+	}
+	s.relocate(w, r, d, path, s.db.CopyFile, http.StatusCreated)
+}
+
+// Reads destination from request body and performs op (MoveFile or CopyFile) on file from path
+// (in shared directory destination is relative to the directory)
+// On success responds with provided status
+func (s *Server) relocate(w http.ResponseWriter, r *http.Request, d *drive, path []string, op func(src, dst []string, key []byte, userRoot uuid.UUID) error, status int) {
+	var req DestinationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		resp400(w)
+		return
+	}
+	dst, ok := cleanPath(req.Destination)
+	if !ok {
+		resp400(w, "invalid destination")
+		return
+	}
+	if !d.holdsFiles(w) {
+		return
+	}
+
+	err := op(path, dst, d.key, d.root)
 	if err != nil {
-		l.Err(err.Error())
-		resp404(w)
+		switch err {
+		case database.FileNotFound:
+			resp404(w)
+		case database.FileExists:
+			resp409(w, "File already exists")
+		case database.LegacyFile:
+			resp409(w, err.Error())
+		case database.InvalidMove:
+			resp400(w, err.Error())
+		default:
+			l.Err(err.Error())
+			resp500(w)
+		}
 		return
 	}
+	writeResponse(w, ErrResponse{}, status)
+}
+
+// Splits path provided by user into names of files
+// Returns false if path is empty or contains empty, "." or ".." names
+func cleanPath(path string) ([]string, bool) {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil, false
+	}
+	names := strings.Split(path, "/")
+	for _, name := range names {
+		if name == "" || name == "." || name == ".." {
+			return nil, false
+		}
+	}
+	return names, true
 }
 
-func (s *Server) signUp(w http.ResponseWriter, r *http.Request, _ []string, _ string) {
+func (s *Server) signUp(w http.ResponseWriter, r *http.Request, _ []string, _ *auth.Session) {
 	var credentials Credentials
 	if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
 		resp400(w)
@@ -300,7 +751,7 @@ func (s *Server) signUp(w http.ResponseWriter, r *http.Request, _ []string, _ st
 	resp201(w)
 }
 
-func (s *Server) signIn(w http.ResponseWriter, r *http.Request, _ []string, _ string) {
+func (s *Server) signIn(w http.ResponseWriter, r *http.Request, _ []string, _ *auth.Session) {
 	var credentials Credentials
 	if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
 		resp400(w)
@@ -325,7 +776,7 @@ func (s *Server) signIn(w http.ResponseWriter, r *http.Request, _ []string, _ st
 	})
 }
 
-func (s *Server) refresh(w http.ResponseWriter, r *http.Request, _ []string, _ string) {
+func (s *Server) refresh(w http.ResponseWriter, r *http.Request, _ []string, _ *auth.Session) {
 	cookie, status := s.auth.Refresh(r)
 	if status != http.StatusOK {
 		switch status {
@@ -343,35 +794,44 @@ func (s *Server) refresh(w http.ResponseWriter, r *http.Request, _ []string, _ s
 	respOK(w)
 }
 
-// serveFile decrypts file on provided path and writes it's to ResponseWriter
+// serveFile decrypts blob of the file and writes it's content to ResponseWriter
+// Range requests are served by decrypting only chunks of blob covering requested ranges
 // Returns error and status code
-func serveFile(w http.ResponseWriter, path, name string, key []byte) (error, int) {
-	f, err := os.OpenFile(path, os.O_RDWR, 0777)
+// (if the error occurred after the response was started StatusOK is returned)
+func serveFile(w http.ResponseWriter, r *http.Request, blobs storage.BlobStore, f *models.File, key []byte) (error, int) {
+	blob, err := blobs.Get(f.BlobName())
 	if err != nil {
-		return err, http.StatusNotFound
+		if err == storage.ErrNotFound {
+			return err, http.StatusNotFound
+		}
+		return err, http.StatusInternalServerError
 	}
-	defer f.Close()
+	defer blob.Close()
 
-	fi, err := f.Stat()
+	content, err := decryptReader(blob, key)
 	if err != nil {
 		return err, http.StatusInternalServerError
 	}
 
-	//name := fi.Name()[:len(fi.Name())-4]
-
 	// Dont show file on web if it's bigger than ~100MB
-	if fi.Size() > 100*1000000 {
-		w.Header().Set("Content-Disposition", "attachment; filename="+name)
+	if content.Size() > 100*1000000 {
+		w.Header().Set("Content-Disposition", "attachment; filename="+f.Name)
 	} else {
-		w.Header().Set("Content-Disposition", "inline; filename="+name)
+		w.Header().Set("Content-Disposition", "inline; filename="+f.Name)
 	}
 
-	ctype := mime.TypeByExtension(filepath.Ext(name))
-	w.Header().Set("Content-Type", ctype)
+	setFileHeaders(w, f)
+	// type of files uploaded by older versions is unknown
+	if f.ContentType == "" {
+		if ctype := mime.TypeByExtension(filepath.Ext(f.Name)); ctype != "" {
+			w.Header().Set("Content-Type", ctype)
+		}
+	}
 
-	err = decrypt(f, w, key)
-	if err != nil {
-		return err, http.StatusInternalServerError
+	// if type is unknown ServeContent sniffs it from content
+	http.ServeContent(w, r, f.Name, f.ModifiedAt, content)
+	if err = content.Err(); err != nil {
+		return err, http.StatusOK
 	}
 	return nil, http.StatusOK
 }
@@ -416,6 +876,14 @@ func resp401(w http.ResponseWriter, msg ...interface{}) {
 	errResponse(w, http.StatusUnauthorized, response)
 }
 
+func resp403(w http.ResponseWriter, msg ...interface{}) {
+	response := "Forbidden"
+	if msg != nil {
+		response = fmt.Sprint(msg[0])
+	}
+	errResponse(w, http.StatusForbidden, response)
+}
+
 func resp404(w http.ResponseWriter, msg ...interface{}) {
 	response := "Content not found"
 	if msg != nil {
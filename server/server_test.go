@@ -1,28 +1,38 @@
 package server
 
 import (
+	"bytes"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"path"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/noisersup/encryptedfs-api/auth"
+	"github.com/noisersup/encryptedfs-api/crypt"
+	"github.com/noisersup/encryptedfs-api/database"
 	"github.com/noisersup/encryptedfs-api/models"
+	"github.com/noisersup/encryptedfs-api/storage"
 	"github.com/stretchr/testify/assert"
 )
 
 func Test_GetFile(t *testing.T) {
 	mockDB := MockDB{}
-	s := Server{maxUpload: 1024 << 20, db: &mockDB, filesPath: "../testdata/files"}
+	blobs := newTestStore(t, &mockDB)
+	s := Server{maxUpload: 1024 << 20, db: &mockDB, blobs: blobs}
 
 	expected := []byte("foo.txt content")
 	req := httptest.NewRequest(http.MethodGet, "/drive/test/foo.txt", nil)
 	w := httptest.NewRecorder()
 
-	s.GetFile(w, req, []string{"test/foo.txt"}, "user1")
+	s.GetFile(w, req, []string{"test/foo.txt"}, testSession(t, "user1"))
 
 	res := w.Result()
 	defer res.Body.Close()
@@ -33,21 +43,275 @@ func Test_GetFile(t *testing.T) {
 	assert.Equal(t, data, expected)
 }
 
+func Test_GetFileRange(t *testing.T) {
+	mockDB := MockDB{}
+	blobs := newTestStore(t, &mockDB)
+	s := Server{maxUpload: 1024 << 20, db: &mockDB, blobs: blobs}
+
+	req := httptest.NewRequest(http.MethodGet, "/drive/test/foo.txt", nil)
+	req.Header.Set("Range", "bytes=4-10")
+	w := httptest.NewRecorder()
+
+	s.GetFile(w, req, []string{"test/foo.txt"}, testSession(t, "user1"))
+
+	res := w.Result()
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusPartialContent, res.StatusCode)
+	assert.Equal(t, "bytes 4-10/16", res.Header.Get("Content-Range"))
+	assert.Equal(t, "bytes", res.Header.Get("Accept-Ranges"))
+	assert.Equal(t, "txt con", string(data))
+}
+
+func Test_GetLegacyFile(t *testing.T) {
+	mockDB := MockDB{}
+	blobs := newTestStore(t, &mockDB)
+	s := Server{maxUpload: 1024 << 20, db: &mockDB, blobs: blobs}
+	user := testSession(t, "user1")
+
+	// files stored by older versions have no data key and are encrypted with user's key
+	iv := make([]byte, 16)
+	blob := encryptLegacyBlob(t, []byte("legacy content"), user.Key, iv)
+	assert.NoError(t, blobs.Put("legacy", strings.NewReader(string(blob))))
+	mockDB.created = map[string]*models.File{"test/old.txt": {Name: "old.txt", Hash: "legacy"}}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/drive/test/old.txt", nil)
+	req.Header.Set("Range", "bytes=7-")
+	s.GetFile(w, req, []string{"test/old.txt"}, user)
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "content", w.Body.String())
+}
+
+func Test_MoveFile(t *testing.T) {
+	mockDB := MockDB{}
+	s := Server{maxUpload: 1024 << 20, db: &mockDB, blobs: newTestStore(t, &mockDB)}
+	user := testSession(t, "user1")
+
+	move := func(src, body string) int {
+		req := httptest.NewRequest("MOVE", "/drive/"+src, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		s.moveFile(w, req, []string{src}, user)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, move("test/foo.txt", `{"destination": "/test/renamed.txt"}`))
+	assert.Equal(t, "test/renamed.txt", mockDB.moved["test/foo.txt"])
+
+	assert.Equal(t, http.StatusConflict, move("test/foo.txt", `{"destination": "test"}`))
+	assert.Equal(t, http.StatusNotFound, move("test/missing.txt", `{"destination": "test/a.txt"}`))
+	assert.Equal(t, http.StatusBadRequest, move("test/foo.txt", `{"destination": "test/../a.txt"}`))
+	assert.Equal(t, http.StatusBadRequest, move("test/foo.txt", `{"destination": ""}`))
+}
+
+func Test_CopyFile(t *testing.T) {
+	mockDB := MockDB{}
+	blobs := newTestStore(t, &mockDB)
+	s := Server{maxUpload: 1024 << 20, db: &mockDB, blobs: blobs}
+	user := testSession(t, "user1")
+
+	copyFile := func(src, body string) int {
+		req := httptest.NewRequest("COPY", "/drive/"+src, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		s.copyFile(w, req, []string{src}, user)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusCreated, copyFile("test/foo.txt", `{"destination": "test/copy.txt"}`))
+	assert.Equal(t, http.StatusConflict, copyFile("test/foo.txt", `{"destination": "test/copy.txt"}`))
+
+	// copy is served from blob of the original
+	req := httptest.NewRequest(http.MethodGet, "/drive/test/copy.txt", nil)
+	w := httptest.NewRecorder()
+	s.GetFile(w, req, []string{"test/copy.txt"}, user)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "foo.txt content\n", w.Body.String())
+}
+
+func Test_ListDirectory(t *testing.T) {
+	mockDB := MockDB{}
+	s := Server{maxUpload: 1024 << 20, db: &mockDB, blobs: newTestStore(t, &mockDB)}
+	user := testSession(t, "user1")
+
+	list := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/drive/test?"+query, nil)
+		w := httptest.NewRecorder()
+		s.GetFile(w, req, []string{"test"}, user)
+		return w
+	}
+
+	w := list("limit=10&cursor=abc&sort=size&order=desc&type=file")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, models.ListOptions{Limit: 10, Cursor: "abc", SortBy: "size", Desc: true, Type: "file"}, mockDB.listOpts)
+
+	var resp ListFilesResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, "next", resp.NextCursor)
+	assert.Len(t, resp.Files, 1)
+	assert.Equal(t, "foo.txt", resp.Files[0].Name)
+
+	assert.Equal(t, http.StatusBadRequest, list("limit=-1").Code)
+	assert.Equal(t, http.StatusBadRequest, list("order=up").Code)
+	assert.Equal(t, http.StatusBadRequest, list("cursor=bad").Code)
+}
+
+func Test_ListTree(t *testing.T) {
+	mockDB := MockDB{}
+	s := Server{maxUpload: 1024 << 20, db: &mockDB, blobs: newTestStore(t, &mockDB)}
+	user := testSession(t, "user1")
+
+	list := func(query string) []ListedFile {
+		req := httptest.NewRequest(http.MethodGet, "/drive/test?"+query, nil)
+		w := httptest.NewRecorder()
+		s.GetFile(w, req, []string{"test"}, user)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+
+		entries := []ListedFile{}
+		dec := json.NewDecoder(w.Body)
+		for dec.More() {
+			var e ListedFile
+			assert.NoError(t, dec.Decode(&e))
+			entries = append(entries, e)
+		}
+		return entries
+	}
+
+	entries := list("recursive")
+	assert.Len(t, entries, 3)
+	assert.Equal(t, "docs/a.md", entries[2].Path)
+	assert.Equal(t, int64(16), entries[2].Size)
+
+	assert.Len(t, list("recursive&depth=1"), 2)
+}
+
+func Test_Search(t *testing.T) {
+	mockDB := MockDB{}
+	s := Server{maxUpload: 1024 << 20, db: &mockDB, blobs: newTestStore(t, &mockDB)}
+	user := testSession(t, "user1")
+
+	search := func(query string) (int, []ListedFile) {
+		req := httptest.NewRequest(http.MethodGet, "/search?"+query, nil)
+		w := httptest.NewRecorder()
+		s.search(w, req, nil, user)
+		var resp ListFilesResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp.Files
+	}
+
+	status, files := search("q=.md&path=test")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Len(t, files, 1)
+	assert.Equal(t, "test/docs/a.md", files[0].Path)
+
+	status, _ = search("q=")
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = search("q=a&path=missing")
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = search("q=a&path=test/foo.txt")
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func Test_GetFileConditional(t *testing.T) {
+	mockDB := MockDB{}
+	s := Server{maxUpload: 1024 << 20, db: &mockDB, blobs: newTestStore(t, &mockDB)}
+	user := testSession(t, "user1")
+
+	get := func(header, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/drive/test/foo.txt", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		s.GetFile(w, req, []string{"test/foo.txt"}, user)
+		return w
+	}
+
+	w := get("", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	assert.Equal(t, http.StatusNotModified, get("If-None-Match", etag).Code)
+	assert.Equal(t, http.StatusOK, get("If-None-Match", `"other"`).Code)
+	assert.Equal(t, http.StatusPreconditionFailed, get("If-Match", `"other"`).Code)
+
+	req := httptest.NewRequest(http.MethodHead, "/drive/test/foo.txt", nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	s.statFile(w, req, []string{"test/foo.txt"}, user)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+}
+
+// Returns session of signed in user
+func testSession(t *testing.T, username string) *auth.Session {
+	key, err := (&MockDB{}).GetKey(username)
+	assert.NoError(t, err)
+	return &auth.Session{Username: username, Key: key.Wrapped}
+}
+
+// Creates memory store with encrypted blobs of files from MockDB
+func newTestStore(t *testing.T, mockDB *MockDB) *storage.MemoryStore {
+	blobs := storage.NewMemoryStore()
+
+	key := testSession(t, "user1").Key
+
+	dataKey, err := crypt.NewKey()
+	assert.NoError(t, err)
+	mockDB.fooKey = dataKey
+
+	f, err := mockDB.GetFile([]string{"test", "foo.txt"}, key, uuid.MustParse("0bb34349-a3f7-4221-ba6e-3dcd3ca78f30"))
+	assert.NoError(t, err)
+
+	encrypted, err := encryptReader(strings.NewReader("foo.txt content\n"), dataKey)
+	assert.NoError(t, err)
+	assert.NoError(t, blobs.Put(f.BlobName(), encrypted))
+
+	return blobs
+}
+
 type MockDB struct {
+	fooKey   []byte                  // data key of test/foo.txt (returned wrapped with requested key)
+	ownKeys  map[uuid.UUID][]byte    // own keys of shared files by their ids
+	created  map[string]*models.File // files added with NewFile by path
+	uploads  map[uuid.UUID]models.Upload
+	moved    map[string]string  // destinations of moved files by source path
+	listOpts models.ListOptions // options of the last directory listing
+	trash    []models.TrashItem
+	links    []models.ShareLink
+	shares   []models.Share
+	members  []models.GroupMember
+	keyPairs map[string]*models.KeyPair
+	versions map[string][]models.File // replaced contents of files by path (oldest first)
 }
 
 func (m *MockDB) Close() {
 }
 
-func (m *MockDB) NewFile(pathNames []string, key []byte, duplicate int, isDirectory bool, userRoot uuid.UUID) error {
+func (m *MockDB) NewFile(pathNames []string, key []byte, file *models.File, userRoot uuid.UUID) error {
+	if m.created == nil {
+		m.created = map[string]*models.File{}
+	}
+	if _, err := m.GetFile(pathNames, key, userRoot); err == nil {
+		return database.FileExists
+	}
+	file.Name = pathNames[len(pathNames)-1]
+	if file.Hash == "" {
+		file.Hash = getHashOfFile([]byte(file.Name), key)
+	}
+	if file.Id == uuid.Nil {
+		file.Id = uuid.New()
+	}
+	file.CreatedAt = time.Now()
+	file.ModifiedAt = file.CreatedAt
+	file.Version = 1
+	m.created[strings.Join(pathNames, "/")] = file
 	return nil
 }
 
-func (m *MockDB) GetFile(pathNames []string, userRoot uuid.UUID) (*models.File, error) {
-	if len(pathNames) == 0 {
-		return nil, errors.New("pathNames empty")
-	}
-
+func (m *MockDB) GetFile(pathNames []string, key []byte, userRoot uuid.UUID) (*models.File, error) {
 	user1ID := uuid.MustParse("0bb34349-a3f7-4221-ba6e-3dcd3ca78f30")
 	user2ID := uuid.MustParse("01fb863a-ceeb-4b28-89b4-7dfe75d72961")
 
@@ -67,6 +331,9 @@ func (m *MockDB) GetFile(pathNames []string, userRoot uuid.UUID) (*models.File,
 		Duplicate:   0,
 		IsDirectory: false,
 	}
+	if m.fooKey != nil {
+		fFoo.WrappedKey, _ = crypt.WrapKey(key, m.fooKey)
+	}
 
 	fBar := models.File{
 		Id:          uuid.MustParse("1feac6c9-f1d8-4c1c-ac0e-f7c2f0a0b96b"),
@@ -77,12 +344,39 @@ func (m *MockDB) GetFile(pathNames []string, userRoot uuid.UUID) (*models.File,
 		IsDirectory: false,
 	}
 
+	// drives of shared files are opened with their own keys
+	if ownKey, ok := m.ownKeys[userRoot]; ok && !bytes.Equal(ownKey, key) {
+		return nil, errors.New("wrong key of shared file")
+	}
+	switch userRoot {
+	case fTest.Id:
+		// paths inside of test directory
+		pathNames = append([]string{"test"}, pathNames...)
+		userRoot = user1ID
+	case fFoo.Id:
+		// shared foo.txt is the only file of its drive
+		if len(pathNames) > 0 {
+			return nil, database.FileNotFound
+		}
+		return &fFoo, nil
+	}
+	if len(pathNames) == 0 {
+		return nil, errors.New("pathNames empty")
+	}
+
+	if f, ok := m.created[strings.Join(pathNames, "/")]; ok {
+		return f, nil
+	}
+
 	switch userRoot {
 	case user1ID:
 		if arraysEqual(pathNames, []string{"test", "foo.txt"}) {
 			return &fFoo, nil
 		}
 		if arraysEqual(pathNames, []string{"test"}) {
+			if ownKey, ok := m.ownKeys[fTest.Id]; ok && key != nil {
+				fTest.OwnKey, _ = crypt.WrapKey(key, ownKey)
+			}
 			return &fTest, nil
 		}
 	case user2ID:
@@ -91,7 +385,7 @@ func (m *MockDB) GetFile(pathNames []string, userRoot uuid.UUID) (*models.File,
 		}
 	}
 
-	return nil, errors.New("File not found")
+	return nil, database.FileNotFound
 
 }
 
@@ -107,16 +401,506 @@ func arraysEqual(a, b []string) bool {
 	return true
 }
 
-func (m *MockDB) ListDirectory(id ...uuid.UUID) ([]models.File, error) {
+func (m *MockDB) ListDirectory(id uuid.UUID, key []byte) ([]models.File, error) {
 
 	return nil, nil
 }
 
-func (m *MockDB) DeleteFile(pathNames []string, userRoot uuid.UUID) error {
+// Returns foo.txt as the only entry of every directory
+func (m *MockDB) ListDirectoryPage(id uuid.UUID, key []byte, opts models.ListOptions) (*models.DirectoryPage, error) {
+	m.listOpts = opts
+	if opts.Cursor == "bad" {
+		return nil, database.InvalidCursor
+	}
+	f, _ := m.GetFile([]string{"test", "foo.txt"}, key, uuid.MustParse("0bb34349-a3f7-4221-ba6e-3dcd3ca78f30"))
+	return &models.DirectoryPage{Files: []models.File{*f}, NextCursor: "next"}, nil
+}
+
+// Walks tree of test directory with subdirectory docs
+// (docs/a.md is a copy of foo.txt)
+func (m *MockDB) ListTree(id uuid.UUID, key []byte, maxDepth int, fn func(path []string, f *models.File) error) error {
+	foo, _ := m.GetFile([]string{"test", "foo.txt"}, key, uuid.MustParse("0bb34349-a3f7-4221-ba6e-3dcd3ca78f30"))
+	foo.Size = 16
+	a := *foo
+	a.Name = "a.md"
+	tree := []struct {
+		path []string
+		f    models.File
+	}{
+		{[]string{"foo.txt"}, *foo},
+		{[]string{"docs"}, models.File{Name: "docs", IsDirectory: true}},
+		{[]string{"docs", "a.md"}, a},
+	}
+	for _, e := range tree {
+		if maxDepth != 0 && len(e.path) > maxDepth {
+			continue
+		}
+		if err := fn(e.path, &e.f); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (m *MockDB) NewUser(username, hashedPassword string) error {
+// Finds files of tree returned by ListTree with names containing query
+func (m *MockDB) SearchFiles(dir uuid.UUID, key []byte, query models.SearchQuery) ([]models.SearchResult, error) {
+	if query.Pattern == "" {
+		return nil, database.InvalidSearch
+	}
+	results := []models.SearchResult{}
+	err := m.ListTree(dir, key, 0, func(path []string, f *models.File) error {
+		if strings.Contains(f.Name, query.Pattern) {
+			results = append(results, models.SearchResult{Path: path, File: *f})
+		}
+		return nil
+	})
+	return results, err
+}
+
+func (m *MockDB) MoveFile(src, dst []string, key []byte, userRoot uuid.UUID) error {
+	f, err := m.GetFile(src, key, userRoot)
+	if err != nil {
+		return err
+	}
+	if _, err = m.GetFile(dst, key, userRoot); err == nil {
+		return database.FileExists
+	}
+	if m.moved == nil {
+		m.moved = map[string]string{}
+		m.created = map[string]*models.File{}
+	}
+	m.moved[strings.Join(src, "/")] = strings.Join(dst, "/")
+	m.created[strings.Join(dst, "/")] = f
+	return nil
+}
+
+func (m *MockDB) CopyFile(src, dst []string, key []byte, userRoot uuid.UUID) error {
+	f, err := m.GetFile(src, key, userRoot)
+	if err != nil {
+		return err
+	}
+	if _, err = m.GetFile(dst, key, userRoot); err == nil {
+		return database.FileExists
+	}
+	if m.created == nil {
+		m.created = map[string]*models.File{}
+	}
+	// copy keeps hash so it shares blob with the original
+	c := *f
+	c.Name = dst[len(dst)-1]
+	m.created[strings.Join(dst, "/")] = &c
+	return nil
+}
+
+func (m *MockDB) ReplaceFile(pathNames []string, key []byte, file *models.File, userRoot uuid.UUID, ifMatch string) error {
+	old, err := m.GetFile(pathNames, key, userRoot)
+	if err != nil {
+		return err
+	}
+	if ifMatch != "" && !old.MatchesETag(ifMatch) {
+		return database.PreconditionFailed
+	}
+	if m.created == nil {
+		m.created = map[string]*models.File{}
+	}
+	if m.versions == nil {
+		m.versions = map[string][]models.File{}
+	}
+	m.versions[strings.Join(pathNames, "/")] = append(m.versions[strings.Join(pathNames, "/")], *old)
+	file.Name = old.Name
+	if file.Hash == "" {
+		file.Hash = getHashOfFile([]byte(file.Name), key)
+	}
+	file.Id = old.Id
+	file.CreatedAt = old.CreatedAt
+	file.ModifiedAt = time.Now()
+	file.Version = old.Version + 1
+	m.created[strings.Join(pathNames, "/")] = file
+	return nil
+}
+
+func (m *MockDB) StoreFile(pathNames []string, key []byte, file *models.File, userRoot uuid.UUID, policy models.ConflictPolicy) error {
+	// blob keeps name computed from the requested file
+	if file.Hash == "" {
+		file.Hash = getHashOfFile([]byte(pathNames[len(pathNames)-1]), key)
+	}
+	err := m.NewFile(pathNames, key, file, userRoot)
+	if err != database.FileExists {
+		return err
+	}
+	switch policy {
+	case models.ConflictOverwrite:
+		return m.ReplaceFile(pathNames, key, file, userRoot, "")
+	case models.ConflictRename:
+		name := pathNames[len(pathNames)-1]
+		ext := path.Ext(name)
+		for n := 1; err == database.FileExists; n++ {
+			renamed := append(append([]string{}, pathNames[:len(pathNames)-1]...), fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), n, ext))
+			err = m.NewFile(renamed, key, file, userRoot)
+		}
+	}
+	return err
+}
+
+func (m *MockDB) DeleteFile(pathNames []string, key []byte, userRoot uuid.UUID) error {
+	delete(m.created, strings.Join(pathNames, "/"))
+	return nil
+}
+
+func (m *MockDB) ListVersions(pathNames []string, key []byte, userRoot uuid.UUID) ([]models.File, error) {
+	f, err := m.GetFile(pathNames, key, userRoot)
+	if err != nil {
+		return nil, err
+	}
+	versions := []models.File{*f}
+	old := m.versions[strings.Join(pathNames, "/")]
+	for i := len(old) - 1; i >= 0; i-- {
+		versions = append(versions, old[i])
+	}
+	return versions, nil
+}
+
+func (m *MockDB) GetVersion(pathNames []string, key []byte, userRoot uuid.UUID, version int64) (*models.File, error) {
+	versions, err := m.ListVersions(pathNames, key, userRoot)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range versions {
+		if v.Version == version {
+			return &v, nil
+		}
+	}
+	return nil, database.FileNotFound
+}
+
+func (m *MockDB) PromoteVersion(pathNames []string, key []byte, userRoot uuid.UUID, version int64) (*models.File, error) {
+	v, err := m.GetVersion(pathNames, key, userRoot, version)
+	if err != nil {
+		return nil, err
+	}
+	return v, m.ReplaceFile(pathNames, key, v, userRoot, "")
+}
+
+func (m *MockDB) PruneVersions(retention models.VersionRetention) (int, error) {
+	n := 0
+	for path, old := range m.versions {
+		if retention.Keep > 0 && len(old) > retention.Keep {
+			n += len(old) - retention.Keep
+			m.versions[path] = old[len(old)-retention.Keep:]
+		}
+	}
+	return n, nil
+}
+
+func (m *MockDB) GetFileById(id uuid.UUID, key []byte, userRoot uuid.UUID) (*models.File, []string, error) {
+	paths := []string{"test", "test/foo.txt", "bar.md"}
+	for path := range m.created {
+		paths = append(paths, path)
+	}
+	for _, path := range paths {
+		f, err := m.GetFile(strings.Split(path, "/"), key, userRoot)
+		if err == nil && f.Id == id {
+			return f, strings.Split(path, "/"), nil
+		}
+	}
+	return nil, nil, database.FileNotFound
+}
+
+func (m *MockDB) ShareKey(pathNames []string, key []byte, userRoot uuid.UUID) (*models.File, []byte, error) {
+	f, err := m.GetFile(pathNames, key, userRoot)
+	if err != nil {
+		return nil, nil, err
+	}
+	if m.ownKeys == nil {
+		m.ownKeys = map[uuid.UUID][]byte{}
+	}
+	if _, ok := m.ownKeys[f.Id]; !ok {
+		if m.ownKeys[f.Id], err = crypt.NewKey(); err != nil {
+			return nil, nil, err
+		}
+	}
+	f, err = m.GetFile(pathNames, key, userRoot)
+	return f, m.ownKeys[f.Id], err
+}
+
+func (m *MockDB) GetSharedFile(id uuid.UUID, key []byte, owner uuid.UUID) (*models.File, error) {
+	if _, ok := m.ownKeys[id]; !ok {
+		return nil, database.FileNotFound
+	}
+	return m.GetFile(nil, key, id)
+}
+
+func (m *MockDB) NewShareLink(link *models.ShareLink) error {
+	link.Id = uuid.New()
+	link.CreatedAt = time.Now()
+	m.links = append(m.links, *link)
+	return nil
+}
+
+func (m *MockDB) GetShareLink(tokenHash string) (*models.ShareLink, error) {
+	for i := range m.links {
+		if m.links[i].TokenHash == tokenHash {
+			link := m.links[i]
+			return &link, nil
+		}
+	}
+	return nil, database.FileNotFound
+}
+
+func (m *MockDB) ListShareLinks(owner uuid.UUID) ([]models.ShareLink, error) {
+	links := []models.ShareLink{}
+	for _, link := range m.links {
+		if link.Owner == owner {
+			links = append(links, link)
+		}
+	}
+	return links, nil
+}
+
+func (m *MockDB) DeleteShareLink(id uuid.UUID, owner uuid.UUID) error {
+	for i, link := range m.links {
+		if link.Id == id && link.Owner == owner {
+			m.links = append(m.links[:i], m.links[i+1:]...)
+			return nil
+		}
+	}
+	return database.FileNotFound
+}
+
+func (m *MockDB) CountDownload(id uuid.UUID) error {
+	for i := range m.links {
+		if m.links[i].Id == id {
+			if m.links[i].MaxDownloads > 0 && m.links[i].Downloads >= m.links[i].MaxDownloads {
+				return database.LinkExpired
+			}
+			m.links[i].Downloads++
+			return nil
+		}
+	}
+	return database.LinkExpired
+}
+
+func (m *MockDB) ShareFile(share *models.Share) error {
+	for i := range m.shares {
+		if m.shares[i].FileId == share.FileId && m.shares[i].Recipient == share.Recipient {
+			m.shares[i].Permission = share.Permission
+			m.shares[i].WrappedKey = share.WrappedKey
+			share.Id = m.shares[i].Id
+			share.CreatedAt = m.shares[i].CreatedAt
+			return nil
+		}
+	}
+	share.Id = uuid.New()
+	share.CreatedAt = time.Now()
+	m.shares = append(m.shares, *share)
+	return nil
+}
+
+func (m *MockDB) GetShare(id uuid.UUID) (*models.Share, error) {
+	for i := range m.shares {
+		if m.shares[i].Id == id {
+			share := m.shares[i]
+			return &share, nil
+		}
+	}
+	return nil, database.FileNotFound
+}
+
+func (m *MockDB) ListSharesByOwner(owner uuid.UUID) ([]models.Share, error) {
+	shares := []models.Share{}
+	for _, share := range m.shares {
+		if share.Owner == owner {
+			shares = append(shares, share)
+		}
+	}
+	return shares, nil
+}
+
+func (m *MockDB) ListSharesWithUser(recipient string) ([]models.Share, error) {
+	shares := []models.Share{}
+	for _, share := range m.shares {
+		if share.Recipient == recipient {
+			shares = append(shares, share)
+		}
+	}
+	return shares, nil
+}
+
+func (m *MockDB) DeleteShare(id uuid.UUID, username string) error {
+	for i, share := range m.shares {
+		if share.Id == id && (share.Recipient == username || share.OwnerName == username) {
+			m.shares = append(m.shares[:i], m.shares[i+1:]...)
+			return nil
+		}
+	}
+	return database.FileNotFound
+}
+
+func (m *MockDB) NewGroup(owner *models.GroupMember) error {
+	owner.GroupId = uuid.New()
+	owner.AddedAt = time.Now()
+	m.members = append(m.members, *owner)
+	return nil
+}
+
+func (m *MockDB) GetGroupMember(groupId uuid.UUID, username string) (*models.GroupMember, error) {
+	for i := range m.members {
+		if m.members[i].GroupId == groupId && m.members[i].Username == username {
+			member := m.members[i]
+			return &member, nil
+		}
+	}
+	return nil, database.FileNotFound
+}
+
+func (m *MockDB) ListGroups(username string) ([]models.GroupMember, error) {
+	members := []models.GroupMember{}
+	for _, member := range m.members {
+		if member.Username == username {
+			members = append(members, member)
+		}
+	}
+	return members, nil
+}
+
+func (m *MockDB) ListGroupMembers(groupId uuid.UUID) ([]models.GroupMember, error) {
+	members := []models.GroupMember{}
+	for _, member := range m.members {
+		if member.GroupId == groupId {
+			members = append(members, member)
+		}
+	}
+	return members, nil
+}
+
+func (m *MockDB) SetGroupMember(member *models.GroupMember) error {
+	if member.Role != models.RoleOwner && !m.otherOwners(member.GroupId, member.Username) {
+		return database.LastGroupOwner
+	}
+	for i := range m.members {
+		if m.members[i].GroupId == member.GroupId && m.members[i].Username == member.Username {
+			m.members[i].Role = member.Role
+			m.members[i].WrappedKey = member.WrappedKey
+			member.AddedAt = m.members[i].AddedAt
+			return nil
+		}
+	}
+	member.AddedAt = time.Now()
+	m.members = append(m.members, *member)
+	return nil
+}
+
+func (m *MockDB) RemoveGroupMember(groupId uuid.UUID, username string, key, newKey []byte, sealedKeys map[string][]byte) error {
+	if !m.otherOwners(groupId, username) {
+		return database.LastGroupOwner
+	}
+	for i, member := range m.members {
+		if member.GroupId == groupId && member.Username == username {
+			m.members = append(m.members[:i], m.members[i+1:]...)
+			// remaining members get the new key of the group
+			for j := range m.members {
+				if m.members[j].GroupId != groupId {
+					continue
+				}
+				sealed, ok := sealedKeys[m.members[j].Username]
+				if !ok {
+					return database.GroupChanged
+				}
+				m.members[j].WrappedKey = sealed
+			}
+			return nil
+		}
+	}
+	return database.FileNotFound
+}
+
+// Checks if group has owners other than user with provided username
+func (m *MockDB) otherOwners(groupId uuid.UUID, username string) bool {
+	for _, member := range m.members {
+		if member.GroupId == groupId && member.Role == models.RoleOwner && member.Username != username {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MockDB) TrashFile(pathNames []string, key []byte, userRoot uuid.UUID) error {
+	f, err := m.GetFile(pathNames, key, userRoot)
+	if err != nil {
+		return err
+	}
+	if f.Id == uuid.Nil {
+		f.Id = uuid.New()
+	}
+	delete(m.created, m.drivePath(pathNames, userRoot))
+	m.trash = append(m.trash, models.TrashItem{File: *f, Path: pathNames, DeletedAt: time.Now()})
+	return nil
+}
+
+// Returns path (as key of created) of file on path inside of drive with provided root
+func (m *MockDB) drivePath(pathNames []string, userRoot uuid.UUID) string {
+	// shared test directory
+	if userRoot == uuid.MustParse("293fe451-b313-4c51-9fad-7d51e602af9b") {
+		pathNames = append([]string{"test"}, pathNames...)
+	}
+	return strings.Join(pathNames, "/")
+}
+
+func (m *MockDB) ListTrash(key []byte, userRoot uuid.UUID) ([]models.TrashItem, error) {
+	return m.trash, nil
+}
+
+func (m *MockDB) RestoreFile(id uuid.UUID, key []byte, userRoot uuid.UUID) ([]string, error) {
+	for i, item := range m.trash {
+		if item.Id != id {
+			continue
+		}
+		if _, err := m.GetFile(item.Path, key, userRoot); err == nil {
+			return nil, database.FileExists
+		}
+		if m.created == nil {
+			m.created = map[string]*models.File{}
+		}
+		m.created[m.drivePath(item.Path, userRoot)] = &item.File
+		m.trash = append(m.trash[:i], m.trash[i+1:]...)
+		return item.Path, nil
+	}
+	return nil, database.FileNotFound
+}
+
+func (m *MockDB) DeleteFromTrash(id uuid.UUID, userRoot uuid.UUID) error {
+	for i, item := range m.trash {
+		if item.Id == id {
+			m.trash = append(m.trash[:i], m.trash[i+1:]...)
+			return nil
+		}
+	}
+	return database.FileNotFound
+}
+
+func (m *MockDB) EmptyTrash(userRoot uuid.UUID) (int, error) {
+	n := len(m.trash)
+	m.trash = nil
+	return n, nil
+}
+
+func (m *MockDB) PurgeTrash(deletedBefore time.Time) (int, error) {
+	kept := []models.TrashItem{}
+	for _, item := range m.trash {
+		if !item.DeletedAt.Before(deletedBefore) {
+			kept = append(kept, item)
+		}
+	}
+	n := len(m.trash) - len(kept)
+	m.trash = kept
+	return n, nil
+}
+
+func (m *MockDB) EncryptNames(key []byte, userRoot uuid.UUID) (int, error) {
+	return 0, nil
+}
+
+func (m *MockDB) NewUser(username, hashedPassword string, key *models.UserKey) error {
 	return nil
 
 }
@@ -126,7 +910,8 @@ func (m *MockDB) GetPasswordOfUser(username string) (string, error) {
 
 }
 
-func (m *MockDB) GetKey(username string) ([]byte, error) {
+// Returns plaintext keys (as stored by older versions)
+func (m *MockDB) GetKey(username string) (*models.UserKey, error) {
 	var b64Decoded string
 
 	switch username {
@@ -142,7 +927,11 @@ func (m *MockDB) GetKey(username string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	return key, err
+	return &models.UserKey{Wrapped: key}, err
+}
+
+func (m *MockDB) SetKey(username string, key *models.UserKey) error {
+	return nil
 }
 
 func (m *MockDB) GetRoot(username string) (uuid.UUID, error) {
@@ -154,3 +943,66 @@ func (m *MockDB) GetRoot(username string) (uuid.UUID, error) {
 	}
 	return uuid.UUID{}, fmt.Errorf("user %s not found", username)
 }
+
+func (m *MockDB) GetKeyPair(username string) (*models.KeyPair, error) {
+	if _, err := m.GetRoot(username); err != nil {
+		return nil, database.UserNotFound
+	}
+	if pair, ok := m.keyPairs[username]; ok {
+		return pair, nil
+	}
+	return &models.KeyPair{}, nil
+}
+
+func (m *MockDB) SetKeyPair(username string, pair *models.KeyPair) error {
+	if m.keyPairs == nil {
+		m.keyPairs = map[string]*models.KeyPair{}
+	}
+	m.keyPairs[username] = pair
+	return nil
+}
+
+func (m *MockDB) NewUpload(u *models.Upload) error {
+	if m.uploads == nil {
+		m.uploads = map[uuid.UUID]models.Upload{}
+	}
+	u.Id = uuid.New()
+	u.CreatedAt = time.Now()
+	m.uploads[u.Id] = *u
+	return nil
+}
+
+func (m *MockDB) GetUpload(id uuid.UUID, owner string) (*models.Upload, error) {
+	u, ok := m.uploads[id]
+	if !ok || u.Owner != owner {
+		return nil, database.FileNotFound
+	}
+	return &u, nil
+}
+
+func (m *MockDB) AdvanceUpload(id uuid.UUID, received, newReceived int64, parts int, hashState []byte) error {
+	u, ok := m.uploads[id]
+	if !ok || u.Received != received {
+		return database.UploadConflict
+	}
+	u.Received = newReceived
+	u.Parts = parts
+	u.HashState = hashState
+	m.uploads[id] = u
+	return nil
+}
+
+func (m *MockDB) DeleteUpload(id uuid.UUID) error {
+	delete(m.uploads, id)
+	return nil
+}
+
+func (m *MockDB) ListStaleUploads(createdBefore time.Time) ([]models.Upload, error) {
+	uploads := []models.Upload{}
+	for _, u := range m.uploads {
+		if u.CreatedAt.Before(createdBefore) {
+			uploads = append(uploads, u)
+		}
+	}
+	return uploads, nil
+}
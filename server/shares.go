@@ -0,0 +1,277 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/noisersup/encryptedfs-api/auth"
+	"github.com/noisersup/encryptedfs-api/crypt"
+	"github.com/noisersup/encryptedfs-api/database"
+	l "github.com/noisersup/encryptedfs-api/logger"
+	"github.com/noisersup/encryptedfs-api/models"
+)
+
+// Handler function for POST requests on /shares
+// Shares file or directory with another user (sharing it again with the same user changes permission)
+func (s *Server) createShare(w http.ResponseWriter, r *http.Request, _ []string, user *auth.Session) {
+	var req ShareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		resp400(w)
+		return
+	}
+	path, ok := cleanPath(req.Path)
+	if !ok {
+		resp400(w, "invalid path")
+		return
+	}
+	permission := models.Permission(req.Permission)
+	switch permission {
+	case "":
+		permission = models.PermissionRead
+	case models.PermissionRead, models.PermissionWrite:
+	default:
+		resp400(w, "invalid permission")
+		return
+	}
+	if req.Username == user.Username {
+		resp400(w, "file can't be shared with its owner")
+		return
+	}
+
+	public := s.publicKey(w, req.Username)
+	if public == nil {
+		return
+	}
+	userRoot, err := s.db.GetRoot(user.Username)
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+	// only own key of the shared file is handed out, not key of the whole drive
+	f, ownKey, err := s.db.ShareKey(path, user.Key, userRoot)
+	if err != nil {
+		switch err {
+		case database.FileNotFound:
+			resp404(w)
+		case database.LegacyFile:
+			resp409(w, err.Error())
+		default:
+			l.Err("%s", err.Error())
+			resp500(w)
+		}
+		return
+	}
+	wrappedKey, err := crypt.SealKey(public, ownKey)
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+
+	share := models.Share{
+		FileId:     f.Id,
+		Owner:      userRoot,
+		OwnerName:  user.Username,
+		Recipient:  req.Username,
+		Permission: permission,
+		WrappedKey: wrappedKey,
+	}
+	if err = s.db.ShareFile(&share); err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+	writeResponse(w, shareInfo(&share, f, path), http.StatusCreated)
+}
+
+// Handler function for GET requests on /shares
+// Lists files shared by the user with their current paths
+func (s *Server) listShares(w http.ResponseWriter, r *http.Request, _ []string, user *auth.Session) {
+	userRoot, err := s.db.GetRoot(user.Username)
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+
+	shares, err := s.db.ListSharesByOwner(userRoot)
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+
+	infos := make([]ShareInfo, 0, len(shares))
+	for i := range shares {
+		// shared file could be moved to trash in the meantime
+		f, path, err := s.db.GetFileById(shares[i].FileId, user.Key, userRoot)
+		if err != nil && err != database.FileNotFound {
+			l.Err("%s", err.Error())
+			resp500(w)
+			return
+		}
+		infos = append(infos, shareInfo(&shares[i], f, path))
+	}
+	writeResponse(w, SharesResponse{Shares: infos}, http.StatusOK)
+}
+
+// Handler function for GET requests on /shared
+// Lists files shared with the user (their paths in drives of their owners aren't revealed)
+func (s *Server) listSharedWithMe(w http.ResponseWriter, r *http.Request, _ []string, user *auth.Session) {
+	shares, err := s.db.ListSharesWithUser(user.Username)
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+	infos := make([]ShareInfo, 0, len(shares))
+	if len(shares) == 0 {
+		writeResponse(w, SharesResponse{Shares: infos}, http.StatusOK)
+		return
+	}
+
+	private, err := s.privateKey(user)
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+	for i := range shares {
+		key, err := crypt.OpenKey(private, shares[i].WrappedKey)
+		if err != nil {
+			l.Err("%s", err.Error())
+			resp500(w)
+			return
+		}
+		f, err := s.db.GetSharedFile(shares[i].FileId, key, shares[i].Owner)
+		if err != nil && err != database.FileNotFound {
+			l.Err("%s", err.Error())
+			resp500(w)
+			return
+		}
+		infos = append(infos, shareInfo(&shares[i], f, nil))
+	}
+	writeResponse(w, SharesResponse{Shares: infos}, http.StatusOK)
+}
+
+// Handler function for DELETE requests on /shares/{id}
+// Revokes share (owner) or removes file shared with the user from their shared files (recipient)
+func (s *Server) deleteShare(w http.ResponseWriter, r *http.Request, paths []string, user *auth.Session) {
+	id, err := uuid.Parse(paths[0])
+	if err != nil {
+		resp404(w)
+		return
+	}
+
+	if err = s.db.DeleteShare(id, user.Username); err != nil {
+		if err == database.FileNotFound {
+			resp404(w)
+			return
+		}
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+	respOK(w)
+}
+
+// Opens drive of file shared with the user by share with provided id
+// If the share can't be opened writes error response and returns nil
+func (s *Server) openShare(w http.ResponseWriter, id string, user *auth.Session) *drive {
+	shareId, err := uuid.Parse(id)
+	if err != nil {
+		resp404(w)
+		return nil
+	}
+	share, err := s.db.GetShare(shareId)
+	if err != nil {
+		if err == database.FileNotFound {
+			resp404(w)
+			return nil
+		}
+		l.Err("%s", err.Error())
+		resp500(w)
+		return nil
+	}
+	// shares of other users are indistinguishable from not existing ones
+	if share.Recipient != user.Username {
+		resp404(w)
+		return nil
+	}
+
+	private, err := s.privateKey(user)
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return nil
+	}
+	key, err := crypt.OpenKey(private, share.WrappedKey)
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return nil
+	}
+
+	f, err := s.db.GetSharedFile(share.FileId, key, share.Owner)
+	if err != nil {
+		if err == database.FileNotFound {
+			resp404(w, "Shared file was deleted")
+			return nil
+		}
+		l.Err("%s", err.Error())
+		resp500(w)
+		return nil
+	}
+	return &drive{root: f.Id, key: key, entry: f, write: share.Permission == models.PermissionWrite}
+}
+
+// Gets public key of user with provided username
+// If the user doesn't exist or has no key pair writes error response and returns nil
+func (s *Server) publicKey(w http.ResponseWriter, username string) []byte {
+	pair, err := s.db.GetKeyPair(username)
+	if err != nil {
+		if err == database.UserNotFound {
+			resp404(w, err.Error())
+			return nil
+		}
+		l.Err("%s", err.Error())
+		resp500(w)
+		return nil
+	}
+	if pair.Public == nil {
+		// users registered by older versions get key pairs when they sign in
+		resp409(w, "User has to sign in before keys can be shared with them")
+		return nil
+	}
+	return pair.Public
+}
+
+// Unwraps private key of the user with their key
+func (s *Server) privateKey(user *auth.Session) ([]byte, error) {
+	pair, err := s.db.GetKeyPair(user.Username)
+	if err != nil {
+		return nil, err
+	}
+	return crypt.UnwrapKey(user.Key, pair.WrappedPrivate)
+}
+
+// Converts share to response (f is nil if shared file doesn't exist anymore, path is nil for recipients)
+func shareInfo(share *models.Share, f *models.File, path []string) ShareInfo {
+	info := ShareInfo{
+		Id:         share.Id.String(),
+		Url:        "/shared/" + share.Id.String(),
+		Path:       strings.Join(path, "/"),
+		Owner:      share.OwnerName,
+		Recipient:  share.Recipient,
+		Permission: string(share.Permission),
+		CreatedAt:  share.CreatedAt,
+	}
+	if f != nil {
+		info.Name = f.Name
+		info.IsDirectory = f.IsDirectory
+	}
+	return info
+}
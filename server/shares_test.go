@@ -0,0 +1,183 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/noisersup/encryptedfs-api/crypt"
+	"github.com/noisersup/encryptedfs-api/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// Creates key pair of user as it's done when the user signs in
+func setTestKeyPair(t *testing.T, mockDB *MockDB, username string) {
+	public, private, err := crypt.NewKeyPair()
+	assert.NoError(t, err)
+	wrapped, err := crypt.WrapKey(testSession(t, username).Key, private)
+	assert.NoError(t, err)
+	assert.NoError(t, mockDB.SetKeyPair(username, &models.KeyPair{Public: public, WrappedPrivate: wrapped}))
+}
+
+func createTestShare(t *testing.T, s *Server, body string) (int, ShareInfo) {
+	w := httptest.NewRecorder()
+	s.createShare(w, httptest.NewRequest(http.MethodPost, "/shares", strings.NewReader(body)), nil, testSession(t, "user1"))
+	var info ShareInfo
+	json.NewDecoder(w.Body).Decode(&info)
+	return w.Code, info
+}
+
+func Test_ShareDirectory(t *testing.T) {
+	mockDB := MockDB{}
+	s := Server{maxUpload: 1024 << 20, db: &mockDB, blobs: newTestStore(t, &mockDB)}
+	user2 := testSession(t, "user2")
+
+	code, _ := createTestShare(t, &s, `{"path": "test", "username": "user2"}`)
+	assert.Equal(t, http.StatusConflict, code)
+
+	setTestKeyPair(t, &mockDB, "user2")
+	code, _ = createTestShare(t, &s, `{"path": "test", "username": "user1"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = createTestShare(t, &s, `{"path": "test", "username": "nobody"}`)
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = createTestShare(t, &s, `{"path": "test", "username": "user2", "permission": "admin"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, share := createTestShare(t, &s, `{"path": "test", "username": "user2"}`)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, "read", share.Permission)
+	assert.Equal(t, "/shared/"+share.Id, share.Url)
+	assert.True(t, share.IsDirectory)
+
+	shared := func(method, path, body string, user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/shared/"+share.Id+"/"+path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		paths := []string{share.Id, path}
+		session := testSession(t, user)
+		switch method {
+		case http.MethodGet:
+			s.GetFile(w, req, paths, session)
+		case http.MethodDelete:
+			s.deleteFile(w, req, paths, session)
+		case "MOVE":
+			s.moveFile(w, req, paths, session)
+		}
+		return w
+	}
+
+	w := shared(http.MethodGet, "", "", "user2")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var list ListFilesResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+	assert.Len(t, list.Files, 1)
+
+	// content is decrypted with own key of the shared directory
+	w = shared(http.MethodGet, "foo.txt", "", "user2")
+	assert.Equal(t, http.StatusOK, w.Code)
+	data, _ := ioutil.ReadAll(w.Body)
+	assert.Equal(t, "foo.txt content\n", string(data))
+
+	// share belongs only to its recipient
+	assert.Equal(t, http.StatusNotFound, shared(http.MethodGet, "foo.txt", "", "user1").Code)
+
+	assert.Equal(t, http.StatusForbidden, shared(http.MethodDelete, "foo.txt", "", "user2").Code)
+	assert.Equal(t, http.StatusForbidden, shared("MOVE", "foo.txt", `{"destination": "renamed.txt"}`, "user2").Code)
+
+	// sharing again changes permission of the same share
+	code, writable := createTestShare(t, &s, `{"path": "test", "username": "user2", "permission": "write"}`)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, share.Id, writable.Id)
+	assert.Len(t, mockDB.shares, 1)
+
+	assert.Equal(t, http.StatusOK, shared("MOVE", "foo.txt", `{"destination": "renamed.txt"}`, "user2").Code)
+	assert.Equal(t, "renamed.txt", mockDB.moved["foo.txt"])
+	assert.Equal(t, http.StatusForbidden, shared("MOVE", "", `{"destination": "renamed"}`, "user2").Code)
+	assert.Equal(t, http.StatusForbidden, shared(http.MethodDelete, "", "", "user2").Code)
+
+	// deleted file is moved to trash of the shared directory
+	assert.Equal(t, http.StatusOK, shared(http.MethodDelete, "foo.txt", "", "user2").Code)
+	if assert.Len(t, mockDB.trash, 1) {
+		assert.Equal(t, []string{"foo.txt"}, mockDB.trash[0].Path)
+	}
+	// where the recipient can restore it
+	mockDB.created["test/new.txt"] = &models.File{Name: "new.txt"}
+	assert.Equal(t, http.StatusOK, shared(http.MethodDelete, "new.txt", "", "user2").Code)
+	assert.Nil(t, mockDB.created["test/new.txt"])
+	w = httptest.NewRecorder()
+	s.listTrash(w, httptest.NewRequest(http.MethodGet, "/trash/shared/"+share.Id, nil), []string{share.Id}, testSession(t, "user1"))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = httptest.NewRecorder()
+	s.listTrash(w, httptest.NewRequest(http.MethodGet, "/trash/shared/"+share.Id, nil), []string{share.Id}, user2)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var trash TrashResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&trash))
+	if assert.Len(t, trash.Files, 2) {
+		assert.Equal(t, "new.txt", trash.Files[1].Path)
+		w = httptest.NewRecorder()
+		s.restoreFile(w, httptest.NewRequest(http.MethodPost, "/trash/shared/"+share.Id+"/"+trash.Files[1].Id, nil), []string{share.Id, trash.Files[1].Id}, user2)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NotNil(t, mockDB.created["test/new.txt"])
+	}
+
+	var shares SharesResponse
+	w = httptest.NewRecorder()
+	s.listShares(w, httptest.NewRequest(http.MethodGet, "/shares", nil), nil, testSession(t, "user1"))
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&shares))
+	if assert.Len(t, shares.Shares, 1) {
+		assert.Equal(t, "test", shares.Shares[0].Path)
+		assert.Equal(t, "user2", shares.Shares[0].Recipient)
+	}
+
+	var sharedWithMe SharesResponse
+	w = httptest.NewRecorder()
+	s.listSharedWithMe(w, httptest.NewRequest(http.MethodGet, "/shared", nil), nil, user2)
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&sharedWithMe))
+	if assert.Len(t, sharedWithMe.Shares, 1) {
+		assert.Equal(t, "test", sharedWithMe.Shares[0].Name)
+		assert.Empty(t, sharedWithMe.Shares[0].Path)
+		assert.Equal(t, "user1", sharedWithMe.Shares[0].Owner)
+		assert.Equal(t, "write", sharedWithMe.Shares[0].Permission)
+	}
+
+	// recipient can remove file shared with them
+	w = httptest.NewRecorder()
+	s.deleteShare(w, httptest.NewRequest(http.MethodDelete, "/shares/"+share.Id, nil), []string{share.Id}, user2)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusNotFound, shared(http.MethodGet, "", "", "user2").Code)
+}
+
+func Test_ShareFile(t *testing.T) {
+	mockDB := MockDB{}
+	s := Server{maxUpload: 1024 << 20, db: &mockDB, blobs: newTestStore(t, &mockDB)}
+	setTestKeyPair(t, &mockDB, "user2")
+	user2 := testSession(t, "user2")
+
+	code, share := createTestShare(t, &s, `{"path": "test/foo.txt", "username": "user2"}`)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.False(t, share.IsDirectory)
+
+	// only own key of the shared file is sealed for the recipient
+	private, err := s.privateKey(user2)
+	assert.NoError(t, err)
+	key, err := crypt.OpenKey(private, mockDB.shares[0].WrappedKey)
+	assert.NoError(t, err)
+	assert.NotEqual(t, testSession(t, "user1").Key, key)
+
+	w := httptest.NewRecorder()
+	s.GetFile(w, httptest.NewRequest(http.MethodGet, "/shared/"+share.Id, nil), []string{share.Id, ""}, user2)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "foo.txt content\n", w.Body.String())
+
+	// the shared file isn't a directory
+	w = httptest.NewRecorder()
+	s.GetFile(w, httptest.NewRequest(http.MethodGet, "/shared/"+share.Id+"/other", nil), []string{share.Id, "other"}, user2)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	s.deleteShare(w, httptest.NewRequest(http.MethodDelete, "/shares/"+share.Id, nil), []string{share.Id}, testSession(t, "user1"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, mockDB.shares)
+}
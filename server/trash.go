@@ -0,0 +1,124 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/noisersup/encryptedfs-api/auth"
+	"github.com/noisersup/encryptedfs-api/database"
+	l "github.com/noisersup/encryptedfs-api/logger"
+	"github.com/noisersup/encryptedfs-api/models"
+)
+
+// Handler function for GET requests on /trash (and /groups/{id}/trash, /trash/shared/{id})
+// Lists files in trash of the user, group or shared directory (most recently deleted first)
+func (s *Server) listTrash(w http.ResponseWriter, r *http.Request, paths []string, user *auth.Session) {
+	d, _ := s.openDrive(w, r, paths, user)
+	if d == nil {
+		return
+	}
+
+	items, err := s.db.ListTrash(d.key, d.root)
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+
+	files := make([]TrashedFile, 0, len(items))
+	for i := range items {
+		files = append(files, s.trashedFile(&items[i]))
+	}
+	writeResponse(w, TrashResponse{Files: files}, http.StatusOK)
+}
+
+// Handler function for POST requests on /trash/{id} (and /groups/{id}/trash/{id}, /trash/shared/{id}/{id})
+// Restores file to its original path
+func (s *Server) restoreFile(w http.ResponseWriter, r *http.Request, paths []string, user *auth.Session) {
+	d, paths := s.openDrive(w, r, paths, user)
+	if d == nil || !d.writable(w, nil, false) {
+		return
+	}
+	id, err := uuid.Parse(paths[0])
+	if err != nil {
+		resp404(w)
+		return
+	}
+
+	path, err := s.db.RestoreFile(id, d.key, d.root)
+	if err != nil {
+		switch err {
+		case database.FileNotFound:
+			resp404(w)
+		case database.FileExists:
+			resp409(w, "original path is taken")
+		case database.InvalidMove:
+			resp409(w, "parent of original path is not a directory")
+		case database.LegacyFile:
+			resp409(w, err.Error())
+		default:
+			l.Err("%s", err.Error())
+			resp500(w)
+		}
+		return
+	}
+	writeResponse(w, RestoreResponse{Path: strings.Join(path, "/")}, http.StatusOK)
+}
+
+// Handler function for DELETE requests on /trash/{id} (and /groups/{id}/trash/{id}, /trash/shared/{id}/{id})
+// Permanently deletes the file from trash
+func (s *Server) deleteFromTrash(w http.ResponseWriter, r *http.Request, paths []string, user *auth.Session) {
+	d, paths := s.openDrive(w, r, paths, user)
+	if d == nil || !d.writable(w, nil, false) {
+		return
+	}
+	id, err := uuid.Parse(paths[0])
+	if err != nil {
+		resp404(w)
+		return
+	}
+
+	if err = s.db.DeleteFromTrash(id, d.root); err != nil {
+		if err == database.FileNotFound {
+			resp404(w)
+			return
+		}
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+	respOK(w)
+}
+
+// Handler function for DELETE requests on /trash (and /groups/{id}/trash, /trash/shared/{id})
+// Permanently deletes all files from trash
+func (s *Server) emptyTrash(w http.ResponseWriter, r *http.Request, paths []string, user *auth.Session) {
+	d, _ := s.openDrive(w, r, paths, user)
+	if d == nil || !d.writable(w, nil, false) {
+		return
+	}
+
+	n, err := s.db.EmptyTrash(d.root)
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+	l.LogV("%d files deleted from trash of %s", n, d.root)
+	respOK(w)
+}
+
+func (s *Server) trashedFile(item *models.TrashItem) TrashedFile {
+	f := TrashedFile{
+		Id:         item.Id.String(),
+		ListedFile: listedFile(&item.File),
+		DeletedAt:  item.DeletedAt,
+	}
+	f.Path = strings.Join(item.Path, "/")
+	if s.trashRetention > 0 {
+		expires := item.DeletedAt.Add(s.trashRetention)
+		f.ExpiresAt = &expires
+	}
+	return f
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Trash(t *testing.T) {
+	mockDB := MockDB{}
+	s := Server{maxUpload: 1024 << 20, db: &mockDB, blobs: newTestStore(t, &mockDB), trashRetention: time.Hour}
+	user := testSession(t, "user1")
+
+	upload := func() int {
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		fw, _ := mw.CreateFormFile("file", "new.txt")
+		fw.Write([]byte("content"))
+		mw.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/drive/test", body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		s.uploadFile(w, req, []string{"test"}, user)
+		return w.Code
+	}
+	list := func() []TrashedFile {
+		w := httptest.NewRecorder()
+		s.listTrash(w, httptest.NewRequest(http.MethodGet, "/trash", nil), nil, user)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var resp TrashResponse
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		return resp.Files
+	}
+	restore := func(id string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.restoreFile(w, httptest.NewRequest(http.MethodPost, "/trash/"+id, nil), []string{id}, user)
+		return w
+	}
+
+	assert.Equal(t, http.StatusCreated, upload())
+	w := httptest.NewRecorder()
+	s.deleteFile(w, httptest.NewRequest(http.MethodDelete, "/drive/test/new.txt", nil), []string{"test/new.txt"}, user)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Nil(t, mockDB.created["test/new.txt"])
+
+	w = httptest.NewRecorder()
+	s.deleteFile(w, httptest.NewRequest(http.MethodDelete, "/drive/test/new.txt", nil), []string{"test/new.txt"}, user)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	files := list()
+	if !assert.Len(t, files, 1) {
+		return
+	}
+	assert.Equal(t, "new.txt", files[0].Name)
+	assert.Equal(t, "test/new.txt", files[0].Path)
+	if assert.NotNil(t, files[0].ExpiresAt) {
+		assert.Equal(t, files[0].DeletedAt.Add(time.Hour), *files[0].ExpiresAt)
+	}
+
+	// original path is taken by a new file
+	assert.Equal(t, http.StatusCreated, upload())
+	assert.Equal(t, http.StatusConflict, restore(files[0].Id).Code)
+
+	delete(mockDB.created, "test/new.txt")
+	w = restore(files[0].Id)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var restored RestoreResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&restored))
+	assert.Equal(t, "test/new.txt", restored.Path)
+	assert.NotNil(t, mockDB.created["test/new.txt"])
+	assert.Empty(t, list())
+
+	assert.Equal(t, http.StatusNotFound, restore(files[0].Id).Code)
+	assert.Equal(t, http.StatusNotFound, restore("not-an-id").Code)
+
+	// permanent delete skips trash
+	w = httptest.NewRecorder()
+	s.deleteFile(w, httptest.NewRequest(http.MethodDelete, "/drive/test/new.txt?permanent", nil), []string{"test/new.txt"}, user)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, list())
+}
+
+func Test_EmptyTrash(t *testing.T) {
+	mockDB := MockDB{}
+	s := Server{maxUpload: 1024 << 20, db: &mockDB, blobs: newTestStore(t, &mockDB)}
+	user := testSession(t, "user1")
+
+	for _, path := range []string{"test", "test/foo.txt"} {
+		w := httptest.NewRecorder()
+		s.deleteFile(w, httptest.NewRequest(http.MethodDelete, "/drive/"+path, nil), []string{path}, user)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	assert.Len(t, mockDB.trash, 2)
+	assert.Nil(t, s.trashedFile(&mockDB.trash[0]).ExpiresAt)
+
+	id := mockDB.trash[0].Id.String()
+	w := httptest.NewRecorder()
+	s.deleteFromTrash(w, httptest.NewRequest(http.MethodDelete, "/trash/"+id, nil), []string{id}, user)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, mockDB.trash, 1)
+
+	w = httptest.NewRecorder()
+	s.deleteFromTrash(w, httptest.NewRequest(http.MethodDelete, "/trash/"+id, nil), []string{id}, user)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	s.emptyTrash(w, httptest.NewRequest(http.MethodDelete, "/trash", nil), nil, user)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, mockDB.trash)
+}
@@ -0,0 +1,671 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/noisersup/encryptedfs-api/auth"
+	"github.com/noisersup/encryptedfs-api/crypt"
+	"github.com/noisersup/encryptedfs-api/database"
+	l "github.com/noisersup/encryptedfs-api/logger"
+	"github.com/noisersup/encryptedfs-api/models"
+	"github.com/noisersup/encryptedfs-api/storage"
+)
+
+/*
+	Resumable uploads (tus protocol 1.0.0 with creation, termination and expiration extensions)
+	https://tus.io/protocols/resumable-upload.html
+
+	Data of every PATCH request is encrypted as it arrives and stored as a separate part of the blob.
+	Only whole chunks of the blob format are accepted, so reported offset is always a multiple
+	of chunk size (except the end of file) and the client resends the rest of the request.
+	After the last part is received the parts are joined into a single blob
+	and the file is linked into the file tree.
+
+	If the file can't be linked (e.g. its name is taken) the upload is kept, so the client can finish it
+	with an empty PATCH at the end of the file, optionally with ?conflict=overwrite|rename.
+	Uploads not finished within uploadExpiration are removed with their parts.
+*/
+
+const tusVersion = "1.0.0"
+
+// Time after which unfinished uploads are removed
+const uploadExpiration = 24 * time.Hour
+
+// Sets headers common for all tus responses
+func tusHeaders(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Access-Control-Expose-Headers", "Location, Upload-Offset, Upload-Length, Upload-Expires, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size")
+}
+
+// Sets time after which the upload is removed
+func uploadExpires(w http.ResponseWriter, u *models.Upload) {
+	w.Header().Set("Upload-Expires", u.CreatedAt.Add(uploadExpiration).UTC().Format(http.TimeFormat))
+}
+
+// Returns conflict policy set with conflict query parameter (fail if it isn't set)
+func conflictPolicy(r *http.Request) (models.ConflictPolicy, error) {
+	opts := uploadOptions{conflict: models.ConflictFail}
+	if conflict := r.URL.Query().Get("conflict"); conflict != "" {
+		if err := opts.set("conflict", conflict); err != nil {
+			return "", err
+		}
+	}
+	return opts.conflict, nil
+}
+
+// Checks if client uses supported version of protocol
+func tusVersionOk(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		errResponse(w, http.StatusPreconditionFailed, "Unsupported tus version")
+		return false
+	}
+	return true
+}
+
+// Name of blob holding part of unfinished upload
+func uploadPartName(id uuid.UUID, part int) string {
+	return fmt.Sprintf("upload-%s-%d", id, part)
+}
+
+// Handler function for OPTIONS /uploads requests.
+// Describes supported features of the protocol
+func (s *Server) uploadOptions(w http.ResponseWriter, r *http.Request, _ []string, _ *auth.Session) {
+	tusHeaders(w)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,termination,expiration")
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(s.maxUpload, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler function for POST /uploads requests.
+// Creates new upload of file described by Upload-Length and Upload-Metadata headers
+// (metadata keys: filename - name of the file, path - target directory)
+// Conflict policy (fail, overwrite or rename) of empty files can be set with conflict query parameter
+func (s *Server) createUpload(w http.ResponseWriter, r *http.Request, _ []string, user *auth.Session) {
+	tusHeaders(w)
+	if !tusVersionOk(w, r) {
+		return
+	}
+
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || size < 0 {
+		resp400(w, "Invalid Upload-Length")
+		return
+	}
+	if size > s.maxUpload {
+		errResponse(w, http.StatusRequestEntityTooLarge, "File too big")
+		return
+	}
+
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		resp400(w, "Invalid Upload-Metadata")
+		return
+	}
+	filename := metadata["filename"]
+	if filename == "" || strings.Contains(filename, "/") {
+		resp400(w, "Invalid filename")
+		return
+	}
+	path := append(database.PathToArr(strings.Trim(metadata["path"], "/")), filename)
+	policy, err := conflictPolicy(r)
+	if err != nil {
+		resp400(w, err.Error())
+		return
+	}
+
+	userRoot, err := s.db.GetRoot(user.Username)
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+
+	// fail early instead of after the whole file is sent
+	if _, err = s.db.GetFile(path, user.Key, userRoot); err != nil && err != database.FileNotFound {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	} else if err == nil && policy == models.ConflictFail {
+		resp409(w, "File already exists")
+		return
+	}
+
+	u, err := newUpload(user, path, size)
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+	if err = s.db.NewUpload(u); err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+
+	w.Header().Set("Location", "/uploads/"+u.Id.String())
+	uploadExpires(w, u)
+
+	// empty file is complete right away
+	if size == 0 {
+		status := s.finishEmptyUpload(u, user, userRoot, policy)
+		if status != http.StatusCreated {
+			errResponse(w, status, http.StatusText(status))
+			return
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Received, 10))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Creates upload with new data key and blob header
+func newUpload(user *auth.Session, path []string, size int64) (*models.Upload, error) {
+	dataKey, err := crypt.NewKey()
+	if err != nil {
+		return nil, err
+	}
+	wrappedKey, err := crypt.WrapKey(user.Key, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	sealer, err := newBlobSealer(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	encryptedPath, err := crypt.Encrypt(user.Key, []byte(strings.Join(path, "/")))
+	if err != nil {
+		return nil, err
+	}
+	return &models.Upload{
+		Owner:      user.Username,
+		Path:       encryptedPath,
+		Size:       size,
+		Header:     sealer.header,
+		WrappedKey: wrappedKey,
+	}, nil
+}
+
+// Stores the only (empty) chunk of empty file and links it into the file tree
+func (s *Server) finishEmptyUpload(u *models.Upload, user *auth.Session, userRoot uuid.UUID, policy models.ConflictPolicy) int {
+	dataKey, err := crypt.UnwrapKey(user.Key, u.WrappedKey)
+	if err != nil {
+		l.Err("%s", err.Error())
+		return http.StatusInternalServerError
+	}
+	sealer, err := resumeBlobSealer(dataKey, u.Header)
+	if err != nil {
+		l.Err("%s", err.Error())
+		return http.StatusInternalServerError
+	}
+	if err = s.blobs.Put(uploadPartName(u.Id, 0), bytes.NewReader(sealer.seal(nil, nil, 0, true))); err != nil {
+		l.Err("%s", err.Error())
+		return http.StatusInternalServerError
+	}
+	if err = s.db.AdvanceUpload(u.Id, 0, 0, 1, nil); err != nil {
+		l.Err("%s", err.Error())
+		return http.StatusInternalServerError
+	}
+	u.Parts = 1
+	return s.finishUpload(u, user, userRoot, policy)
+}
+
+// Handler function for HEAD /uploads/{id} requests.
+// Returns offset of the upload
+func (s *Server) headUpload(w http.ResponseWriter, r *http.Request, args []string, user *auth.Session) {
+	tusHeaders(w)
+	w.Header().Set("Cache-Control", "no-store")
+
+	u, status := s.getUpload(args[0], user)
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Received, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Size, 10))
+	uploadExpires(w, u)
+	w.WriteHeader(http.StatusOK)
+}
+
+// Handler function for PATCH /uploads/{id} requests.
+// Encrypts received data and stores it as next part of the upload
+// Conflict policy (fail, overwrite or rename) used when the upload is finished can be set with conflict query parameter
+func (s *Server) patchUpload(w http.ResponseWriter, r *http.Request, args []string, user *auth.Session) {
+	tusHeaders(w)
+	if !tusVersionOk(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		errResponse(w, http.StatusUnsupportedMediaType, "Unsupported Media Type")
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		resp400(w, "Invalid Upload-Offset")
+		return
+	}
+	policy, err := conflictPolicy(r)
+	if err != nil {
+		resp400(w, err.Error())
+		return
+	}
+
+	// the same chunks can't be encrypted concurrently (it would reuse nonces)
+	lock := s.uploadLock(args[0])
+	lock.Lock()
+	defer lock.Unlock()
+
+	u, status := s.getUpload(args[0], user)
+	if status != http.StatusOK {
+		errResponse(w, status, http.StatusText(status))
+		return
+	}
+	if offset != u.Received {
+		resp409(w, "Upload-Offset mismatch")
+		return
+	}
+
+	dataKey, err := crypt.UnwrapKey(user.Key, u.WrappedKey)
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+	sealer, err := resumeBlobSealer(dataKey, u.Header)
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+
+	checksum, err := uploadHash(dataKey, u.HashState)
+	if err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+
+	chunks := newUploadChunkReader(r.Body, sealer, checksum, u.Received, u.Size)
+	partName := uploadPartName(u.Id, u.Parts)
+	if err = s.blobs.Put(partName, chunks); err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+	if chunks.err != nil {
+		l.Warn("upload %s interrupted: %s", u.Id, chunks.err.Error())
+	}
+
+	if chunks.received == 0 {
+		s.blobs.Delete(partName)
+	} else {
+		hashState, err := sealHashState(dataKey, checksum)
+		if err != nil {
+			s.blobs.Delete(partName)
+			l.Err("%s", err.Error())
+			resp500(w)
+			return
+		}
+		err = s.db.AdvanceUpload(u.Id, u.Received, u.Received+chunks.received, u.Parts+1, hashState)
+		if err != nil {
+			s.blobs.Delete(partName)
+			if err == database.UploadConflict {
+				resp409(w, "Upload-Offset mismatch")
+				return
+			}
+			l.Err("%s", err.Error())
+			resp500(w)
+			return
+		}
+		u.Received += chunks.received
+		u.Parts++
+		u.HashState = hashState
+	}
+
+	if u.Received == u.Size {
+		userRoot, err := s.db.GetRoot(user.Username)
+		if err != nil {
+			l.Err("%s", err.Error())
+			resp500(w)
+			return
+		}
+		if status := s.finishUpload(u, user, userRoot, policy); status != http.StatusCreated {
+			errResponse(w, status, http.StatusText(status))
+			return
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Received, 10))
+	uploadExpires(w, u)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler function for DELETE /uploads/{id} requests.
+// Terminates the upload and removes its stored parts
+func (s *Server) terminateUpload(w http.ResponseWriter, r *http.Request, args []string, user *auth.Session) {
+	tusHeaders(w)
+	if !tusVersionOk(w, r) {
+		return
+	}
+
+	lock := s.uploadLock(args[0])
+	lock.Lock()
+	defer lock.Unlock()
+
+	u, status := s.getUpload(args[0], user)
+	if status != http.StatusOK {
+		errResponse(w, status, http.StatusText(status))
+		return
+	}
+
+	if err := s.removeUpload(u); err != nil {
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Gets upload of user from database (expired uploads are treated as removed)
+// Returns upload and http status
+func (s *Server) getUpload(id string, user *auth.Session) (*models.Upload, int) {
+	uploadId, err := uuid.Parse(id)
+	if err != nil {
+		return nil, http.StatusNotFound
+	}
+	u, err := s.db.GetUpload(uploadId, user.Username)
+	if err != nil {
+		if err == database.FileNotFound {
+			return nil, http.StatusNotFound
+		}
+		l.Err("%s", err.Error())
+		return nil, http.StatusInternalServerError
+	}
+	if time.Since(u.CreatedAt) > uploadExpiration {
+		return nil, http.StatusNotFound
+	}
+	return u, http.StatusOK
+}
+
+// Returns mutex guarding writes to upload with provided id
+func (s *Server) uploadLock(id string) *sync.Mutex {
+	lock, _ := s.uploadLocks.LoadOrStore(id, &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
+
+// Joins stored parts of finished upload into a blob and adds the file to file tree resolving conflicts by policy
+// Upload is removed only when the file is added, otherwise it's kept until it expires so it can be finished again
+// Returns http status (StatusCreated on success)
+func (s *Server) finishUpload(u *models.Upload, user *auth.Session, userRoot uuid.UUID, policy models.ConflictPolicy) (status int) {
+	defer func() {
+		if status != http.StatusCreated {
+			return
+		}
+		if err := s.removeUpload(u); err != nil {
+			l.Err("removing upload %s: %s", u.Id, err.Error())
+		}
+	}()
+
+	path, err := crypt.Decrypt(user.Key, u.Path)
+	if err != nil {
+		l.Err("%s", err.Error())
+		return http.StatusInternalServerError
+	}
+	pathNames := database.PathToArr(string(path))
+
+	dataKey, err := crypt.UnwrapKey(user.Key, u.WrappedKey)
+	if err != nil {
+		l.Err("%s", err.Error())
+		return http.StatusInternalServerError
+	}
+	checksum, err := uploadHash(dataKey, u.HashState)
+	if err != nil {
+		l.Err("%s", err.Error())
+		return http.StatusInternalServerError
+	}
+
+	name := newBlobName()
+	if err = s.blobs.Put(name, &uploadPartsReader{blobs: s.blobs, u: u, current: bytes.NewReader(u.Header)}); err != nil {
+		l.Err("%s", err.Error())
+		return http.StatusInternalServerError
+	}
+
+	head, err := blobHead(s.blobs, name, dataKey)
+	if err != nil {
+		s.blobs.Delete(name)
+		l.Err("%s", err.Error())
+		return http.StatusInternalServerError
+	}
+
+	f := models.File{
+		Hash:        name,
+		WrappedKey:  u.WrappedKey,
+		Size:        u.Size,
+		ContentType: detectContentType(pathNames[len(pathNames)-1], head),
+		Checksum:    fmt.Sprintf("%x", checksum.Sum(nil)),
+	}
+	if err = s.db.StoreFile(pathNames, user.Key, &f, userRoot, policy); err != nil {
+		s.blobs.Delete(name)
+		if err == database.FileExists {
+			return http.StatusConflict
+		}
+		l.Err("%s", err.Error())
+		return http.StatusInternalServerError
+	}
+	return http.StatusCreated
+}
+
+// Returns SHA-256 of data received so far restored from its encrypted state
+// (nil state is a state of empty upload)
+func uploadHash(dataKey, state []byte) (hash.Hash, error) {
+	h := sha256.New()
+	if state == nil {
+		return h, nil
+	}
+	plain, err := crypt.Decrypt(dataKey, state)
+	if err != nil {
+		return nil, err
+	}
+	if err = h.(encoding.BinaryUnmarshaler).UnmarshalBinary(plain); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Returns state of SHA-256 encrypted with data key
+// (state of checksum would reveal information about content of the file)
+func sealHashState(dataKey []byte, h hash.Hash) ([]byte, error) {
+	state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return crypt.Encrypt(dataKey, state)
+}
+
+// Returns first bytes of content of blob (used to detect its type)
+func blobHead(blobs storage.BlobStore, name string, key []byte) ([]byte, error) {
+	blob, err := blobs.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+
+	content, err := decryptReader(blob, key)
+	if err != nil {
+		return nil, err
+	}
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(content, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return head[:n], nil
+}
+
+// Removes uploads of all users started before provided time with their stored parts
+// Returns number of removed uploads
+func (s *Server) purgeUploads(createdBefore time.Time) (int, error) {
+	uploads, err := s.db.ListStaleUploads(createdBefore)
+	if err != nil {
+		return 0, err
+	}
+	for i := range uploads {
+		lock := s.uploadLock(uploads[i].Id.String())
+		lock.Lock()
+		err = s.removeUpload(&uploads[i])
+		lock.Unlock()
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(uploads), nil
+}
+
+// Removes stored parts and database entry of upload
+func (s *Server) removeUpload(u *models.Upload) error {
+	for i := 0; i < u.Parts; i++ {
+		if err := s.blobs.Delete(uploadPartName(u.Id, i)); err != nil && err != storage.ErrNotFound {
+			return err
+		}
+	}
+	s.uploadLocks.Delete(u.Id.String())
+	return s.db.DeleteUpload(u.Id)
+}
+
+// Parses Upload-Metadata header (comma separated "key base64(value)" pairs)
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		kv := strings.Fields(pair)
+		if len(kv) == 0 || len(kv) > 2 {
+			return nil, fmt.Errorf("invalid metadata pair: %q", pair)
+		}
+		value := []byte{}
+		if len(kv) == 2 {
+			var err error
+			if value, err = base64.StdEncoding.DecodeString(kv[1]); err != nil {
+				return nil, err
+			}
+		}
+		metadata[kv[0]] = string(value)
+	}
+	return metadata, nil
+}
+
+// uploadChunkReader reads body of PATCH request and returns it as encrypted chunks.
+// Only whole chunks (and the last chunk of the file) are encrypted,
+// the rest of the body is discarded
+type uploadChunkReader struct {
+	body     io.Reader
+	sealer   *blobSealer
+	hash     hash.Hash // checksum of plaintext of encrypted chunks
+	offset   int64     // offset of the next chunk in the file
+	size     int64     // size of the whole file
+	received int64     // number of encrypted bytes of the file
+	plain    []byte
+	out      []byte
+	pending  []byte // encrypted bytes not yet returned by Read
+	done     bool
+	err      error // error which interrupted reading of body
+}
+
+// offset has to be a multiple of chunk size
+func newUploadChunkReader(body io.Reader, sealer *blobSealer, checksum hash.Hash, offset, size int64) *uploadChunkReader {
+	return &uploadChunkReader{
+		body:   body,
+		sealer: sealer,
+		hash:   checksum,
+		offset: offset,
+		size:   size,
+		plain:  make([]byte, blobChunkSize),
+		out:    make([]byte, 0, blobChunkSize+blobTagSize),
+	}
+}
+
+func (u *uploadChunkReader) Read(p []byte) (int, error) {
+	if len(u.pending) == 0 {
+		if u.done || u.offset >= u.size {
+			return 0, io.EOF
+		}
+
+		want := u.size - u.offset
+		if want > blobChunkSize {
+			want = blobChunkSize
+		}
+		n, err := io.ReadFull(u.body, u.plain[:want])
+		if err != nil {
+			// incomplete chunk is discarded,
+			// everything encrypted so far is stored
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				u.err = err
+			}
+			u.done = true
+			return 0, io.EOF
+		}
+
+		last := u.offset+int64(n) == u.size
+		u.hash.Write(u.plain[:n])
+		u.pending = u.sealer.seal(u.out[:0], u.plain[:n], uint32(u.offset/blobChunkSize), last)
+		u.offset += int64(n)
+		u.received += int64(n)
+		u.done = last
+	}
+	n := copy(p, u.pending)
+	u.pending = u.pending[n:]
+	return n, nil
+}
+
+// uploadPartsReader reads stored parts of upload one after another
+// (each part is opened only when it's needed)
+type uploadPartsReader struct {
+	blobs   storage.BlobStore
+	u       *models.Upload
+	next    int // index of the next part to open
+	current io.Reader
+	closer  io.Closer
+}
+
+func (p *uploadPartsReader) Read(b []byte) (int, error) {
+	for {
+		n, err := p.current.Read(b)
+		if err != io.EOF {
+			return n, err
+		}
+		if p.closer != nil {
+			p.closer.Close()
+			p.closer = nil
+		}
+		if p.next == p.u.Parts {
+			return n, io.EOF
+		}
+
+		part, err := p.blobs.Get(uploadPartName(p.u.Id, p.next))
+		if err != nil {
+			return n, err
+		}
+		p.next++
+		p.current = part
+		p.closer = part
+
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/noisersup/encryptedfs-api/models"
+	"github.com/noisersup/encryptedfs-api/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_TusUpload(t *testing.T) {
+	mockDB := MockDB{}
+	blobs := newTestStore(t, &mockDB)
+	s := Server{maxUpload: 1024 << 20, db: &mockDB, blobs: blobs}
+	user := testSession(t, "user1")
+
+	content := make([]byte, blobChunkSize+10)
+	rand.Read(content)
+
+	req := httptest.NewRequest(http.MethodPost, "/uploads", nil)
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Upload-Length", strconv.Itoa(len(content)))
+	req.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte("big.bin"))+",path "+base64.StdEncoding.EncodeToString([]byte("docs")))
+	w := httptest.NewRecorder()
+	s.createUpload(w, req, nil, user)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	id := w.Header().Get("Location")[len("/uploads/"):]
+
+	patch := func(offset int, data []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, "/uploads/"+id, bytes.NewReader(data))
+		req.Header.Set("Tus-Resumable", tusVersion)
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+		w := httptest.NewRecorder()
+		s.patchUpload(w, req, []string{id}, user)
+		return w
+	}
+
+	// incomplete chunk is not accepted
+	w = patch(0, content[:blobChunkSize+5])
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, strconv.Itoa(blobChunkSize), w.Header().Get("Upload-Offset"))
+
+	w = patch(0, content)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	req = httptest.NewRequest(http.MethodHead, "/uploads/"+id, nil)
+	w = httptest.NewRecorder()
+	s.headUpload(w, req, []string{id}, user)
+	assert.Equal(t, strconv.Itoa(blobChunkSize), w.Header().Get("Upload-Offset"))
+
+	w = patch(blobChunkSize, content[blobChunkSize:])
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, strconv.Itoa(len(content)), w.Header().Get("Upload-Offset"))
+
+	// file is linked and upload is removed
+	f := mockDB.created["docs/big.bin"]
+	assert.NotNil(t, f)
+	assert.Equal(t, int64(len(content)), f.Size)
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256(content)), f.Checksum)
+	assert.Equal(t, "application/octet-stream", f.ContentType)
+	assert.Empty(t, mockDB.uploads)
+
+	dataKey, err := fileKey(f, user.Key)
+	assert.NoError(t, err)
+	blob, err := blobs.Get(f.BlobName())
+	assert.NoError(t, err)
+	out := bytes.Buffer{}
+	assert.NoError(t, decrypt(blob, &out, dataKey))
+	assert.True(t, bytes.Equal(content, out.Bytes()))
+
+	list, err := blobs.List()
+	assert.NoError(t, err)
+	assert.Len(t, list, 2, "parts of upload should be removed")
+}
+
+func Test_TusUploadConflict(t *testing.T) {
+	mockDB := MockDB{}
+	blobs := newTestStore(t, &mockDB)
+	s := Server{maxUpload: 1024 << 20, db: &mockDB, blobs: blobs}
+	user := testSession(t, "user1")
+
+	req := httptest.NewRequest(http.MethodPost, "/uploads", nil)
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Upload-Length", "5")
+	req.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte("new.txt")))
+	w := httptest.NewRecorder()
+	s.createUpload(w, req, nil, user)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Upload-Expires"))
+	id := w.Header().Get("Location")[len("/uploads/"):]
+
+	patch := func(offset int, data []byte, query string) int {
+		req := httptest.NewRequest(http.MethodPatch, "/uploads/"+id+query, bytes.NewReader(data))
+		req.Header.Set("Tus-Resumable", tusVersion)
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+		w := httptest.NewRecorder()
+		s.patchUpload(w, req, []string{id}, user)
+		return w.Code
+	}
+
+	// name is taken while the file is uploaded
+	assert.NoError(t, mockDB.NewFile([]string{"new.txt"}, user.Key, &models.File{}, uuid.Nil))
+	assert.Equal(t, http.StatusConflict, patch(0, []byte("first"), ""))
+	assert.Len(t, mockDB.uploads, 1, "upload should be kept")
+
+	assert.Equal(t, http.StatusBadRequest, patch(5, nil, "?conflict=skip"))
+	assert.Equal(t, http.StatusNoContent, patch(5, nil, "?conflict=rename"))
+	assert.NotNil(t, mockDB.created["new (1).txt"])
+	assert.Empty(t, mockDB.uploads)
+}
+
+func Test_PurgeUploads(t *testing.T) {
+	mockDB := MockDB{}
+	blobs := newTestStore(t, &mockDB)
+	s := Server{maxUpload: 1024 << 20, db: &mockDB, blobs: blobs}
+	user := testSession(t, "user1")
+
+	u, err := newUpload(user, []string{"stale.bin"}, 10)
+	assert.NoError(t, err)
+	assert.NoError(t, mockDB.NewUpload(u))
+	assert.NoError(t, mockDB.AdvanceUpload(u.Id, 0, 0, 1, nil))
+	assert.NoError(t, blobs.Put(uploadPartName(u.Id, 0), bytes.NewReader([]byte("part"))))
+
+	n, err := s.purgeUploads(time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// expired upload can't be continued
+	stale := mockDB.uploads[u.Id]
+	stale.CreatedAt = time.Now().Add(-uploadExpiration - time.Minute)
+	mockDB.uploads[u.Id] = stale
+	_, status := s.getUpload(u.Id.String(), user)
+	assert.Equal(t, http.StatusNotFound, status)
+
+	n, err = s.purgeUploads(time.Now().Add(-uploadExpiration))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Empty(t, mockDB.uploads)
+	_, err = blobs.Stat(uploadPartName(u.Id, 0))
+	assert.Equal(t, storage.ErrNotFound, err)
+}
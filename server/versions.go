@@ -0,0 +1,90 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/noisersup/encryptedfs-api/database"
+	l "github.com/noisersup/encryptedfs-api/logger"
+	"github.com/noisersup/encryptedfs-api/models"
+)
+
+// Responds with versions of file on provided path (current one first)
+func (s *Server) listVersions(w http.ResponseWriter, path []string, d *drive) {
+	files, err := s.db.ListVersions(path, d.key, d.root)
+	if err != nil {
+		if err == database.FileNotFound {
+			resp404(w)
+			return
+		}
+		l.Err("%s", err.Error())
+		resp500(w)
+		return
+	}
+
+	versions := make([]FileVersion, 0, len(files))
+	for i := range files {
+		versions = append(versions, fileVersion(&files[i], i == 0))
+	}
+	writeResponse(w, VersionsResponse{Versions: versions}, http.StatusOK)
+}
+
+// Gets provided version of file on provided path
+// Responds with error and returns nil if the version can't be found
+func (s *Server) getVersion(w http.ResponseWriter, version string, path []string, d *drive) *models.File {
+	n, err := strconv.ParseInt(version, 10, 64)
+	if err != nil || n <= 0 {
+		resp400(w, "invalid version")
+		return nil
+	}
+
+	f, err := s.db.GetVersion(path, d.key, d.root, n)
+	if err != nil {
+		if err == database.FileNotFound {
+			resp404(w, "Version not found")
+			return nil
+		}
+		l.Err("%s", err.Error())
+		resp500(w)
+		return nil
+	}
+	return f
+}
+
+// Makes provided version of file on provided path its current content
+// Responds with the new current version
+func (s *Server) promoteVersion(w http.ResponseWriter, version string, path []string, d *drive) {
+	n, err := strconv.ParseInt(version, 10, 64)
+	if err != nil || n <= 0 {
+		resp400(w, "invalid version")
+		return
+	}
+
+	f, err := s.db.PromoteVersion(path, d.key, d.root, n)
+	if err != nil {
+		switch err {
+		case database.FileNotFound:
+			resp404(w, "Version not found")
+		case database.FileExists:
+			resp400(w, "directory has no versions")
+		default:
+			l.Err("%s", err.Error())
+			resp500(w)
+		}
+		return
+	}
+	w.Header().Set("ETag", f.ETag())
+	writeResponse(w, fileVersion(f, true), http.StatusOK)
+}
+
+func fileVersion(f *models.File, current bool) FileVersion {
+	return FileVersion{
+		Version:     f.Version,
+		Current:     current,
+		Size:        f.Size,
+		ContentType: f.ContentType,
+		Checksum:    f.Checksum,
+		ModifiedAt:  f.ModifiedAt,
+		ETag:        f.ETag(),
+	}
+}
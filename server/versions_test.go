@@ -0,0 +1,83 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Versions(t *testing.T) {
+	mockDB := MockDB{}
+	s := Server{maxUpload: 1024 << 20, db: &mockDB, blobs: newTestStore(t, &mockDB)}
+	user := testSession(t, "user1")
+
+	upload := func(content string) {
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		fw, _ := mw.CreateFormFile("file", "report.txt")
+		fw.Write([]byte(content))
+		mw.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/drive/test?conflict=overwrite", body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		s.uploadFile(w, req, []string{"test"}, user)
+		assert.Equal(t, http.StatusCreated, w.Code)
+	}
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.GetFile(w, httptest.NewRequest(http.MethodGet, "/drive/test/report.txt"+query, nil), []string{"test/report.txt"}, user)
+		return w
+	}
+
+	upload("first")
+	upload("second")
+
+	w := get("?versions")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp VersionsResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	if assert.Len(t, resp.Versions, 2) {
+		assert.Equal(t, int64(2), resp.Versions[0].Version)
+		assert.True(t, resp.Versions[0].Current)
+		assert.Equal(t, int64(1), resp.Versions[1].Version)
+		assert.False(t, resp.Versions[1].Current)
+		assert.NotEqual(t, resp.Versions[0].ETag, resp.Versions[1].ETag)
+	}
+
+	w = get("?version=1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	body, _ := ioutil.ReadAll(w.Body)
+	assert.Equal(t, "first", string(body))
+	assert.Equal(t, resp.Versions[1].ETag, w.Header().Get("ETag"))
+
+	assert.Equal(t, http.StatusNotFound, get("?version=7").Code)
+	assert.Equal(t, http.StatusBadRequest, get("?version=first").Code)
+
+	// promoted content becomes a new version
+	w = httptest.NewRecorder()
+	s.uploadFile(w, httptest.NewRequest(http.MethodPost, "/drive/test/report.txt?promote=1", nil), []string{"test/report.txt"}, user)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var promoted FileVersion
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&promoted))
+	assert.Equal(t, int64(3), promoted.Version)
+	assert.Equal(t, promoted.ETag, w.Header().Get("ETag"))
+
+	w = get("")
+	body, _ = ioutil.ReadAll(w.Body)
+	assert.Equal(t, "first", string(body))
+
+	w = httptest.NewRecorder()
+	s.uploadFile(w, httptest.NewRequest(http.MethodPost, "/drive/test/report.txt?promote=9", nil), []string{"test/report.txt"}, user)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	s.GetFile(w, httptest.NewRequest(http.MethodGet, "/drive/test?versions", nil), []string{"test"}, user)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LocalStore keeps blobs as files in a single directory on local filesystem
+type LocalStore struct {
+	dir string
+}
+
+// Creates LocalStore in provided directory (creates directory if it doesn't exist)
+func NewLocalStore(dir string) (*LocalStore, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &LocalStore{dir: dir}, nil
+}
+
+func (s *LocalStore) path(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return "", errors.New("invalid blob name")
+	}
+	return filepath.Join(s.dir, name), nil
+}
+
+// Writes blob to temporary file first and renames it on success
+// so partially written blobs are never visible under their name
+func (s *LocalStore) Put(name string, r io.Reader) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(s.dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *LocalStore) Get(name string) (io.ReadSeekCloser, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, mapErr(err)
+	}
+	return f, nil
+}
+
+func (s *LocalStore) Delete(name string) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	return mapErr(os.Remove(path))
+}
+
+func (s *LocalStore) Stat(name string) (BlobInfo, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return BlobInfo{}, mapErr(err)
+	}
+	return BlobInfo{Name: name, Size: fi.Size()}, nil
+}
+
+func (s *LocalStore) List() ([]BlobInfo, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	blobs := []BlobInfo{}
+	for _, e := range entries {
+		// skip directories and unfinished uploads
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, BlobInfo{Name: e.Name(), Size: fi.Size()})
+	}
+	return blobs, nil
+}
+
+// Converts "not exists" errors to ErrNotFound
+func mapErr(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"sync"
+)
+
+// MemoryStore keeps blobs in memory. Useful for tests
+type MemoryStore struct {
+	mu    sync.RWMutex
+	blobs map[string][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{blobs: map[string][]byte{}}
+}
+
+func (s *MemoryStore) Put(name string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.blobs[name] = data
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *MemoryStore) Get(name string) (io.ReadSeekCloser, error) {
+	s.mu.RLock()
+	data, ok := s.blobs[name]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return nopCloser{bytes.NewReader(data)}, nil
+}
+
+func (s *MemoryStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.blobs[name]; !ok {
+		return ErrNotFound
+	}
+	delete(s.blobs, name)
+	return nil
+}
+
+func (s *MemoryStore) Stat(name string) (BlobInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, ok := s.blobs[name]
+	if !ok {
+		return BlobInfo{}, ErrNotFound
+	}
+	return BlobInfo{Name: name, Size: int64(len(data))}, nil
+}
+
+func (s *MemoryStore) List() ([]BlobInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	blobs := make([]BlobInfo, 0, len(s.blobs))
+	for name, data := range s.blobs {
+		blobs = append(blobs, BlobInfo{Name: name, Size: int64(len(data))})
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].Name < blobs[j].Name })
+	return blobs, nil
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
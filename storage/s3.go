@@ -0,0 +1,421 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Size of a single part of multipart upload
+// (S3 requires all parts except the last one to be at least 5MiB)
+const defaultPartSize = 8 << 20
+
+type S3Config struct {
+	Endpoint  string // ex. https://s3.eu-central-1.amazonaws.com or http://minio:9000
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	PartSize  int64 // size of multipart upload parts (defaultPartSize if 0)
+}
+
+// S3Store keeps blobs as objects in S3-compatible bucket.
+// Objects are addressed with path-style URLs ({endpoint}/{bucket}/{name})
+type S3Store struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+func NewS3Store(cfg S3Config) (*S3Store, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("s3: no bucket provided")
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("s3: invalid endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.PartSize == 0 {
+		cfg.PartSize = defaultPartSize
+	}
+	return &S3Store{cfg: cfg, endpoint: endpoint, client: http.DefaultClient}, nil
+}
+
+// Uploads blob in a single request if it's smaller than part size,
+// otherwise uses multipart upload
+func (s *S3Store) Put(name string, r io.Reader) error {
+	buf := make([]byte, s.cfg.PartSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		resp, err := s.do(http.MethodPut, name, nil, nil, buf[:n])
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.putMultipart(name, r, buf)
+}
+
+func (s *S3Store) putMultipart(name string, r io.Reader, first []byte) error {
+	resp, err := s.do(http.MethodPost, name, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadId string
+	}
+	err = decodeXML(resp, &initiated)
+	if err != nil {
+		return err
+	}
+
+	complete := completeMultipartUpload{}
+	err = func() error {
+		buf := first
+		for partNumber := 1; ; partNumber++ {
+			query := url.Values{
+				"partNumber": {strconv.Itoa(partNumber)},
+				"uploadId":   {initiated.UploadId},
+			}
+			resp, err := s.do(http.MethodPut, name, query, nil, buf)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			complete.Parts = append(complete.Parts, completedPart{partNumber, resp.Header.Get("ETag")})
+
+			buf = buf[:cap(buf)]
+			n, err := io.ReadFull(r, buf)
+			buf = buf[:n]
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil && err != io.ErrUnexpectedEOF {
+				return err
+			}
+		}
+	}()
+
+	if err == nil {
+		var body []byte
+		body, err = xml.Marshal(complete)
+		if err == nil {
+			resp, err = s.do(http.MethodPost, name, url.Values{"uploadId": {initiated.UploadId}}, nil, body)
+			if err == nil {
+				// S3 can report failure of completion with 200 status
+				var result struct {
+					XMLName xml.Name
+				}
+				if err = decodeXML(resp, &result); err == nil && result.XMLName.Local == "Error" {
+					err = errors.New("s3: completing multipart upload failed")
+				}
+			}
+		}
+	}
+
+	if err != nil {
+		if resp, abortErr := s.do(http.MethodDelete, name, url.Values{"uploadId": {initiated.UploadId}}, nil, nil); abortErr == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *S3Store) Get(name string) (io.ReadSeekCloser, error) {
+	bi, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Reader{s: s, name: name, size: bi.Size}, nil
+}
+
+func (s *S3Store) Delete(name string) error {
+	// S3 doesn't report deletion of missing objects
+	if _, err := s.Stat(name); err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodDelete, name, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Store) Stat(name string) (BlobInfo, error) {
+	resp, err := s.do(http.MethodHead, name, nil, nil, nil)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	resp.Body.Close()
+	return BlobInfo{Name: name, Size: resp.ContentLength}, nil
+}
+
+func (s *S3Store) List() ([]BlobInfo, error) {
+	blobs := []BlobInfo{}
+	query := url.Values{"list-type": {"2"}}
+	for {
+		resp, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key  string
+				Size int64
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if err = decodeXML(resp, &result); err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			blobs = append(blobs, BlobInfo{Name: c.Key, Size: c.Size})
+		}
+		if !result.IsTruncated {
+			return blobs, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// s3Reader reads object with ranged GET requests.
+// Request is made lazily on first Read after Seek
+type s3Reader struct {
+	s      *S3Store
+	name   string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *s3Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", r.offset)}}
+		resp, err := r.s.do(http.MethodGet, r.name, nil, header, nil)
+		if err != nil {
+			return 0, err
+		}
+		r.body = resp.Body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if err == io.EOF && r.offset < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("s3: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("s3: negative position")
+	}
+	if offset != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *s3Reader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+func decodeXML(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	return xml.NewDecoder(resp.Body).Decode(v)
+}
+
+// Sends signed request for object with provided name (or bucket if name is empty).
+// Returns ErrNotFound on 404 and error on every other non 2xx status
+func (s *S3Store) do(method, name string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.cfg.Bucket
+	if name != "" {
+		u.Path += "/" + name
+	}
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.sign(req, body, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3: %s %s: %s %s", method, name, resp.Status, msg)
+	}
+	return resp, nil
+}
+
+/*
+	AWS Signature Version 4
+	https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+*/
+
+func (s *S3Store) sign(req *http.Request, body []byte, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+
+	payloadHash := sha256Hex(body)
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	// host is not a part of req.Header
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if k == "range" || k == "content-type" || k == "content-md5" || strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, s.cfg.Region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), date)
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, scope, signedHeaders, signature,
+	))
+}
+
+// Query string with sorted and encoded keys and values
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := []string{}
+	for _, k := range keys {
+		for _, v := range query[k] {
+			pairs = append(pairs, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// Encodes everything except unreserved characters (and slashes if encodeSlash is false)
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
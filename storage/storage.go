@@ -0,0 +1,32 @@
+/*
+	Blob storage of encrypted file contents
+*/
+package storage
+
+import (
+	"errors"
+	"io"
+)
+
+var ErrNotFound error = errors.New("Blob not found")
+
+// BlobInfo describes a single blob kept in a BlobStore
+type BlobInfo struct {
+	Name string
+	Size int64
+}
+
+// BlobStore is a place where encrypted contents of files are kept.
+// Blobs are addressed by flat names (see models.File.BlobName)
+type BlobStore interface {
+	// Stores everything read from r under provided name (overwrites existing blob)
+	Put(name string, r io.Reader) error
+	// Opens blob for reading. Returns ErrNotFound if blob doesn't exist
+	Get(name string) (io.ReadSeekCloser, error)
+	// Removes blob. Returns ErrNotFound if blob doesn't exist
+	Delete(name string) error
+	// Returns info about blob. Returns ErrNotFound if blob doesn't exist
+	Stat(name string) (BlobInfo, error)
+	// Lists all blobs in the store
+	List() ([]BlobInfo, error)
+}
@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testStore(t *testing.T, s BlobStore) {
+	_, err := s.Get("missing")
+	assert.Equal(t, ErrNotFound, err)
+	_, err = s.Stat("missing")
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, ErrNotFound, s.Delete("missing"))
+
+	assert.NoError(t, s.Put("foo", strings.NewReader("foo content")))
+	assert.NoError(t, s.Put("bar", strings.NewReader("bar")))
+
+	bi, err := s.Stat("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, BlobInfo{Name: "foo", Size: 11}, bi)
+
+	blob, err := s.Get("foo")
+	assert.NoError(t, err)
+	_, err = blob.Seek(4, io.SeekStart)
+	assert.NoError(t, err)
+	data, err := io.ReadAll(blob)
+	assert.NoError(t, err)
+	assert.Equal(t, "content", string(data))
+	assert.NoError(t, blob.Close())
+
+	blobs, err := s.List()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []BlobInfo{{"foo", 11}, {"bar", 3}}, blobs)
+
+	assert.NoError(t, s.Delete("foo"))
+	_, err = s.Stat("foo")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestLocalStore(t *testing.T) {
+	s, err := NewLocalStore(t.TempDir())
+	assert.NoError(t, err)
+	testStore(t, s)
+
+	assert.Error(t, s.Put("../escape", strings.NewReader("")))
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}